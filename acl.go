@@ -0,0 +1,41 @@
+package pri_dns
+
+import (
+	"net"
+
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/types"
+)
+
+// 访问控制中的功能，为空时表示只检查是否允许使用插件
+const (
+	aclForward = "forward" // 使用转发规则
+	aclAdmin   = "admin"   // 访问后台接口
+	aclRules   = "rules"   // 修改自己的私有规则
+)
+
+// aclAllowed 判断客户端 host 能否使用功能 feature。客户端需要先通过 allow 和 deny 的检查，再检查功能对应的集合。
+// host 不是合法IP时只有没有任何相关限制才允许
+func aclAllowed(acl types.AclConfig, host, feature string) bool {
+	ip := net.ParseIP(host)
+	if acl.Deny != nil && (ip == nil || acl.Deny.Contains(ip)) {
+		return false
+	}
+	if !aclContains(acl.Allow, ip) {
+		return false
+	}
+	switch feature {
+	case aclForward:
+		return aclContains(acl.Forward, ip)
+	case aclAdmin:
+		return aclContains(acl.Admin, ip)
+	case aclRules:
+		return aclContains(acl.Rules, ip)
+	}
+	return true
+}
+
+// aclContains 判断 ip 是否属于 set，set 为 nil 时表示不限制
+func aclContains(set *cidrMerger.IpSet, ip net.IP) bool {
+	return set == nil || (ip != nil && set.Contains(ip))
+}
@@ -0,0 +1,83 @@
+package pri_dns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+func Test_aclAllowed(t *testing.T) {
+	acl := types.AclConfig{
+		Allow:   mustLoadIpSet("192.168.0.0/16", "10.0.0.0/8"),
+		Deny:    mustLoadIpSet("192.168.9.0/24"),
+		Forward: mustLoadIpSet("192.168.1.0/24"),
+		Admin:   mustLoadIpSet("10.0.0.1"),
+	}
+	tests := []struct {
+		host    string
+		feature string
+		want    bool
+	}{
+		{"192.168.1.2", "", true},
+		{"192.168.1.2", aclForward, true},
+		{"192.168.2.2", aclForward, false},
+		{"192.168.9.2", "", false},
+		{"192.168.9.2", aclRules, false},
+		{"172.16.0.1", "", false},
+		{"10.0.0.1", aclAdmin, true},
+		{"10.0.0.2", aclAdmin, false},
+		{"10.0.0.2", aclRules, true}, // 没有配置 rules 时不限制
+		{"invalid", "", false},
+	}
+	for _, tt := range tests {
+		if got := aclAllowed(acl, tt.host, tt.feature); got != tt.want {
+			t.Errorf("aclAllowed(%s, %q) = %v, want %v", tt.host, tt.feature, got, tt.want)
+		}
+	}
+
+	// 没有任何限制时所有客户端都允许
+	if !aclAllowed(types.AclConfig{}, "invalid", aclForward) {
+		t.Error("empty acl should allow all clients")
+	}
+}
+
+func TestAclServeDNS(t *testing.T) {
+	store := memory.NewStore()
+	err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{
+		{Name: "example.com", Value: "10.0.0.1", Ttl: 60, DnsType: "A", Enable: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		acl      types.AclConfig
+		wantCode int
+	}{
+		{"允许", types.AclConfig{Allow: mustLoadIpSet("10.240.0.0/16")}, dns.RcodeSuccess},
+		{"不在允许范围内", types.AclConfig{Allow: mustLoadIpSet("192.168.0.0/16")}, dns.RcodeNotImplemented},
+		{"禁止", types.AclConfig{Deny: mustLoadIpSet("10.240.0.1")}, dns.RcodeNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewPriDns(&types.Config{Acl: tt.acl}, store)
+			defer func() { _ = d.closeFunc() }()
+			d.Next = test.NextHandler(dns.RcodeNotImplemented, nil)
+
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			// test.ResponseWriter 的客户端地址为 10.240.0.1
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			code, err := d.ServeDNS(context.Background(), rec, r)
+			if code != tt.wantCode || err != nil {
+				t.Errorf("code = %d, err = %v, want %d", code, err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -14,15 +14,18 @@ func TestRange_ToIpNets(t *testing.T) {
 	tests := []struct {
 		name   string
 		fields fields
-		want   []*net.IPNet
+		want   []string
 	}{
 		{
 			name:   "0.0.0.0 - 255.0.0.0",
 			fields: fields{start: net.ParseIP("0.0.0.0"), end: net.ParseIP("255.0.0.0")},
-			want: []*net.IPNet{
-				{IP: net.ParseIP("0.0.0.0"), Mask: net.CIDRMask(0, 32)},
-				{IP: net.ParseIP("0.0.0.0"), Mask: net.CIDRMask(0, 32)},
-			},
+			want: []string{"0.0.0.0/1", "128.0.0.0/2", "192.0.0.0/3", "224.0.0.0/4", "240.0.0.0/5",
+				"248.0.0.0/6", "252.0.0.0/7", "254.0.0.0/8", "255.0.0.0/32"},
+		},
+		{
+			name:   "2001:db8:: - 2001:db8::1:ffff",
+			fields: fields{start: net.ParseIP("2001:db8::"), end: net.ParseIP("2001:db8::1:ffff")},
+			want:   []string{"2001:db8::/111"},
 		},
 	}
 	for _, tt := range tests {
@@ -31,9 +34,17 @@ func TestRange_ToIpNets(t *testing.T) {
 				Start: tt.fields.start,
 				End:   tt.fields.end,
 			}
-			if got := r.ToIpNets(); !reflect.DeepEqual(got, tt.want) {
+			if got := IpNetToString(r.ToIpNets()); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("ToIpNets() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestStrToIpNet(t *testing.T) {
+	got := IpNetToString(StrToIpNet([]string{"1.2.3.4", "1.2.3.0/24", "2001:db8::1", "2001:db8::/32", "bad"}))
+	want := []string{"1.2.3.4/32", "1.2.3.0/24", "2001:db8::1/128", "2001:db8::/32"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StrToIpNet() = %v, want %v", got, want)
+	}
+}
@@ -49,9 +49,13 @@ func StrToIpNet(hosts []string) []*net.IPNet {
 	hostIPNets := make([]*net.IPNet, len(hosts))
 	i := 0
 	for _, host := range hosts {
-		// 如果不是 CIDR 格式则在末尾拼接掩码将其转换为 CIDR 格式
+		// 如果不是 CIDR 格式则在末尾拼接掩码将其转换为 CIDR 格式，IPv4 为 32 位，IPv6 为 128 位
 		if strings.IndexByte(host, '/') == -1 {
-			host = fmt.Sprintf("%s/%d", host, 32)
+			bits := 32
+			if strings.IndexByte(host, ':') != -1 {
+				bits = 128
+			}
+			host = fmt.Sprintf("%s/%d", host, bits)
 		}
 
 		_, ipNet, err := net.ParseCIDR(host)
@@ -0,0 +1,105 @@
+package cidr_merger
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IpSet 表示一个只读的IP集合，内部以排序合并后的IP范围存储，查询时使用二分查找
+type IpSet struct {
+	ranges []*Range
+}
+
+// NewIpSet 根据IP范围创建IP集合
+func NewIpSet(ranges []IRange) *IpSet {
+	rs := make([]*Range, 0, len(ranges))
+	for _, r := range ranges {
+		rs = append(rs, normalizeRange(r.ToRange()))
+	}
+	return &IpSet{ranges: SortAndMerge(rs)}
+}
+
+// LoadIpSet 根据来源创建IP集合，来源可以是IP、CIDR、IP范围，也可以是文件路径。
+// 文件中每行一个IP、CIDR或IP范围，空行以及以'#'开头的行将被忽略
+func LoadIpSet(sources ...string) (*IpSet, error) {
+	var ranges []IRange
+	for _, source := range sources {
+		if r, err := Parse(source); err == nil {
+			ranges = append(ranges, r)
+			continue
+		}
+		rs, err := readIpFile(source)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, rs...)
+	}
+	return NewIpSet(ranges), nil
+}
+
+func readIpFile(path string) ([]IRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ranges []IRange
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		r, err := Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, scanner.Err()
+}
+
+// Contains 判断IP是否属于该集合
+func (s *IpSet) Contains(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	// 找到第一个结束地址不小于 ip 的范围
+	i := sort.Search(len(s.ranges), func(i int) bool {
+		return !lessThan(s.ranges[i].End, ip)
+	})
+	return i < len(s.ranges) && !lessThan(ip, s.ranges[i].Start)
+}
+
+// Len 返回集合中合并后的IP范围数量
+func (s *IpSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.ranges)
+}
+
+// Ranges 返回集合中合并后的IP范围
+func (s *IpSet) Ranges() []*Range {
+	if s == nil {
+		return nil
+	}
+	return s.ranges
+}
+
+// 将 IPv4 地址统一为4字节格式，以保证同一地址族的范围长度一致
+func normalizeRange(r *Range) *Range {
+	start, end := r.Start, r.End
+	if s4, e4 := start.To4(), end.To4(); s4 != nil && e4 != nil {
+		start, end = s4, e4
+	}
+	return &Range{Start: start, End: end}
+}
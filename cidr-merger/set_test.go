@@ -0,0 +1,34 @@
+package cidr_merger
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIpSet_Contains(t *testing.T) {
+	set, err := LoadIpSet("1.2.3.0/24", "10.0.0.1-10.0.0.5", "8.8.8.8", "2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.2.3.4", true},
+		{"1.2.4.0", false},
+		{"10.0.0.5", true},
+		{"10.0.0.6", false},
+		{"8.8.8.8", true},
+		{"8.8.4.4", false},
+		{"::ffff:1.2.3.4", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := set.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package pri_dns
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/types"
+	"github.com/pires/go-proxyproto"
+)
+
+// unixPeerIp 通过 unix socket 连接时对端没有IP，视为该地址
+const unixPeerIp = "127.0.0.1"
+
+// clientIp 返回后台接口请求者的IP，见 resolveClientIp
+func clientIp(config *types.Config, ctx iris.Context) string {
+	peer := ctx.RemoteAddr()
+	if net.ParseIP(peer) == nil {
+		peer = unixPeerIp
+	}
+	return resolveClientIp(config.TrustedProxies, peer, ctx.Request().Header)
+}
+
+// resolveClientIp 根据直接连接的对端 peer（启用 PROXY protocol 时为其中的源地址）以及请求头确定请求者的IP.
+// 只有 peer 属于 trusted 时才会依次使用 Forwarded、X-Forwarded-For、X-Real-IP 请求头：从右往左跳过属于 trusted 的代理，
+// 第一个不属于 trusted 的地址即为请求者；遇到无法解析的地址时停止，使用最后一个可信的地址
+func resolveClientIp(trusted *cidrMerger.IpSet, peer string, header http.Header) string {
+	if trusted == nil || !trusted.Contains(net.ParseIP(peer)) {
+		return peer
+	}
+	chain := forwardedFor(header.Values("Forwarded"))
+	if len(chain) == 0 {
+		for _, v := range header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	}
+	if len(chain) == 0 {
+		if ip := parseForwardedIp(header.Get("X-Real-IP")); ip != nil {
+			return ip.String()
+		}
+		return peer
+	}
+	host := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseForwardedIp(chain[i])
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !trusted.Contains(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// forwardedFor 返回 Forwarded 请求头（RFC 7239）中所有 for 参数的值，按出现的顺序排列
+func forwardedFor(values []string) []string {
+	var dst []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					dst = append(dst, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	return dst
+}
+
+// parseForwardedIp 解析请求头中的地址，地址可能带有端口，IPv6 地址可能带有方括号。无法解析（如 "unknown"）时返回 nil
+func parseForwardedIp(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
+
+// proxyProtocolPolicy 返回 PROXY protocol 的使用策略：只使用可信代理（unix socket 的对端视为 unixPeerIp）发送的 PROXY 头，
+// 其他连接的 PROXY 头将被忽略，没有配置可信代理时忽略所有 PROXY 头，以免客户端冒充其他IP。没有 PROXY 头的连接均可正常使用
+func proxyProtocolPolicy(trusted *cidrMerger.IpSet) proxyproto.PolicyFunc {
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		if trusted == nil {
+			return proxyproto.IGNORE, nil
+		}
+		ip := net.ParseIP(unixPeerIp)
+		if addr, ok := upstream.(*net.TCPAddr); ok {
+			ip = addr.IP
+		}
+		if trusted.Contains(ip) {
+			return proxyproto.USE, nil
+		}
+		return proxyproto.IGNORE, nil
+	}
+}
@@ -0,0 +1,97 @@
+package pri_dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/laeni/pri-dns/types"
+)
+
+func Test_resolveClientIp(t *testing.T) {
+	trusted := mustLoadIpSet("127.0.0.1", "10.0.0.0/8")
+	tests := []struct {
+		name   string
+		peer   string
+		header map[string]string
+		want   string
+	}{
+		{"没有请求头", "127.0.0.1", nil, "127.0.0.1"},
+		{"不可信的对端", "192.168.1.2", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "192.168.1.2"},
+		{"X-Forwarded-For", "127.0.0.1", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"跳过可信代理", "127.0.0.1", map[string]string{"X-Forwarded-For": "5.6.7.8, 1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"全部为可信代理", "127.0.0.1", map[string]string{"X-Forwarded-For": "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"无法解析的地址", "127.0.0.1", map[string]string{"X-Forwarded-For": "unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"X-Real-IP", "127.0.0.1", map[string]string{"X-Real-IP": "1.2.3.4"}, "1.2.3.4"},
+		{"Forwarded优先", "127.0.0.1", map[string]string{
+			"Forwarded":       `for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"`,
+			"X-Forwarded-For": "1.2.3.4",
+		}, "2001:db8::1"},
+		{"带端口", "127.0.0.1", map[string]string{"X-Forwarded-For": "1.2.3.4:5678"}, "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			if got := resolveClientIp(trusted, tt.peer, header); got != tt.want {
+				t.Errorf("resolveClientIp() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// 没有配置可信代理时不使用请求头
+	if got := resolveClientIp(nil, "127.0.0.1", http.Header{"X-Forwarded-For": {"1.2.3.4"}}); got != "127.0.0.1" {
+		t.Errorf("resolveClientIp() without trusted proxies = %s", got)
+	}
+}
+
+func Test_newAdminListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{"没有可信代理时忽略PROXY头", "", "127.0.0.1"},
+		{"可信代理", "127.0.0.1", "1.2.3.4"},
+		{"忽略不可信代理的PROXY头", "10.0.0.0/8", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &types.Config{ServerPort: "127.0.0.1:0", ProxyProtocol: true}
+			if tt.trusted != "" {
+				config.TrustedProxies = mustLoadIpSet(tt.trusted)
+			}
+			ln, err := newAdminListener(config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			svr := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				host, _, _ := net.SplitHostPort(r.RemoteAddr)
+				_, _ = w.Write([]byte(host))
+			})}
+			go func() { _ = svr.Serve(ln) }()
+			defer svr.Close()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_, _ = fmt.Fprint(conn, "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\nGET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("remote addr = %s, want %s", body, tt.want)
+			}
+		})
+	}
+}
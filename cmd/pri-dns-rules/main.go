@@ -0,0 +1,88 @@
+// pri-dns-rules 是用于批量导入导出 pri-dns 规则的命令行工具，功能与后台接口 /api/export 和 /api/import 相同.
+//
+// 用法:
+//
+//	pri-dns-rules [-driver mysql|postgres|sqlite] -dsn DSN export -type domain -format zone [-client IP] > rules.zone
+//	pri-dns-rules -dsn DSN import -type forward -format dnsmasq [-client IP] [-replace] [-dry-run] [-actor NAME] FILE
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	sqlStore "github.com/laeni/pri-dns/db/sql"
+	"github.com/laeni/pri-dns/ruleio"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func main() {
+	driver := flag.String("driver", sqlStore.DriverMySQL, "数据库驱动: mysql | postgres | sqlite")
+	dsn := flag.String("dsn", os.Getenv("PRI_DNS_DSN"), "数据库连接串，默认读取环境变量 PRI_DNS_DSN")
+	flag.Usage = usage
+	flag.Parse()
+	if *dsn == "" || flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	kind := cmd.String("type", ruleio.KindDomain, "规则类型: domain | forward")
+	format := cmd.String("format", "", "文件格式: zone | hosts（domain）, dnsmasq | unbound | coredns（forward）")
+	client := cmd.String("client", "", "生效范围，即客户端地址，为空时表示全局规则")
+	replace := cmd.Bool("replace", false, "导入时删除生效范围内导入文件中不存在的规则")
+	dryRun := cmd.Bool("dry-run", false, "导入时只输出变更而不保存")
+	actor := cmd.String("actor", "cli:"+os.Getenv("USER"), "导入时记录到审计记录中的操作者")
+	_ = cmd.Parse(flag.Args()[1:])
+
+	ormDb, err := sqlStore.Open(*driver, *dsn, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		fatal(err)
+	}
+	store := sqlStore.NewStore(ormDb)
+	opts := ruleio.Options{Kind: *kind, Format: *format, Host: *client, Replace: *replace, DryRun: *dryRun, Actor: *actor}
+
+	switch cmd.Name() {
+	case "export":
+		skipped, err := ruleio.Export(&store, opts, os.Stdout)
+		if err != nil {
+			fatal(err)
+		}
+		for _, it := range skipped {
+			fmt.Fprintln(os.Stderr, "跳过:", it)
+		}
+	case "import":
+		var in io.Reader = os.Stdin
+		if cmd.NArg() > 0 && cmd.Arg(0) != "-" {
+			f, err := os.Open(cmd.Arg(0))
+			if err != nil {
+				fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		result, err := ruleio.Import(&store, opts, in)
+		if err != nil {
+			fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "用法: %s [-driver DRIVER] [-dsn DSN] export|import [选项] [FILE]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
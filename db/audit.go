@@ -0,0 +1,141 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/laeni/pri-dns/types"
+)
+
+// 审计记录中的规则类型
+const (
+	RuleTypeDomain    = "domain"
+	RuleTypeForward   = "forward"
+	RuleTypeHistoryEx = "history_ex"
+)
+
+// 审计记录中的操作
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditLog 规则变更的审计记录，每条规则的每次变更一条记录，同一规则的所有记录即为该规则的版本历史.
+type AuditLog struct {
+	ID         int64
+	RuleType   string          // 规则类型。<br />domain | forward | history_ex
+	RuleId     int64           // 规则ID
+	ClientHost string          // 规则的生效范围，变更前后不同时为变更后的
+	Action     string          // 操作。<br />create | update | delete
+	Actor      string          // 操作者
+	ClientIp   string          // 操作者的IP
+	Before     string          // 变更前的规则（JSON），新增时为空
+	After      string          // 变更后的规则（JSON），删除时为空
+	CreateTime types.LocalTime // 变更时间
+}
+
+// AuditFilter 查询审计记录的条件，为零值的条件表示不限。结果按时间倒序排列
+type AuditFilter struct {
+	ID         int64
+	RuleType   string
+	RuleId     int64
+	ClientHost *string // 规则的生效范围，为 nil 时表示不限，为空字符串时表示全局规则
+	Actor      string
+	ClientIp   string
+	Since      time.Time // 不早于该时间
+	Until      time.Time // 早于该时间
+	Limit      int       // 最多返回的数量，为 0 时不限
+}
+
+// Match 判断审计记录是否满足条件，不考虑 Limit
+func (f AuditFilter) Match(log AuditLog) bool {
+	t := time.Time(log.CreateTime)
+	return (f.ID == 0 || log.ID == f.ID) &&
+		(f.RuleType == "" || log.RuleType == f.RuleType) &&
+		(f.RuleId == 0 || log.RuleId == f.RuleId) &&
+		(f.ClientHost == nil || log.ClientHost == *f.ClientHost) &&
+		(f.Actor == "" || log.Actor == f.Actor) &&
+		(f.ClientIp == "" || log.ClientIp == f.ClientIp) &&
+		(f.Since.IsZero() || !t.Before(f.Since)) &&
+		(f.Until.IsZero() || t.Before(f.Until))
+}
+
+// NewAuditLog 创建一条审计记录，before 和 after 为变更前后的规则，只能是 *Domain、*Forward 或 *HistoryEx，新增时 before 为 nil，删除时 after 为 nil.
+// 使用指针是为了让 types.LocalTime 的 MarshalJSON 生效
+func NewAuditLog(changes RuleChanges, action string, before, after any) AuditLog {
+	log := AuditLog{Action: action, Actor: changes.Actor, ClientIp: changes.ClientIp, CreateTime: types.LocalTime(time.Now())}
+	for _, it := range []struct {
+		rule any
+		dst  *string
+	}{{before, &log.Before}, {after, &log.After}} {
+		if it.rule == nil {
+			continue
+		}
+		// 规则中只有基本类型和时间，不会序列化失败
+		data, _ := json.Marshal(it.rule)
+		*it.dst = string(data)
+		switch v := it.rule.(type) {
+		case *Domain:
+			log.RuleType, log.RuleId, log.ClientHost = RuleTypeDomain, v.ID, v.ClientHost
+		case *Forward:
+			log.RuleType, log.RuleId, log.ClientHost = RuleTypeForward, v.ID, v.ClientHost
+		case *HistoryEx:
+			log.RuleType, log.RuleId, log.ClientHost = RuleTypeHistoryEx, v.ID, v.ClientHost
+		default:
+			panic(fmt.Sprintf("unsupported rule type %T", it.rule))
+		}
+	}
+	return log
+}
+
+// ErrNotRevertible 表示审计记录无法用于恢复规则，如规则类型未知
+var ErrNotRevertible = errors.New("audit log is not revertible")
+
+// RevertChanges 返回将规则恢复到审计记录 log 对应的版本（即该次变更之后的状态）所需的变更，log 为删除记录时表示删除该规则.
+// 规则当前是否存在根据该规则最新的审计记录判断，已删除的规则将使用原来的 ID 重新创建。返回的变更没有设置 Actor 和 ClientIp
+func RevertChanges(store Store, log AuditLog) (RuleChanges, error) {
+	latest, err := store.FindAudit(AuditFilter{RuleType: log.RuleType, RuleId: log.RuleId, Limit: 1})
+	if err != nil {
+		return RuleChanges{}, err
+	}
+	exists := len(latest) > 0 && latest[0].Action != AuditDelete
+
+	var changes RuleChanges
+	switch log.RuleType {
+	case RuleTypeDomain:
+		err = revert(log, exists, &changes.CreateDomains, &changes.UpdateDomains, &changes.DeleteDomains)
+	case RuleTypeForward:
+		err = revert(log, exists, &changes.CreateForwards, &changes.UpdateForwards, &changes.DeleteForwards)
+	case RuleTypeHistoryEx:
+		err = revert(log, exists, &changes.CreateHistoryExes, &changes.UpdateHistoryExes, &changes.DeleteHistoryExes)
+	default:
+		err = fmt.Errorf("%w: unknown rule type %s", ErrNotRevertible, log.RuleType)
+	}
+	return changes, err
+}
+
+func revert[T any](log AuditLog, exists bool, create, update, del *[]T) error {
+	if log.Action == AuditDelete {
+		if exists {
+			var rule T
+			if err := json.Unmarshal([]byte(log.Before), &rule); err != nil {
+				return err
+			}
+			*del = append(*del, rule)
+		}
+		return nil
+	}
+	var rule T
+	if err := json.Unmarshal([]byte(log.After), &rule); err != nil {
+		return err
+	}
+	if exists {
+		*update = append(*update, rule)
+	} else {
+		*create = append(*create, rule)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+// Package memory 提供一个基于内存的 db.Store 实现，数据不会持久化，主要作为其他实现的参考以及用于测试.
+package memory
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+	"github.com/laeni/pri-dns/util"
+)
+
+// historyKey 解析历史的唯一键，与 SQL 存储中 history_ip 表的唯一索引相同
+type historyKey struct {
+	name       string
+	forwardId  int64
+	clientHost string
+	ipNet      string
+}
+
+type Store struct {
+	mu          sync.RWMutex
+	lastId      int64
+	domains     []db.Domain
+	forwards    []db.Forward
+	history     map[historyKey]db.HistoryIp
+	historyExes []db.HistoryEx
+	audits      []db.AuditLog
+	watchers    map[chan struct{}]struct{}
+}
+
+func NewStore() *Store {
+	return &Store{history: make(map[historyKey]db.HistoryIp), watchers: make(map[chan struct{}]struct{})}
+}
+
+// NewStoreWithRules 创建包含指定规则的存储，规则的ID等字段保持不变
+func NewStoreWithRules(domains []db.Domain, forwards []db.Forward) *Store {
+	s := NewStore()
+	s.domains = append(s.domains, domains...)
+	for _, it := range domains {
+		s.lastId = max(s.lastId, it.ID)
+	}
+	for _, it := range forwards {
+		s.forwards = append(s.forwards, copyForward(it))
+		s.lastId = max(s.lastId, it.ID)
+	}
+	return s
+}
+
+func (s *Store) FindForwardByHostAndName(host, name string) ([]db.Forward, error) {
+	return s.FindForwardByHostAndNames(host, util.GenAllMatchDomain(name))
+}
+
+func (s *Store) FindForwardByHostAndNames(host string, names []string) ([]db.Forward, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var dst []db.Forward
+	for _, it := range s.forwards {
+		if visible(it.ClientHost, host) && contains(names, it.Name) {
+			dst = append(dst, copyForward(it))
+		}
+	}
+	return dst, nil
+}
+
+func (s *Store) FindDomainByHostAndName(host, qname string) ([]db.Domain, error) {
+	names := util.GenAllMatchDomain(qname)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var dst []db.Domain
+	for _, it := range s.domains {
+		if visible(it.ClientHost, host) && contains(names, it.Name) {
+			dst = append(dst, it)
+		}
+	}
+	return dst, nil
+}
+
+func (s *Store) FindDomainByHost(host string) ([]db.Domain, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var dst []db.Domain
+	for _, it := range s.domains {
+		if it.ClientHost == host {
+			dst = append(dst, it)
+		}
+	}
+	return dst, nil
+}
+
+func (s *Store) FindForwardByHost(host string) ([]db.Forward, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var dst []db.Forward
+	for _, it := range s.forwards {
+		if it.ClientHost == host {
+			dst = append(dst, copyForward(it))
+		}
+	}
+	return dst, nil
+}
+
+func (s *Store) FindAllRules() ([]db.Domain, []db.Forward, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	domains := append([]db.Domain(nil), s.domains...)
+	forwards := make([]db.Forward, len(s.forwards))
+	for i, it := range s.forwards {
+		forwards[i] = copyForward(it)
+	}
+	return domains, forwards, nil
+}
+
+func (s *Store) SaveRules(changes db.RuleChanges) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := types.LocalTime(time.Now())
+	for _, it := range changes.CreateDomains {
+		it.ID = s.nextId(it.ID)
+		it.CreateTime, it.UpdateTime = now, now
+		s.domains = append(s.domains, it)
+		s.audit(changes, db.AuditCreate, nil, &it)
+	}
+	for _, it := range changes.UpdateDomains {
+		for i := range s.domains {
+			if s.domains[i].ID == it.ID {
+				old := s.domains[i]
+				it.CreateTime, it.UpdateTime = old.CreateTime, now
+				s.domains[i] = it
+				s.audit(changes, db.AuditUpdate, &old, &it)
+			}
+		}
+	}
+	for _, it := range changes.DeleteDomains {
+		for _, old := range deleteById(&s.domains, it.ID, func(d db.Domain) int64 { return d.ID }) {
+			s.audit(changes, db.AuditDelete, &old, nil)
+		}
+	}
+	for _, it := range changes.CreateForwards {
+		it.ID = s.nextId(it.ID)
+		it.CreateTime, it.UpdateTime = now, now
+		s.forwards = append(s.forwards, copyForward(it))
+		s.audit(changes, db.AuditCreate, nil, &it)
+	}
+	for _, it := range changes.UpdateForwards {
+		for i := range s.forwards {
+			if s.forwards[i].ID == it.ID {
+				old := s.forwards[i]
+				it.CreateTime, it.UpdateTime = old.CreateTime, now
+				s.forwards[i] = copyForward(it)
+				s.audit(changes, db.AuditUpdate, &old, &it)
+			}
+		}
+	}
+	for _, it := range changes.DeleteForwards {
+		for _, old := range deleteById(&s.forwards, it.ID, func(f db.Forward) int64 { return f.ID }) {
+			s.audit(changes, db.AuditDelete, &old, nil)
+		}
+	}
+	for _, it := range changes.CreateHistoryExes {
+		it.ID = s.nextId(it.ID)
+		s.historyExes = append(s.historyExes, it)
+		s.audit(changes, db.AuditCreate, nil, &it)
+	}
+	for _, it := range changes.UpdateHistoryExes {
+		for i := range s.historyExes {
+			if s.historyExes[i].ID == it.ID {
+				old := s.historyExes[i]
+				s.historyExes[i] = it
+				s.audit(changes, db.AuditUpdate, &old, &it)
+			}
+		}
+	}
+	for _, it := range changes.DeleteHistoryExes {
+		for _, old := range deleteById(&s.historyExes, it.ID, func(ex db.HistoryEx) int64 { return ex.ID }) {
+			s.audit(changes, db.AuditDelete, &old, nil)
+		}
+	}
+	if !changes.Empty() {
+		s.notify()
+	}
+	return nil
+}
+
+// nextId 返回新增数据的ID，id 不为 0 时使用指定的ID
+func (s *Store) nextId(id int64) int64 {
+	if id == 0 {
+		s.lastId++
+		return s.lastId
+	}
+	s.lastId = max(s.lastId, id)
+	return id
+}
+
+// audit 记录一条审计记录。调用时需持有写锁
+func (s *Store) audit(changes db.RuleChanges, action string, before, after any) {
+	log := db.NewAuditLog(changes, action, before, after)
+	s.lastId++
+	log.ID = s.lastId
+	s.audits = append(s.audits, log)
+}
+
+// FindAudit 查询满足条件的审计记录，按时间倒序排列
+func (s *Store) FindAudit(filter db.AuditFilter) ([]db.AuditLog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var dst []db.AuditLog
+	for i := len(s.audits) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(dst) >= filter.Limit {
+			break
+		}
+		if filter.Match(s.audits[i]) {
+			dst = append(dst, s.audits[i])
+		}
+	}
+	return dst, nil
+}
+
+// Watch 订阅规则变更，SaveRules 保存了变更后通知
+func (s *Store) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.watchers[ch] = struct{}{}
+	s.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.watchers, ch)
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// notify 通知所有订阅者，订阅者还有未处理的通知时不再重复通知。调用时需持有写锁
+func (s *Store) notify() {
+	for ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Store) SavaHistory(his db.History) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, it := range his.History {
+		if it.FirstSeen.IsZero() {
+			it.FirstSeen = it.LastSeen
+		}
+		key := historyKey{name: his.Name, forwardId: his.ForwardId, clientHost: his.ClientHost, ipNet: it.IpNet}
+		if old, ok := s.history[key]; ok {
+			it = db.MergeHistoryIp([]db.HistoryIp{old}, []db.HistoryIp{it})[0]
+		}
+		s.history[key] = it
+	}
+	return nil
+}
+
+func (s *Store) FindHistoryByHost(host, scope string) ([]db.HistoryIp, []string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// 查询全局和客户端对应的已启用的转发域名
+	var forwards []db.Forward
+	for _, it := range s.forwards {
+		if it.Enable && visible(it.ClientHost, host) {
+			forwards = append(forwards, it)
+		}
+	}
+	forwards = db.HistoryForwards(forwards, scope)
+
+	names := make(map[string]struct{}, len(forwards))
+	ids := make(map[int64]struct{}, len(forwards))
+	for _, it := range forwards {
+		names[it.Name] = struct{}{}
+		ids[it.ID] = struct{}{}
+	}
+	var his []db.HistoryIp
+	for key, it := range s.history {
+		var ok bool
+		if scope == db.HistoryScopeAll {
+			_, ok = names[key.name]
+		} else {
+			_, ok = ids[key.forwardId]
+		}
+		if ok {
+			his = append(his, it)
+		}
+	}
+
+	var exes []db.HistoryEx
+	for _, it := range s.historyExes {
+		if visible(it.ClientHost, host) {
+			exes = append(exes, it)
+		}
+	}
+	return db.MergeHistoryIp(his, nil), db.HistoryExNets(exes), nil
+}
+
+func (s *Store) PruneHistory(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int64
+	for key, it := range s.history {
+		if it.LastSeen.Before(before) {
+			delete(s.history, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// SaveHistoryEx 添加需要从解析历史中排除的网段
+func (s *Store) SaveHistoryEx(ex db.HistoryEx) error {
+	return s.SaveRules(db.RuleChanges{CreateHistoryExes: []db.HistoryEx{ex}})
+}
+
+// visible 判断生效范围为 clientHost 的数据对客户端 host 是否可见，全局数据对所有客户端可见
+func visible(clientHost, host string) bool {
+	return clientHost == "" || clientHost == host
+}
+
+func contains(names []string, name string) bool {
+	for _, it := range names {
+		if it == name {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteById 从 items 中删除ID为 id 的数据，返回被删除的数据
+func deleteById[T any](items *[]T, id int64, idOf func(T) int64) (removed []T) {
+	dst := (*items)[:0]
+	for _, it := range *items {
+		if idOf(it) != id {
+			dst = append(dst, it)
+		} else {
+			removed = append(removed, it)
+		}
+	}
+	*items = dst
+	return removed
+}
+
+// copyForward 复制转发配置中的切片，避免调用者修改存储中的数据
+func copyForward(f db.Forward) db.Forward {
+	f.DnsSvr = append([]string(nil), f.DnsSvr...)
+	f.FallbackSvr = append([]string(nil), f.FallbackSvr...)
+	return f
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/laeni/pri-dns/db/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) storetest.Store {
+		return NewStore()
+	})
+}
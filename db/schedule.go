@@ -0,0 +1,196 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule 每周的生效时间段，由多个以分号分割的时间段组成，每个时间段的格式为 "[星期] 开始时间-结束时间"，如：
+//
+//	Mon-Fri 09:00-18:00; Sat,Sun 10:00-12:00
+//
+// 星期可以是 Mon、Tue、Wed、Thu、Fri、Sat、Sun，多个以逗号分割，连续的可以用 '-' 表示范围，省略时表示每天。
+// 结束时间可以是 24:00；结束时间早于开始时间时表示跨越午夜，如 "Fri 22:00-06:00" 包含周六的 0 点到 6 点
+type Schedule []schedulePeriod
+
+type schedulePeriod struct {
+	days       [7]bool // 下标为 time.Weekday
+	start, end int     // 一天中的分钟数
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseSchedule 解析每周的生效时间段，s 为空时返回 nil，表示不限
+func ParseSchedule(s string) (Schedule, error) {
+	var dst Schedule
+	for _, item := range strings.Split(s, ";") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		var p schedulePeriod
+		switch len(fields) {
+		case 1:
+			for i := range p.days {
+				p.days[i] = true
+			}
+		case 2:
+			if err := parseDays(fields[0], &p.days); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid schedule: %q", item)
+		}
+		startStr, endStr, ok := strings.Cut(fields[len(fields)-1], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time range: %q", fields[len(fields)-1])
+		}
+		var err error
+		if p.start, err = parseClock(startStr, false); err != nil {
+			return nil, err
+		}
+		if p.end, err = parseClock(endStr, true); err != nil {
+			return nil, err
+		}
+		if p.start == p.end {
+			return nil, fmt.Errorf("empty time range: %q", fields[len(fields)-1])
+		}
+		dst = append(dst, p)
+	}
+	return dst, nil
+}
+
+func parseDays(s string, days *[7]bool) error {
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		start, ok := weekdays[strings.ToLower(from)]
+		if !ok {
+			return fmt.Errorf("invalid weekday: %q", from)
+		}
+		end := start
+		if isRange {
+			if end, ok = weekdays[strings.ToLower(to)]; !ok {
+				return fmt.Errorf("invalid weekday: %q", to)
+			}
+		}
+		// 范围可以跨越周末，如 Sat-Mon
+		for d := start; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == end {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock 解析 "HH:MM" 格式的时间，返回一天中的分钟数。allowEnd 为 true 时允许 24:00
+func parseClock(s string, allowEnd bool) (int, error) {
+	if len(s) != 5 || s[2] != ':' || !isDigits(s[:2]) || !isDigits(s[3:]) {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	h := int(s[0]-'0')*10 + int(s[1]-'0')
+	m := int(s[3]-'0')*10 + int(s[4]-'0')
+	minutes := h*60 + m
+	if m > 59 || minutes > 24*60 || (minutes == 24*60 && !allowEnd) {
+		return 0, fmt.Errorf("invalid time: %q", s)
+	}
+	return minutes, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains 判断 t 是否在生效时间段内，没有时间段时表示不限
+func (s Schedule) Contains(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	for _, p := range s {
+		if p.start < p.end {
+			if p.days[day] && minutes >= p.start && minutes < p.end {
+				return true
+			}
+			continue
+		}
+		// 跨越午夜时，午夜前属于当天，午夜后属于前一天的时间段
+		if p.days[day] && minutes >= p.start {
+			return true
+		}
+		if p.days[(day+6)%7] && minutes < p.end {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSchedule 检查 changes 中新增和修改的规则的生效时间段格式是否正确，以免保存后规则因格式有误而不生效
+func CheckSchedule(changes RuleChanges) error {
+	for _, domains := range [][]Domain{changes.CreateDomains, changes.UpdateDomains} {
+		for _, it := range domains {
+			if _, err := ParseSchedule(it.Schedule); err != nil {
+				return fmt.Errorf("解析记录 %s 的生效时间段有误: %w", it.Name, err)
+			}
+		}
+	}
+	for _, forwards := range [][]Forward{changes.CreateForwards, changes.UpdateForwards} {
+		for _, it := range forwards {
+			if _, err := ParseSchedule(it.Schedule); err != nil {
+				return fmt.Errorf("转发规则 %s 的生效时间段有误: %w", it.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parsedSchedule 解析生效时间段的结果
+type parsedSchedule struct {
+	schedule Schedule
+	err      error
+}
+
+// schedules 缓存已解析的生效时间段，key 为原始字符串。规则在每次查询时都需要判断是否生效，缓存后每种格式只需要解析一次
+var schedules sync.Map
+
+// cachedSchedule 返回 s 解析后的生效时间段，解析结果会被缓存
+func cachedSchedule(s string) (Schedule, error) {
+	if v, ok := schedules.Load(s); ok {
+		p := v.(parsedSchedule)
+		return p.schedule, p.err
+	}
+	schedule, err := ParseSchedule(s)
+	schedules.Store(s, parsedSchedule{schedule: schedule, err: err})
+	return schedule, err
+}
+
+// ruleActive 判断规则在 now 时是否生效：已启用、在有效期内且在每周的生效时间段内。
+// 生效时间段格式有误时视为不生效，以免错误的配置使规则在预期之外的时间生效
+func ruleActive(enable bool, start, end time.Time, schedule string, now time.Time) bool {
+	if !enable {
+		return false
+	}
+	if !start.IsZero() && now.Before(start) {
+		return false
+	}
+	if !end.IsZero() && !now.Before(end) {
+		return false
+	}
+	if schedule == "" {
+		return true
+	}
+	s, err := cachedSchedule(schedule)
+	return err == nil && s.Contains(now)
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, s := range []string{
+		"Mon 09:00",
+		"Mon-Fri 9:00-18:00",
+		"Mon-Fri 09:00-24:01",
+		"Mon-Fri 24:00-08:00",
+		"Mon-Fri 09:60-18:00",
+		"Mon-Fry 09:00-18:00",
+		"Mon-Fri 09:00-09:00",
+		"Mon Tue 09:00-18:00",
+	} {
+		if _, err := ParseSchedule(s); err == nil {
+			t.Errorf("ParseSchedule(%q) error = nil, want error", s)
+		}
+	}
+	if s, err := ParseSchedule(" ; "); err != nil || s != nil {
+		t.Errorf("ParseSchedule(empty) = %v, %v", s, err)
+	}
+}
+
+func TestSchedule_Contains(t *testing.T) {
+	// 2024-01-01 为周一
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		schedule string
+		t        time.Time
+		want     bool
+	}{
+		{"Mon-Fri 09:00-18:00", at(1, 9, 0), true},
+		{"Mon-Fri 09:00-18:00", at(5, 17, 59), true},
+		{"Mon-Fri 09:00-18:00", at(5, 18, 0), false},
+		{"Mon-Fri 09:00-18:00", at(6, 12, 0), false},
+		{"09:00-18:00", at(7, 12, 0), true},
+		{"Sat-Mon 00:00-24:00", at(1, 23, 59), true},
+		{"Sat-Mon 00:00-24:00", at(2, 0, 0), false},
+		{"Fri 22:00-06:00", at(5, 23, 0), true},
+		{"Fri 22:00-06:00", at(6, 5, 59), true},
+		{"Fri 22:00-06:00", at(5, 5, 0), false},
+		{"Mon 08:00-09:00; Tue,Thu 20:00-21:00", at(4, 20, 30), true},
+		{"Mon 08:00-09:00; Tue,Thu 20:00-21:00", at(3, 20, 30), false},
+	}
+	for _, tt := range tests {
+		s, err := ParseSchedule(tt.schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Contains(tt.t); got != tt.want {
+			t.Errorf("%q.Contains(%s) = %v, want %v", tt.schedule, tt.t.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func Test_ruleActive(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name       string
+		enable     bool
+		start, end time.Time
+		schedule   string
+		want       bool
+	}{
+		{"启用", true, time.Time{}, time.Time{}, "", true},
+		{"禁用", false, time.Time{}, time.Time{}, "", false},
+		{"未开始", true, now.Add(time.Hour), time.Time{}, "", false},
+		{"已结束", true, time.Time{}, now, "", false},
+		{"有效期内", true, now.Add(-time.Hour), now.Add(time.Hour), "", true},
+		{"生效时间段内", true, time.Time{}, time.Time{}, "Mon 09:00-18:00", true},
+		{"生效时间段外", true, time.Time{}, time.Time{}, "Tue 09:00-18:00", false},
+		{"生效时间段格式有误", true, time.Time{}, time.Time{}, "Mon 9:00-18:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ruleActive(tt.enable, tt.start, tt.end, tt.schedule, now); got != tt.want {
+				t.Errorf("ruleActive() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSchedule(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes RuleChanges
+		wantErr bool
+	}{
+		{"不限", RuleChanges{CreateDomains: []Domain{{Name: "example.com"}}}, false},
+		{"格式正确", RuleChanges{UpdateForwards: []Forward{{Name: "example.com", Schedule: "Mon-Fri 09:00-18:00"}}}, false},
+		{"新增解析记录格式有误", RuleChanges{CreateDomains: []Domain{{Name: "example.com", Schedule: "Mon 9:00-18:00"}}}, true},
+		{"修改转发规则格式有误", RuleChanges{UpdateForwards: []Forward{{Name: "example.com", Schedule: "Foo 09:00-18:00"}}}, true},
+		{"删除的规则不检查", RuleChanges{DeleteForwards: []Forward{{Name: "example.com", Schedule: "Foo 09:00-18:00"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckSchedule(tt.changes); (err != nil) != tt.wantErr {
+				t.Errorf("CheckSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
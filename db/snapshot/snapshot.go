@@ -0,0 +1,318 @@
+// Package snapshot 为 db.Store 提供本地快照：每次从存储成功加载全部规则后写入本地文件，
+// 存储不可用（包括启动时无法连接）时使用快照中的规则继续提供查询，此时处于降级模式.
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var log = clog.NewWithPlugin("pri-dns")
+
+// ErrUnavailable 表示存储不可用且操作无法使用快照完成，如保存规则或者查询解析历史
+var ErrUnavailable = errors.New("store unavailable")
+
+var degradedGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "pridns",
+	Name:      "store_degraded",
+	Help:      "Whether rules are served from the local snapshot because the store is unavailable (1) or not (0).",
+})
+
+// Snapshot 快照文件的内容
+type Snapshot struct {
+	Time     time.Time
+	Domains  []db.Domain
+	Forwards []db.Forward
+}
+
+// Store 包装一个存储。查询规则时优先使用存储，出错时使用快照，直到下一次刷新成功；其他操作只能使用存储
+type Store struct {
+	path    string
+	connect func() (db.Store, error)
+
+	mu       sync.RWMutex
+	inner    db.Store      // 为 nil 时表示还未连接成功
+	local    *memory.Store // 快照中的规则，为 nil 时表示没有快照
+	snapTime time.Time     // 快照的加载时间
+
+	degraded atomic.Bool
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Open 使用 connect 连接存储并加载规则。连接或加载失败时使用 path 中已有的快照并进入降级模式，此时只有在快照也不存在时才返回错误
+func Open(path string, connect func() (db.Store, error)) (*Store, error) {
+	s := &Store{path: path, connect: connect, stop: make(chan struct{})}
+	err := s.Refresh()
+	if err == nil {
+		return s, nil
+	}
+	snap, readErr := readFile(path)
+	if readErr != nil {
+		if errors.Is(readErr, os.ErrNotExist) {
+			return nil, err
+		}
+		return nil, errors.Join(err, readErr)
+	}
+	log.Warningf("store unavailable, serving %d domains and %d forwards from snapshot taken at %s: %v",
+		len(snap.Domains), len(snap.Forwards), snap.Time.Format(time.RFC3339), err)
+	s.local, s.snapTime = memory.NewStoreWithRules(snap.Domains, snap.Forwards), snap.Time
+	return s, nil
+}
+
+// Refresh 从存储加载全部规则并写入快照文件，必要时先连接存储。失败时进入降级模式，成功时退出降级模式
+func (s *Store) Refresh() error {
+	err := s.refresh()
+	s.setDegraded(err != nil)
+	return err
+}
+
+func (s *Store) refresh() error {
+	s.mu.RLock()
+	inner := s.inner
+	s.mu.RUnlock()
+	if inner == nil {
+		var err error
+		if inner, err = s.connect(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.inner = inner
+		s.mu.Unlock()
+	}
+
+	domains, forwards, err := inner.FindAllRules()
+	if err != nil {
+		return err
+	}
+	snap := Snapshot{Time: time.Now(), Domains: domains, Forwards: forwards}
+	if err := writeFile(s.path, snap); err != nil {
+		// 快照只是后备，写入失败不影响正常使用
+		log.Errorf("write snapshot: %v", err)
+	}
+	s.mu.Lock()
+	s.local, s.snapTime = memory.NewStoreWithRules(domains, forwards), snap.Time
+	s.mu.Unlock()
+	return nil
+}
+
+// Start 每隔 interval 刷新一次快照，存储不可用时同时尝试重新连接
+func (s *Store) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if err := s.Refresh(); err != nil {
+					log.Errorf("refresh snapshot: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop 停止定时刷新
+func (s *Store) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// Degraded 返回是否处于降级模式，以及正在使用的快照的加载时间
+func (s *Store) Degraded() (bool, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.degraded.Load(), s.snapTime
+}
+
+func (s *Store) setDegraded(degraded bool) {
+	if s.degraded.Swap(degraded) != degraded {
+		if degraded {
+			log.Warning("store unavailable, entering degraded mode")
+			degradedGauge.Set(1)
+		} else {
+			log.Info("store available, leaving degraded mode")
+			degradedGauge.Set(0)
+		}
+	}
+}
+
+func (s *Store) stores() (inner db.Store, local *memory.Store) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inner, s.local
+}
+
+// find 优先从存储查询，存储不可用时从快照查询。降级模式下直接从快照查询，以免每次查询都需要等待存储超时，
+// 存储恢复后由定时刷新退出降级模式
+func find[T any](s *Store, f func(db.Store) (T, error)) (T, error) {
+	inner, local := s.stores()
+	if local != nil && s.degraded.Load() {
+		return f(local)
+	}
+	err := ErrUnavailable
+	if inner != nil {
+		var v T
+		if v, err = f(inner); err == nil {
+			return v, nil
+		}
+		s.setDegraded(true)
+	}
+	if local == nil {
+		var zero T
+		return zero, err
+	}
+	return f(local)
+}
+
+// write 只能使用存储完成的操作
+func (s *Store) write(f func(db.Store) error) error {
+	inner, _ := s.stores()
+	if inner == nil {
+		return ErrUnavailable
+	}
+	return f(inner)
+}
+
+func (s *Store) FindForwardByHostAndName(host, name string) ([]db.Forward, error) {
+	return find(s, func(it db.Store) ([]db.Forward, error) { return it.FindForwardByHostAndName(host, name) })
+}
+
+func (s *Store) FindForwardByHostAndNames(host string, names []string) ([]db.Forward, error) {
+	return find(s, func(it db.Store) ([]db.Forward, error) { return it.FindForwardByHostAndNames(host, names) })
+}
+
+func (s *Store) FindDomainByHostAndName(host, qname string) ([]db.Domain, error) {
+	return find(s, func(it db.Store) ([]db.Domain, error) { return it.FindDomainByHostAndName(host, qname) })
+}
+
+func (s *Store) FindDomainByHost(host string) ([]db.Domain, error) {
+	return find(s, func(it db.Store) ([]db.Domain, error) { return it.FindDomainByHost(host) })
+}
+
+func (s *Store) FindForwardByHost(host string) ([]db.Forward, error) {
+	return find(s, func(it db.Store) ([]db.Forward, error) { return it.FindForwardByHost(host) })
+}
+
+func (s *Store) FindAllRules() ([]db.Domain, []db.Forward, error) {
+	var forwards []db.Forward
+	domains, err := find(s, func(it db.Store) ([]db.Domain, error) {
+		var domains []db.Domain
+		var err error
+		domains, forwards, err = it.FindAllRules()
+		return domains, err
+	})
+	return domains, forwards, err
+}
+
+func (s *Store) SaveRules(changes db.RuleChanges) error {
+	return s.write(func(it db.Store) error { return it.SaveRules(changes) })
+}
+
+// FindAudit 快照中没有审计记录，所以只能使用存储
+func (s *Store) FindAudit(filter db.AuditFilter) (logs []db.AuditLog, err error) {
+	err = s.write(func(it db.Store) error {
+		logs, err = it.FindAudit(filter)
+		return err
+	})
+	return
+}
+
+func (s *Store) SavaHistory(his db.History) error {
+	return s.write(func(it db.Store) error { return it.SavaHistory(his) })
+}
+
+// FindHistoryByHost 快照中没有解析历史，所以只能使用存储
+func (s *Store) FindHistoryByHost(host, scope string) (his []db.HistoryIp, exes []string, err error) {
+	err = s.write(func(it db.Store) error {
+		his, exes, err = it.FindHistoryByHost(host, scope)
+		return err
+	})
+	return
+}
+
+func (s *Store) PruneHistory(before time.Time) (removed int64, err error) {
+	err = s.write(func(it db.Store) error {
+		removed, err = it.PruneHistory(before)
+		return err
+	})
+	return
+}
+
+// Watch 订阅存储的规则变更，收到通知时先刷新快照再通知订阅者。存储还未连接或者不支持变更通知时返回错误
+func (s *Store) Watch(ctx context.Context) (<-chan struct{}, error) {
+	inner, _ := s.stores()
+	if inner == nil {
+		return nil, ErrUnavailable
+	}
+	feed, ok := inner.(db.ChangeFeed)
+	if !ok {
+		return nil, errors.New("store does not support change notifications")
+	}
+	changes, err := feed.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		for range changes {
+			if err := s.Refresh(); err != nil {
+				log.Errorf("refresh snapshot: %v", err)
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func readFile(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// writeFile 先写入临时文件再重命名，避免进程退出时留下不完整的快照
+func writeFile(path string, snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,166 @@
+package snapshot
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+)
+
+var errDown = errors.New("connection refused")
+
+// flakyStore 在 down 为 true 时查询规则返回错误，用于模拟运行时数据库不可用
+type flakyStore struct {
+	*memory.Store
+	down    bool
+	queries int // FindDomainByHostAndName 的调用次数
+}
+
+func (s *flakyStore) FindDomainByHostAndName(host, qname string) ([]db.Domain, error) {
+	s.queries++
+	if s.down {
+		return nil, errDown
+	}
+	return s.Store.FindDomainByHostAndName(host, qname)
+}
+
+func (s *flakyStore) FindAllRules() ([]db.Domain, []db.Forward, error) {
+	if s.down {
+		return nil, nil, errDown
+	}
+	return s.Store.FindAllRules()
+}
+
+func newFlakyStore(t *testing.T) *flakyStore {
+	s := &flakyStore{Store: memory.NewStore()}
+	err := s.SaveRules(db.RuleChanges{
+		CreateDomains:  []db.Domain{{Name: "example.com", Value: "10.0.0.1", DnsType: "A", Enable: true}},
+		CreateForwards: []db.Forward{{Name: "example.org", DnsSvr: []string{"8.8.8.8"}, Enable: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustFindDomain(t *testing.T, s *Store) {
+	t.Helper()
+	domains, err := s.FindDomainByHostAndName("192.168.1.2", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Value != "10.0.0.1" {
+		t.Fatalf("FindDomainByHostAndName() = %+v", domains)
+	}
+}
+
+func TestOpenWithoutStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	down := func() (db.Store, error) { return nil, errDown }
+
+	// 没有快照时无法启动
+	if _, err := Open(path, down); !errors.Is(err, errDown) {
+		t.Fatalf("Open() without snapshot error = %v", err)
+	}
+
+	// 成功加载一次后写入快照
+	up := newFlakyStore(t)
+	s, err := Open(path, func() (db.Store, error) { return up, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if degraded, _ := s.Degraded(); degraded {
+		t.Error("Degraded() = true after successful open")
+	}
+
+	// 启动时存储不可用，使用快照
+	s, err = Open(path, down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if degraded, snapTime := s.Degraded(); !degraded || snapTime.IsZero() {
+		t.Errorf("Degraded() = %v, %v", degraded, snapTime)
+	}
+	mustFindDomain(t, s)
+	forwards, err := s.FindForwardByHostAndName("", "example.org")
+	if err != nil || len(forwards) != 1 || forwards[0].ID == 0 {
+		t.Errorf("FindForwardByHostAndName() = %+v, %v", forwards, err)
+	}
+	if err := s.SaveRules(db.RuleChanges{}); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("SaveRules() error = %v, want ErrUnavailable", err)
+	}
+	if _, _, err := s.FindHistoryByHost("", db.HistoryScopeMine); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("FindHistoryByHost() error = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestRuntimeFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	inner := newFlakyStore(t)
+	s, err := Open(path, func() (db.Store, error) { return inner, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 运行时存储不可用，使用最近一次加载的规则
+	inner.down = true
+	mustFindDomain(t, s)
+	if degraded, _ := s.Degraded(); !degraded {
+		t.Error("Degraded() = false while store is down")
+	}
+	if err := s.Refresh(); !errors.Is(err, errDown) {
+		t.Errorf("Refresh() error = %v", err)
+	}
+
+	// 降级模式下直接使用快照，不再查询存储
+	queries := inner.queries
+	inner.down = false
+	mustFindDomain(t, s)
+	if inner.queries != queries {
+		t.Errorf("store queried %d times while degraded", inner.queries-queries)
+	}
+
+	// 存储恢复后刷新即退出降级模式
+	if err := s.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if degraded, _ := s.Degraded(); degraded {
+		t.Error("Degraded() = true after store recovered")
+	}
+	mustFindDomain(t, s)
+	if inner.queries != queries+1 {
+		t.Errorf("store queried %d times after recovered, want 1", inner.queries-queries)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	inner := newFlakyStore(t)
+	if _, err := Open(path, func() (db.Store, error) { return inner, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// 启动时无法连接，之后刷新时重新连接成功
+	up := false
+	s, err := Open(path, func() (db.Store, error) {
+		if !up {
+			return nil, errDown
+		}
+		return inner, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up = true
+	if err := s.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveRules(db.RuleChanges{}); err != nil {
+		t.Errorf("SaveRules() after reconnect error = %v", err)
+	}
+	if degraded, _ := s.Degraded(); degraded {
+		t.Error("Degraded() = true after reconnect")
+	}
+}
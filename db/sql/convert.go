@@ -0,0 +1,178 @@
+package sql
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/laeni/pri-dns/db"
+)
+
+// 数据库中的布尔值使用 Y/N 表示
+func toBool(s string) bool {
+	return strings.ToUpper(s) == "Y"
+}
+
+func fromBool(b bool) string {
+	if b {
+		return "Y"
+	}
+	return "N"
+}
+
+// 多个值以逗号分割
+func toSlice(s sql.NullString) []string {
+	if s.String == "" {
+		return nil
+	}
+	return strings.Split(s.String, ",")
+}
+
+func fromSlice(ss []string) sql.NullString {
+	return fromString(strings.Join(ss, ","))
+}
+
+func fromString(s string) sql.NullString {
+	return sql.NullString{Valid: s != "", String: s}
+}
+
+// 零值时间表示不限，存储为 NULL
+func toTime(t sql.NullTime) time.Time {
+	if !t.Valid {
+		return time.Time{}
+	}
+	return t.Time
+}
+
+func fromTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Valid: !t.IsZero(), Time: t}
+}
+
+func toDbDomain(temp Domain) db.Domain {
+	return db.Domain{
+		ID:         temp.ID,
+		ClientHost: temp.ClientHost,
+		Name:       temp.Name,
+		Value:      temp.Value.String,
+		Ttl:        temp.Ttl.Int32,
+		DnsType:    temp.DnsType.String,
+		DenyGlobal: toBool(temp.DenyGlobal),
+		Enable:     toBool(temp.Enable),
+		StartTime:  toTime(temp.StartTime),
+		EndTime:    toTime(temp.EndTime),
+		Schedule:   temp.Schedule.String,
+		CreateTime: temp.CreateTime,
+		UpdateTime: temp.UpdateTime,
+	}
+}
+
+func fromDbDomain(d db.Domain) Domain {
+	return Domain{
+		ID:         d.ID,
+		ClientHost: d.ClientHost,
+		Name:       d.Name,
+		Value:      fromString(d.Value),
+		Ttl:        sql.NullInt32{Valid: true, Int32: d.Ttl},
+		DnsType:    fromString(d.DnsType),
+		DenyGlobal: fromBool(d.DenyGlobal),
+		Enable:     fromBool(d.Enable),
+		StartTime:  fromTime(d.StartTime),
+		EndTime:    fromTime(d.EndTime),
+		Schedule:   fromString(d.Schedule),
+		CreateTime: d.CreateTime,
+		UpdateTime: d.UpdateTime,
+	}
+}
+
+func toDbForward(temp Forward) db.Forward {
+	return db.Forward{
+		ID:          temp.ID,
+		ClientHost:  temp.ClientHost,
+		Name:        temp.Name,
+		DnsSvr:      toSlice(temp.DnsSvr),
+		FallbackSvr: toSlice(temp.FallbackSvr),
+		Mode:        temp.Mode.String,
+		IpSet:       temp.IpSet.String,
+		Policy:      temp.Policy.String,
+		DenyGlobal:  toBool(temp.DenyGlobal),
+		Enable:      toBool(temp.Enable),
+		StartTime:   toTime(temp.StartTime),
+		EndTime:     toTime(temp.EndTime),
+		Schedule:    temp.Schedule.String,
+		CreateTime:  temp.CreateTime,
+		UpdateTime:  temp.UpdateTime,
+	}
+}
+
+func fromDbForward(f db.Forward) Forward {
+	return Forward{
+		ID:          f.ID,
+		ClientHost:  f.ClientHost,
+		Name:        f.Name,
+		DnsSvr:      fromSlice(f.DnsSvr),
+		FallbackSvr: fromSlice(f.FallbackSvr),
+		Mode:        fromString(f.Mode),
+		IpSet:       fromString(f.IpSet),
+		Policy:      fromString(f.Policy),
+		DenyGlobal:  fromBool(f.DenyGlobal),
+		Enable:      fromBool(f.Enable),
+		StartTime:   fromTime(f.StartTime),
+		EndTime:     fromTime(f.EndTime),
+		Schedule:    fromString(f.Schedule),
+		CreateTime:  f.CreateTime,
+		UpdateTime:  f.UpdateTime,
+	}
+}
+
+func toDbHistoryEx(temp HistoryEx) db.HistoryEx {
+	return db.HistoryEx{
+		ID:         temp.ID,
+		ClientHost: temp.ClientHost,
+		IpNet:      temp.IpNet,
+		DenyGlobal: toBool(temp.DenyGlobal),
+		Label:      temp.Label.String,
+		// 没有执行迁移的旧表中没有 enable 列，此时视为启用
+		Enable: temp.Enable == "" || toBool(temp.Enable),
+	}
+}
+
+func fromDbHistoryEx(ex db.HistoryEx) HistoryEx {
+	return HistoryEx{
+		ID:         ex.ID,
+		ClientHost: ex.ClientHost,
+		IpNet:      ex.IpNet,
+		DenyGlobal: fromBool(ex.DenyGlobal),
+		Label:      fromString(ex.Label),
+		Enable:     fromBool(ex.Enable),
+	}
+}
+
+func toDbAuditLog(temp AuditLog) db.AuditLog {
+	return db.AuditLog{
+		ID:         temp.ID,
+		RuleType:   temp.RuleType,
+		RuleId:     temp.RuleId,
+		ClientHost: temp.ClientHost,
+		Action:     temp.Action,
+		Actor:      temp.Actor,
+		ClientIp:   temp.ClientIp,
+		Before:     temp.BeforeJson.String,
+		After:      temp.AfterJson.String,
+		CreateTime: temp.CreateTime,
+	}
+}
+
+func fromDbAuditLog(log db.AuditLog) AuditLog {
+	return AuditLog{
+		ID:         log.ID,
+		RuleType:   log.RuleType,
+		RuleId:     log.RuleId,
+		ClientHost: log.ClientHost,
+		Action:     log.Action,
+		Actor:      log.Actor,
+		ClientIp:   log.ClientIp,
+		BeforeJson: fromString(log.Before),
+		AfterJson:  fromString(log.After),
+		CreateTime: log.CreateTime,
+	}
+}
@@ -0,0 +1,97 @@
+package sql
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDrivers 返回所有可以测试的数据库，key 为驱动名称，value 用于创建一个空数据库.
+// MySQL 使用进程内的兼容服务，SQLite 使用临时文件，PostgreSQL 需要通过环境变量 PRI_DNS_TEST_POSTGRES_DSN 指定一个空数据库
+func testDrivers() map[string]func(t *testing.T) *gorm.DB {
+	drivers := map[string]func(t *testing.T) *gorm.DB{
+		DriverMySQL: newMySQLTestDb,
+		DriverSQLite: func(t *testing.T) *gorm.DB {
+			return openTestDb(t, DriverSQLite, filepath.Join(t.TempDir(), "pri-dns.db"))
+		},
+	}
+	if dsn := os.Getenv("PRI_DNS_TEST_POSTGRES_DSN"); dsn != "" {
+		drivers[DriverPostgres] = func(t *testing.T) *gorm.DB {
+			d := openTestDb(t, DriverPostgres, dsn)
+			t.Cleanup(func() {
+				d.Exec("DROP SCHEMA public CASCADE")
+				d.Exec("CREATE SCHEMA public")
+			})
+			return d
+		}
+	}
+	return drivers
+}
+
+// forEachDriver 在所有可以测试的数据库上执行测试
+func forEachDriver(t *testing.T, f func(t *testing.T, d *gorm.DB)) {
+	for name, newDb := range testDrivers() {
+		t.Run(name, func(t *testing.T) {
+			f(t, newDb(t))
+		})
+	}
+}
+
+// newMySQLTestDb 启动一个进程内的 MySQL 兼容服务并返回连接
+func newMySQLTestDb(t *testing.T) *gorm.DB {
+	t.Helper()
+	pro := memory.NewDBProvider(memory.NewDatabase("pridns"))
+	engine := sqle.NewDefault(pro)
+	svr, err := server.NewServer(server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}, engine, memory.NewSessionBuilder(pro), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = svr.Start()
+	}()
+	t.Cleanup(func() {
+		_ = svr.Close()
+	})
+	d := openTestDb(t, DriverMySQL, "root@tcp("+svr.Listener.Addr().String()+")/pridns?parseTime=true")
+	// go-mysql-server 的内存引擎在并发读写时可能丢失已提交的写入，使用单个连接使所有操作串行执行
+	sqlDb, err := d.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDb.SetMaxOpenConns(1)
+	return d
+}
+
+func openTestDb(t *testing.T, driver, dsn string) *gorm.DB {
+	t.Helper()
+	d, err := Open(driver, dsn, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDb, err := d.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sqlDb.Close()
+	})
+	return d
+}
+
+// newTestStore 返回一个已经执行了迁移的空数据库
+func newTestStore(t *testing.T, d *gorm.DB) *Store {
+	t.Helper()
+	if _, err := Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(d)
+	s.SetPollInterval(10 * time.Millisecond)
+	return &s
+}
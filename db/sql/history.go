@@ -0,0 +1,183 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// historyUpsert 返回插入解析历史时的冲突处理，已存在相同 (name, forward_id, client_host, cidr) 的记录时，合并时间和次数
+func historyUpsert(dialect string) clause.OnConflict {
+	columns := []clause.Column{{Name: "name"}, {Name: "forward_id"}, {Name: "client_host"}, {Name: "cidr"}}
+	switch dialect {
+	case DriverPostgres:
+		return clause.OnConflict{Columns: columns, DoUpdates: clause.Assignments(map[string]interface{}{
+			"first_seen": gorm.Expr("LEAST(history_ip.first_seen, excluded.first_seen)"),
+			"last_seen":  gorm.Expr("GREATEST(history_ip.last_seen, excluded.last_seen)"),
+			"count":      gorm.Expr("history_ip.count + excluded.count"),
+		})}
+	case DriverSQLite:
+		return clause.OnConflict{Columns: columns, DoUpdates: clause.Assignments(map[string]interface{}{
+			"first_seen": gorm.Expr("MIN(first_seen, excluded.first_seen)"),
+			"last_seen":  gorm.Expr("MAX(last_seen, excluded.last_seen)"),
+			"count":      gorm.Expr("count + excluded.count"),
+		})}
+	default:
+		return clause.OnConflict{DoUpdates: clause.Assignments(map[string]interface{}{
+			"first_seen": gorm.Expr("LEAST(first_seen, VALUES(first_seen))"),
+			"last_seen":  gorm.Expr("GREATEST(last_seen, VALUES(last_seen))"),
+			"count":      gorm.Expr("count + VALUES(count)"),
+		})}
+	}
+}
+
+func (s *Store) SavaHistory(newHis db.History) error {
+	if len(newHis.History) == 0 {
+		return nil
+	}
+	// 按合并后的数量创建，同一批中重复的IP合并为一行
+	merged := db.MergeHistoryIp(newHis.History, nil)
+	rows := make([]HistoryIp, len(merged))
+	for i, it := range merged {
+		rows[i] = fromDbHistoryIp(newHis, it)
+	}
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.Clauses(historyUpsert(tx.Dialector.Name())).Create(&rows).Error
+	})
+}
+
+func (s *Store) PruneHistory(before time.Time) (int64, error) {
+	result := s.db.Where("last_seen < ?", types.LocalTime(before)).Delete(&HistoryIp{})
+	return result.RowsAffected, result.Error
+}
+
+// 查询域名对应的解析IP历史
+func findHistoryHostsByNames(tx *gorm.DB, names []string) ([]db.HistoryIp, error) {
+	var rows []HistoryIp
+	if err := tx.Where("name IN ?", names).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return mergeHistoryRows(rows), nil
+}
+
+// 查询转发规则对应的解析IP历史
+func findHistoryHostsByForwardIds(tx *gorm.DB, ids []int64) ([]db.HistoryIp, error) {
+	var rows []HistoryIp
+	if err := tx.Where("forward_id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	return mergeHistoryRows(rows), nil
+}
+
+// 合并多条记录中的解析历史，同一IP只保留一条
+func mergeHistoryRows(rows []HistoryIp) []db.HistoryIp {
+	items := make([]db.HistoryIp, len(rows))
+	for i, row := range rows {
+		items[i] = toDbHistoryIp(row)
+	}
+	return db.MergeHistoryIp(items, nil)
+}
+
+func toDbHistoryIp(row HistoryIp) db.HistoryIp {
+	return db.HistoryIp{
+		IpNet:     row.Cidr,
+		FirstSeen: time.Time(row.FirstSeen),
+		LastSeen:  time.Time(row.LastSeen),
+		Count:     row.Count,
+	}
+}
+
+func fromDbHistoryIp(his db.History, it db.HistoryIp) HistoryIp {
+	if it.FirstSeen.IsZero() {
+		it.FirstSeen = it.LastSeen
+	}
+	return HistoryIp{
+		Name:       his.Name,
+		ForwardId:  his.ForwardId,
+		ClientHost: his.ClientHost,
+		Cidr:       it.IpNet,
+		FirstSeen:  types.LocalTime(it.FirstSeen),
+		LastSeen:   types.LocalTime(it.LastSeen),
+		Count:      it.Count,
+	}
+}
+
+// MigrateLegacyHistory 将旧版本 history 表中以逗号分割存储的解析历史迁移到 history_ip 表，迁移成功的记录将从 history 表中删除.
+// history 表不存在时什么也不做，返回迁移的记录数
+func MigrateLegacyHistory(d *gorm.DB) (int64, error) {
+	if !d.Migrator().HasTable(&LegacyHistory{}) {
+		return 0, nil
+	}
+	var migrated int64
+	err := d.Transaction(func(tx *gorm.DB) error {
+		// 更早的版本没有 forward_id 和 client_host 列
+		columns := []string{"id", "name", "history", "create_time", "update_time"}
+		for _, column := range []string{"forward_id", "client_host"} {
+			if tx.Migrator().HasColumn(&LegacyHistory{}, column) {
+				columns = append(columns, column)
+			}
+		}
+		var legacy []LegacyHistory
+		if err := tx.Select(columns).Find(&legacy).Error; err != nil {
+			return err
+		}
+		for _, row := range legacy {
+			// 未知转发规则的历史归属到同名的全局转发规则
+			if row.ForwardId == 0 {
+				var forward Forward
+				err := whereHost(tx, "").Where("name = ?", row.Name).Limit(1).Find(&forward).Error
+				if err != nil {
+					return err
+				}
+				row.ForwardId = forward.ID
+			}
+			his := db.History{Name: row.Name, ForwardId: row.ForwardId, ClientHost: row.ClientHost, History: parseLegacyHistory(row)}
+			if len(his.History) > 0 {
+				merged := db.MergeHistoryIp(his.History, nil)
+				rows := make([]HistoryIp, len(merged))
+				for i, it := range merged {
+					it.FirstSeen = time.Time(row.CreateTime)
+					rows[i] = fromDbHistoryIp(his, it)
+				}
+				if err := tx.Clauses(historyUpsert(tx.Dialector.Name())).Create(&rows).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Delete(&LegacyHistory{}, row.ID).Error; err != nil {
+				return err
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+// parseLegacyHistory 解析旧版本 history 表的 history 列，多个IP以逗号分割，每个IP的格式为 "IP;最后解析时间（Unix时间戳）;解析次数"。
+// 更早的版本只有IP，此时最后解析时间取该记录的修改时间，解析次数为 1
+func parseLegacyHistory(row LegacyHistory) []db.HistoryIp {
+	if row.History.String == "" {
+		return nil
+	}
+	items := strings.Split(row.History.String, ",")
+	dst := make([]db.HistoryIp, 0, len(items))
+	for _, item := range items {
+		fields := strings.Split(item, ";")
+		it := db.HistoryIp{IpNet: fields[0], LastSeen: time.Time(row.UpdateTime), Count: 1}
+		if len(fields) == 3 {
+			if sec, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				it.LastSeen = time.Unix(sec, 0)
+			}
+			if count, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				it.Count = count
+			}
+		}
+		dst = append(dst, it)
+	}
+	return dst
+}
@@ -0,0 +1,141 @@
+package sql
+
+import (
+	"database/sql"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+	"gorm.io/gorm"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLegacyHistory(t *testing.T) {
+	updateTime := time.Unix(1700000000, 0)
+	tests := []struct {
+		name    string
+		history string
+		want    []db.HistoryIp
+	}{
+		{"空", "", nil},
+		{
+			"旧版本格式",
+			"1.2.3.4,1.2.4.0/24",
+			[]db.HistoryIp{{IpNet: "1.2.3.4", LastSeen: updateTime, Count: 1}, {IpNet: "1.2.4.0/24", LastSeen: updateTime, Count: 1}},
+		},
+		{
+			"带有最后解析时间和次数",
+			"1.2.3.4;1600000000;3,2001:db8::1;1600000001;1",
+			[]db.HistoryIp{{IpNet: "1.2.3.4", LastSeen: time.Unix(1600000000, 0), Count: 3}, {IpNet: "2001:db8::1", LastSeen: time.Unix(1600000001, 0), Count: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := LegacyHistory{History: sql.NullString{Valid: true, String: tt.history}, UpdateTime: types.LocalTime(updateTime)}
+			got := parseLegacyHistory(row)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLegacyHistory() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeHistoryIp(t *testing.T) {
+	a := []db.HistoryIp{{IpNet: "1.2.3.4", FirstSeen: time.Unix(80, 0), LastSeen: time.Unix(100, 0), Count: 2}}
+	b := []db.HistoryIp{{IpNet: "1.2.3.4", FirstSeen: time.Unix(10, 0), LastSeen: time.Unix(50, 0), Count: 1}, {IpNet: "1.2.3.5", LastSeen: time.Unix(60, 0), Count: 1}}
+	want := []db.HistoryIp{{IpNet: "1.2.3.4", FirstSeen: time.Unix(10, 0), LastSeen: time.Unix(100, 0), Count: 3}, {IpNet: "1.2.3.5", LastSeen: time.Unix(60, 0), Count: 1}}
+	if got := db.MergeHistoryIp(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeHistoryIp() = %v, want %v", got, want)
+	}
+}
+
+func TestSavaHistory(t *testing.T) {
+	forEachDriver(t, testSavaHistory)
+}
+
+func testSavaHistory(t *testing.T, d *gorm.DB) {
+	s := newTestStore(t, d)
+
+	his := db.History{Name: "*.example.com", ForwardId: 1, ClientHost: "192.168.1.2"}
+	his.History = []db.HistoryIp{{IpNet: "1.2.3.4", FirstSeen: time.Unix(100, 0), LastSeen: time.Unix(100, 0), Count: 1}}
+	if err := s.SavaHistory(his); err != nil {
+		t.Fatal(err)
+	}
+	// 同一批中的重复IP合并后写入
+	his.History = []db.HistoryIp{
+		{IpNet: "1.2.3.4", FirstSeen: time.Unix(200, 0), LastSeen: time.Unix(200, 0), Count: 1},
+		{IpNet: "1.2.3.5", FirstSeen: time.Unix(200, 0), LastSeen: time.Unix(200, 0), Count: 1},
+		{IpNet: "1.2.3.4", FirstSeen: time.Unix(200, 0), LastSeen: time.Unix(200, 0), Count: 1},
+	}
+	if err := s.SavaHistory(his); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []HistoryIp
+	if err := d.Order("cidr").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	got := make([]db.HistoryIp, len(rows))
+	for i, row := range rows {
+		got[i] = toDbHistoryIp(row)
+	}
+	want := []db.HistoryIp{
+		{IpNet: "1.2.3.4", FirstSeen: time.Unix(100, 0), LastSeen: time.Unix(200, 0), Count: 3},
+		{IpNet: "1.2.3.5", FirstSeen: time.Unix(200, 0), LastSeen: time.Unix(200, 0), Count: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("history_ip = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].IpNet != want[i].IpNet || !got[i].FirstSeen.Equal(want[i].FirstSeen) || !got[i].LastSeen.Equal(want[i].LastSeen) || got[i].Count != want[i].Count {
+			t.Errorf("history_ip[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	removed, err := s.PruneHistory(time.Unix(150, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("PruneHistory() = %d, want 0", removed)
+	}
+	removed, err = s.PruneHistory(time.Unix(300, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("PruneHistory() = %d, want 2", removed)
+	}
+}
+
+func TestMigrateLegacyHistory(t *testing.T) {
+	forEachDriver(t, testMigrateLegacyHistory)
+}
+
+func testMigrateLegacyHistory(t *testing.T, d *gorm.DB) {
+	newTestStore(t, d)
+	if err := d.Migrator().CreateTable(&LegacyHistory{}); err != nil {
+		t.Fatal(err)
+	}
+	// 旧版本的历史中可能存在重复的IP
+	row := LegacyHistory{Name: "example.com", ForwardId: 1, History: sql.NullString{String: "1.2.3.4;100;1,1.2.3.5;100;1,1.2.3.4;200;2", Valid: true},
+		CreateTime: types.LocalTime(time.Unix(50, 0)), UpdateTime: types.LocalTime(time.Unix(200, 0))}
+	if err := d.Create(&row).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := MigrateLegacyHistory(d); err != nil || n != 1 {
+		t.Fatalf("MigrateLegacyHistory() = %d, %v", n, err)
+	}
+
+	var rows []HistoryIp
+	if err := d.Order("cidr").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Cidr != "1.2.3.4" || rows[0].Count != 3 || rows[1].Cidr != "1.2.3.5" || rows[1].Name != "example.com" {
+		t.Errorf("history_ip = %+v", rows)
+	}
+	var count int64
+	if err := d.Model(&LegacyHistory{}).Count(&count).Error; err != nil || count != 0 {
+		t.Errorf("legacy history count = %d, %v", count, err)
+	}
+}
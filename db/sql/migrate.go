@@ -0,0 +1,208 @@
+package sql
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/laeni/pri-dns/types"
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration 表示一个版本的表结构变更，版本号从 1 开始递增
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// SchemaVersion 记录已经执行的迁移.
+type SchemaVersion struct {
+	Version     int    `gorm:"primaryKey;autoIncrement:false"`
+	Name        string // 迁移名称
+	AppliedTime types.LocalTime
+}
+
+func (SchemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// 无法用 SQL 文件表达的迁移，比如需要判断已有的表结构
+var codeMigrations = []migration{
+	{Version: 2, Name: "name_client_host_index", Up: createIndexes},
+	{Version: 4, Name: "rule_schedule", Up: addColumns(scheduleColumns)},
+	{Version: 6, Name: "forward_policy", Up: addColumns(policyColumns)},
+	{Version: 7, Name: "forward_mode", Up: addColumns(forwardModeColumns)},
+}
+
+// 需要创建的索引，表由用户手动创建时可能已经存在同名索引，所以只创建不存在的索引
+var indexes = []struct {
+	table, name, columns string
+}{
+	{"domain", "idx_domain_name_client_host", "name, client_host"},
+	{"forward", "idx_forward_name_client_host", "name, client_host"},
+	{"history_ex", "idx_history_ex_client_host", "client_host"},
+	{"history_ip", "idx_history_ip_forward_id", "forward_id"},
+	{"history_ip", "idx_history_ip_last_seen", "last_seen"},
+}
+
+func createIndexes(tx *gorm.DB) error {
+	for _, it := range indexes {
+		if tx.Migrator().HasIndex(it.table, it.name) {
+			continue
+		}
+		if err := tx.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", it.name, it.table, it.columns)).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// column 需要添加的列，definition 中的 %TIMESTAMP% 将替换为数据库对应的时间类型
+type column struct {
+	table, column, definition string
+}
+
+// 规则生效时间相关的列
+var scheduleColumns = []column{
+	{"domain", "start_time", "%TIMESTAMP%"},
+	{"domain", "end_time", "%TIMESTAMP%"},
+	{"domain", "schedule", "VARCHAR(255)"},
+	{"forward", "start_time", "%TIMESTAMP%"},
+	{"forward", "end_time", "%TIMESTAMP%"},
+	{"forward", "schedule", "VARCHAR(255)"},
+	{"history_ex", "enable", "CHAR(1) NOT NULL DEFAULT 'Y'"},
+}
+
+// 转发规则的响应策略
+var policyColumns = []column{
+	{"forward", "policy", "VARCHAR(64)"},
+}
+
+// 转发规则的回退DNS服务器和转发模式，初始表结构中已包含，但用户按旧版本 README 手动创建的表中没有
+var forwardModeColumns = []column{
+	{"forward", "fallback_svr", "VARCHAR(1024)"},
+	{"forward", "mode", "VARCHAR(16)"},
+	{"forward", "ip_set", "VARCHAR(64)"},
+}
+
+// addColumns 返回添加 columns 的迁移，用户可能已经手动添加，所以只添加不存在的列
+func addColumns(columns []column) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		timestamp := "DATETIME"
+		if tx.Dialector.Name() == DriverPostgres {
+			timestamp = "TIMESTAMP"
+		}
+		for _, it := range columns {
+			if tx.Migrator().HasColumn(it.table, it.column) {
+				continue
+			}
+			definition := strings.ReplaceAll(it.definition, "%TIMESTAMP%", timestamp)
+			if err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", it.table, it.column, definition)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migrate 按版本顺序执行所有未执行的迁移，并在 schema_version 表中记录，返回本次执行的迁移数量.
+// 迁移包括 migrations 目录下数据库对应目录中以 "版本号_名称.sql" 命名的 SQL 文件以及 codeMigrations 中的迁移
+func Migrate(d *gorm.DB) (int, error) {
+	all, err := loadMigrations(d.Dialector.Name())
+	if err != nil {
+		return 0, err
+	}
+	if err := d.Migrator().AutoMigrate(&SchemaVersion{}); err != nil {
+		return 0, err
+	}
+	var applied []SchemaVersion
+	if err := d.Find(&applied).Error; err != nil {
+		return 0, err
+	}
+	done := make(map[int]struct{}, len(applied))
+	for _, it := range applied {
+		done[it.Version] = struct{}{}
+	}
+
+	count := 0
+	for _, m := range all {
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		// MySQL 中的 DDL 会隐式提交，所以不放在事务中，执行失败时需要根据错误手动处理
+		if err := m.Up(d); err != nil {
+			return count, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		if err := d.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedTime: types.LocalTime(time.Now())}).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// loadMigrations 加载所有迁移并按版本排序，版本号重复时返回错误
+func loadMigrations(dialect string) ([]migration, error) {
+	all := append([]migration{}, codeMigrations...)
+	names, err := fs.Glob(migrationFiles, "migrations/"+dialect+"/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("unsupported database: %s", dialect)
+	}
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		version, title, ok := strings.Cut(base, "_")
+		v, err := strconv.Atoi(version)
+		if !ok || err != nil || v < 1 {
+			return nil, fmt.Errorf("invalid migration file name: %s", name)
+		}
+		content, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, migration{Version: v, Name: title, Up: execStatements(string(content))})
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Version < all[j].Version
+	})
+	for i := 1; i < len(all); i++ {
+		if all[i].Version == all[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version: %d", all[i].Version)
+		}
+	}
+	return all, nil
+}
+
+// execStatements 依次执行以分号结尾的多条语句，以 "--" 开头的行为注释
+func execStatements(content string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		var lines []string
+		for _, line := range strings.Split(content, "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "--") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		for _, stmt := range strings.Split(strings.Join(lines, "\n"), ";") {
+			if stmt = strings.TrimSpace(stmt); stmt == "" {
+				continue
+			}
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,105 @@
+package sql
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/laeni/pri-dns/db"
+
+	"gorm.io/gorm"
+)
+
+func TestMigrate(t *testing.T) {
+	forEachDriver(t, testMigrate)
+}
+
+func testMigrate(t *testing.T, d *gorm.DB) {
+	all, err := loadMigrations(d.Dialector.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Migrate(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(all) {
+		t.Errorf("Migrate() = %d, want %d", n, len(all))
+	}
+	for _, table := range []string{"domain", "forward", "history_ex", "history_ip", "rule_version", "audit_log", "schema_version"} {
+		if !d.Migrator().HasTable(table) {
+			t.Errorf("table %s not created", table)
+		}
+	}
+	for _, it := range indexes {
+		if !d.Migrator().HasIndex(it.table, it.name) {
+			t.Errorf("index %s not created", it.name)
+		}
+	}
+	for _, it := range append(append(append([]column{}, scheduleColumns...), policyColumns...), forwardModeColumns...) {
+		if !d.Migrator().HasColumn(it.table, it.column) {
+			t.Errorf("column %s.%s not created", it.table, it.column)
+		}
+	}
+
+	// 再次执行时不会重复执行
+	n, err = Migrate(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Migrate() again = %d, want 0", n)
+	}
+	var versions []SchemaVersion
+	if err := d.Order("version").Find(&versions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != len(all) || versions[len(versions)-1].Version != all[len(all)-1].Version {
+		t.Errorf("schema_version = %v", versions)
+	}
+}
+
+func TestMigrateExistingTables(t *testing.T) {
+	forEachDriver(t, testMigrateExistingTables)
+}
+
+func testMigrateExistingTables(t *testing.T, d *gorm.DB) {
+	// 用户按 README 手动创建的表以及索引，forward 表为旧版本的表结构
+	id, timestamp := "BIGINT AUTO_INCREMENT PRIMARY KEY", "DATETIME"
+	switch d.Dialector.Name() {
+	case DriverSQLite:
+		id = "INTEGER PRIMARY KEY AUTOINCREMENT"
+	case DriverPostgres:
+		id, timestamp = "BIGSERIAL PRIMARY KEY", "TIMESTAMP"
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE domain (id BIGINT PRIMARY KEY, client_host VARCHAR(64), name VARCHAR(255))",
+		"CREATE INDEX idx_domain_name_client_host ON domain (name, client_host)",
+		"CREATE TABLE forward (id " + id + ", client_host VARCHAR(64) NOT NULL DEFAULT '', name VARCHAR(255) NOT NULL, dns_svr VARCHAR(1024), " +
+			"deny_global CHAR(1) NOT NULL DEFAULT 'N', enable CHAR(1) NOT NULL DEFAULT 'Y', create_time " + timestamp + ", update_time " + timestamp + ")",
+	} {
+		if err := d.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Migrate(d); err != nil {
+		t.Fatal(err)
+	}
+	if !d.Migrator().HasIndex("forward", "idx_forward_name_client_host") {
+		t.Error("index idx_forward_name_client_host not created")
+	}
+
+	// 迁移后可以保存新版本的转发规则
+	store := NewStore(d)
+	forward := db.Forward{Name: "example.com", DnsSvr: []string{"8.8.8.8"}, FallbackSvr: []string{"1.1.1.1"},
+		Mode: db.ForwardModeSmart, IpSet: "china", Policy: "ipv4", Enable: true}
+	if err := store.SaveRules(db.RuleChanges{CreateForwards: []db.Forward{forward}}); err != nil {
+		t.Fatal(err)
+	}
+	forwards, err := store.FindForwardByHost("")
+	if err != nil || len(forwards) != 1 {
+		t.Fatalf("FindForwardByHost() = %+v, %v", forwards, err)
+	}
+	if got := forwards[0]; !reflect.DeepEqual(got.FallbackSvr, forward.FallbackSvr) || got.Mode != forward.Mode || got.IpSet != forward.IpSet || got.Policy != forward.Policy {
+		t.Errorf("forward = %+v", got)
+	}
+}
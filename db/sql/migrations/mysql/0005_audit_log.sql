@@ -0,0 +1,17 @@
+-- 规则变更的审计记录，同一规则的所有记录即为该规则的版本历史
+CREATE TABLE IF NOT EXISTS audit_log
+(
+    id          BIGINT      NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    rule_type   VARCHAR(16) NOT NULL,
+    rule_id     BIGINT      NOT NULL,
+    client_host VARCHAR(64) NOT NULL DEFAULT '',
+    action      VARCHAR(16) NOT NULL,
+    actor       VARCHAR(64) NOT NULL DEFAULT '',
+    client_ip   VARCHAR(64) NOT NULL DEFAULT '',
+    before_json TEXT,
+    after_json  TEXT,
+    create_time DATETIME   NOT NULL
+);
+
+CREATE INDEX idx_audit_log_rule ON audit_log (rule_type, rule_id);
+CREATE INDEX idx_audit_log_create_time ON audit_log (create_time);
@@ -0,0 +1,53 @@
+-- 初始表结构。已存在的表不会被修改
+CREATE TABLE IF NOT EXISTS domain
+(
+    id          BIGSERIAL    PRIMARY KEY,
+    client_host VARCHAR(64)  NOT NULL DEFAULT '',
+    name        VARCHAR(255) NOT NULL,
+    value       VARCHAR(255),
+    ttl         INT,
+    dns_type    VARCHAR(16),
+    deny_global CHAR(1)      NOT NULL DEFAULT 'N',
+    enable      CHAR(1)      NOT NULL DEFAULT 'Y',
+    create_time TIMESTAMP,
+    update_time TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS forward
+(
+    id           BIGSERIAL    PRIMARY KEY,
+    client_host  VARCHAR(64)  NOT NULL DEFAULT '',
+    name         VARCHAR(255) NOT NULL,
+    dns_svr      VARCHAR(1024),
+    fallback_svr VARCHAR(1024),
+    mode         VARCHAR(16),
+    ip_set       VARCHAR(64),
+    deny_global  CHAR(1)      NOT NULL DEFAULT 'N',
+    enable       CHAR(1)      NOT NULL DEFAULT 'Y',
+    create_time  TIMESTAMP,
+    update_time  TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS history_ex
+(
+    id          BIGSERIAL   PRIMARY KEY,
+    client_host VARCHAR(64) NOT NULL DEFAULT '',
+    ip_net      VARCHAR(64) NOT NULL,
+    deny_global CHAR(1)     NOT NULL DEFAULT 'N',
+    label       VARCHAR(64),
+    create_time TIMESTAMP,
+    update_time TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS history_ip
+(
+    id          BIGSERIAL    PRIMARY KEY,
+    name        VARCHAR(255) NOT NULL,
+    forward_id  BIGINT       NOT NULL DEFAULT 0,
+    client_host VARCHAR(64)  NOT NULL DEFAULT '',
+    cidr        VARCHAR(64)  NOT NULL,
+    first_seen  TIMESTAMP     NOT NULL,
+    last_seen   TIMESTAMP     NOT NULL,
+    count       BIGINT       NOT NULL DEFAULT 0,
+    CONSTRAINT uk_history_ip UNIQUE (name, forward_id, client_host, cidr)
+);
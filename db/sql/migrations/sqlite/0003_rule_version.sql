@@ -0,0 +1,8 @@
+-- 规则版本号，每次通过存储保存规则时加一，用于多个实例之间的变更通知
+CREATE TABLE IF NOT EXISTS rule_version
+(
+    id      INT    NOT NULL PRIMARY KEY,
+    version BIGINT NOT NULL
+);
+
+INSERT INTO rule_version (id, version) VALUES (1, 0);
@@ -0,0 +1,127 @@
+package sql
+
+import (
+	"database/sql"
+	"github.com/laeni/pri-dns/types"
+)
+
+// Domain 解析记录表.
+type Domain struct {
+	ID         int64  `gorm:"primaryKey"` // 客户端地址（生效范围）。<br />如果全局生效，则该字段为空。
+	ClientHost string // 主机记录。由于可能存在泛域名，所以为了便于使用索引，存储时将采用反转格式，如：example.com
+	Name       string
+	Value      sql.NullString  // 记录值
+	Ttl        sql.NullInt32   // TTL
+	DnsType    sql.NullString  // 记录类型。<br />A | AAAA
+	DenyGlobal string          // 是否拒绝全局解析
+	Enable     string          // 是否启用
+	StartTime  sql.NullTime    // 生效开始时间
+	EndTime    sql.NullTime    // 生效结束时间
+	Schedule   sql.NullString  // 每周的生效时间段
+	CreateTime types.LocalTime // 创建时间
+	UpdateTime types.LocalTime // 修改时间
+}
+
+func (Domain) TableName() string {
+	return "domain"
+}
+
+// Forward 转发配置.
+type Forward struct {
+	ID          int64           `gorm:"primaryKey"`
+	ClientHost  string          // 客户端地址（生效范围）。<br />如果全局生效，则该字段为空。
+	Name        string          // 需要转发解析的域名
+	DnsSvr      sql.NullString  // 转发目标DNS服务器，可以是多个，多个以逗号分割
+	FallbackSvr sql.NullString  // 回退DNS服务器，可以是多个，多个以逗号分割
+	Mode        sql.NullString  // 转发模式。<br />为空表示普通模式；smart 表示智能模式；next 表示交给下一个插件解析
+	IpSet       sql.NullString  // 智能模式下期望的IP集合名称
+	Policy      sql.NullString  // 响应策略名称
+	DenyGlobal  string          // 是否拒绝全局解析
+	Enable      string          // 是否启用
+	StartTime   sql.NullTime    // 生效开始时间
+	EndTime     sql.NullTime    // 生效结束时间
+	Schedule    sql.NullString  // 每周的生效时间段
+	CreateTime  types.LocalTime // 创建时间
+	UpdateTime  types.LocalTime // 修改时间
+}
+
+func (Forward) TableName() string {
+	return "forward"
+}
+
+// HistoryIp 解析历史，每个转发规则、客户端和IP一条记录.
+// 其中 (name, forward_id, client_host, cidr) 唯一.
+type HistoryIp struct {
+	ID         int64           `gorm:"primaryKey"`
+	Name       string          // 需要转发解析的域名
+	ForwardId  int64           // 产生该历史的转发规则ID，为 0 时表示未知
+	ClientHost string          // 产生该历史的客户端地址，为空时表示未知
+	Cidr       string          // 解析得到的IP或网段
+	FirstSeen  types.LocalTime // 第一次解析得到该IP的时间
+	LastSeen   types.LocalTime // 最后一次解析得到该IP的时间
+	Count      int64           // 解析得到该IP的次数
+}
+
+func (HistoryIp) TableName() string {
+	return "history_ip"
+}
+
+// LegacyHistory 旧版本的解析历史，多个IP以逗号分割存储在一列中，只用于迁移到 history_ip.
+type LegacyHistory struct {
+	ID         int64           `gorm:"primaryKey"`
+	Name       string          // 需要转发解析的域名
+	ForwardId  int64           // 产生该历史的转发规则ID，为 0 时表示未知
+	ClientHost string          // 产生该历史的客户端地址，为空时表示未知
+	History    sql.NullString  // 解析记录，多个以逗号分割
+	CreateTime types.LocalTime // 创建时间
+	UpdateTime types.LocalTime // 修改时间
+}
+
+func (LegacyHistory) TableName() string {
+	return "history"
+}
+
+// HistoryEx 用于排除历史中的网段。
+// 由于历史数据需要按照一定规则聚合精简，所以处理后的范围可能包含一些特殊网段，比如内网等，所以这里列出的数据将在处理后生效，即精确排除这里列出的网段.
+type HistoryEx struct {
+	ID         int64 `gorm:"primaryKey"` // 客户端地址（生效范围）。<br />如果全局生效，则该字段为空。
+	ClientHost string
+	IpNet      string          // 需要排除的网段
+	DenyGlobal string          // 是否拒绝全局.为了简化，和 domain 表一样当 clent_host 为空时的记录对所有人生效，但是特定的某个而可以排除这种默认设置
+	Label      sql.NullString  // 标签/分组
+	Enable     string          // 是否启用
+	CreateTime types.LocalTime // 创建时间
+	UpdateTime types.LocalTime // 修改时间
+}
+
+func (HistoryEx) TableName() string {
+	return "history_ex"
+}
+
+// RuleVersion 规则版本号，只有一条 ID 为 1 的记录，每次通过存储保存规则时加一.
+type RuleVersion struct {
+	ID      int64 `gorm:"primaryKey"`
+	Version int64
+}
+
+func (RuleVersion) TableName() string {
+	return "rule_version"
+}
+
+// AuditLog 规则变更的审计记录.
+type AuditLog struct {
+	ID         int64           `gorm:"primaryKey"`
+	RuleType   string          // 规则类型。<br />domain | forward | history_ex
+	RuleId     int64           // 规则ID
+	ClientHost string          // 规则的生效范围
+	Action     string          // 操作。<br />create | update | delete
+	Actor      string          // 操作者
+	ClientIp   string          // 操作者的IP
+	BeforeJson sql.NullString  // 变更前的规则
+	AfterJson  sql.NullString  // 变更后的规则
+	CreateTime types.LocalTime // 变更时间
+}
+
+func (AuditLog) TableName() string {
+	return "audit_log"
+}
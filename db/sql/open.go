@@ -0,0 +1,32 @@
+package sql
+
+import (
+	"fmt"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// Open 根据驱动名称打开数据库，driver 为 mysql、postgres 或 sqlite
+func Open(driver, dsn string, opts ...gorm.Option) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case DriverMySQL:
+		dialector = mysql.Open(dsn)
+	case DriverPostgres:
+		dialector = postgres.Open(dsn)
+	case DriverSQLite:
+		dialector = sqlite.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unsupported sql driver: %s", driver)
+	}
+	return gorm.Open(dialector, opts...)
+}
@@ -0,0 +1,386 @@
+package sql
+
+import (
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+	"github.com/laeni/pri-dns/util"
+	"gorm.io/gorm"
+	"time"
+)
+
+type Store struct {
+	db           *gorm.DB
+	pollInterval time.Duration // Watch 查询规则是否变更的间隔
+}
+
+func NewStore(db *gorm.DB) Store {
+	return Store{db: db, pollInterval: defaultPollInterval}
+}
+
+func (s *Store) FindForwardByHostAndName(host, name string) ([]db.Forward, error) {
+	return s.FindForwardByHostAndNames(host, util.GenAllMatchDomain(name))
+}
+
+func (s *Store) FindForwardByHostAndNames(host string, names []string) ([]db.Forward, error) {
+	var forwardTemps []Forward
+	err := s.db.Where("name IN ? AND (client_host IS NULL OR client_host = '' OR client_host = ?)", names, host).Find(&forwardTemps).Error
+	if err != nil {
+		return nil, err
+	}
+
+	forwards := make([]db.Forward, len(forwardTemps))
+	for i, temp := range forwardTemps {
+		forwards[i] = toDbForward(temp)
+	}
+	return forwards, nil
+}
+
+func (s *Store) FindDomainByHostAndName(host, name string) ([]db.Domain, error) {
+	names := util.GenAllMatchDomain(name)
+
+	var domainTemps []Domain
+	err := s.db.Where("name IN ? AND (client_host IS NULL OR client_host = '' OR client_host = ?)", names, host).Find(&domainTemps).Error
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make([]db.Domain, len(domainTemps))
+	for i, temp := range domainTemps {
+		domains[i] = toDbDomain(temp)
+	}
+	return domains, nil
+}
+
+func (s *Store) FindDomainByHost(host string) ([]db.Domain, error) {
+	var domainTemps []Domain
+	if err := whereHost(s.db, host).Find(&domainTemps).Error; err != nil {
+		return nil, err
+	}
+
+	domains := make([]db.Domain, len(domainTemps))
+	for i, temp := range domainTemps {
+		domains[i] = toDbDomain(temp)
+	}
+	return domains, nil
+}
+
+func (s *Store) FindForwardByHost(host string) ([]db.Forward, error) {
+	var forwardTemps []Forward
+	if err := whereHost(s.db, host).Find(&forwardTemps).Error; err != nil {
+		return nil, err
+	}
+
+	forwards := make([]db.Forward, len(forwardTemps))
+	for i, temp := range forwardTemps {
+		forwards[i] = toDbForward(temp)
+	}
+	return forwards, nil
+}
+
+func (s *Store) FindAllRules() ([]db.Domain, []db.Forward, error) {
+	var domainTemps []Domain
+	var forwardTemps []Forward
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Find(&domainTemps).Error; err != nil {
+			return err
+		}
+		return tx.Find(&forwardTemps).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	domains := make([]db.Domain, len(domainTemps))
+	for i, temp := range domainTemps {
+		domains[i] = toDbDomain(temp)
+	}
+	forwards := make([]db.Forward, len(forwardTemps))
+	for i, temp := range forwardTemps {
+		forwards[i] = toDbForward(temp)
+	}
+	return domains, forwards, nil
+}
+
+// 精确匹配生效范围，host 为空时只匹配全局数据
+func whereHost(tx *gorm.DB, host string) *gorm.DB {
+	if host == "" {
+		return tx.Where("client_host IS NULL OR client_host = ''")
+	}
+	return tx.Where("client_host = ?", host)
+}
+
+func (s *Store) SaveRules(changes db.RuleChanges) error {
+	now := types.LocalTime(time.Now())
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		a := auditor{tx: tx, changes: changes, enabled: tx.Migrator().HasTable(&AuditLog{})}
+		for _, it := range changes.CreateDomains {
+			it.CreateTime, it.UpdateTime = now, now
+			temp := fromDbDomain(it)
+			if err := tx.Create(&temp).Error; err != nil {
+				return err
+			}
+			it.ID = temp.ID
+			a.log(nil, &it)
+		}
+		for _, it := range changes.UpdateDomains {
+			old, err := findById[Domain](tx, it.ID)
+			if err != nil {
+				return err
+			}
+			it.UpdateTime = now
+			temp := fromDbDomain(it)
+			if err := tx.Omit("create_time").Save(&temp).Error; err != nil {
+				return err
+			}
+			if old != nil {
+				before := toDbDomain(*old)
+				it.CreateTime = before.CreateTime
+				a.log(&before, &it)
+			} else {
+				a.log(nil, &it)
+			}
+		}
+		for _, it := range changes.DeleteDomains {
+			old, err := findById[Domain](tx, it.ID)
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				// 与内存存储一致，忽略不存在的记录，继续处理其他变更
+				continue
+			}
+			if err := tx.Delete(&Domain{}, it.ID).Error; err != nil {
+				return err
+			}
+			before := toDbDomain(*old)
+			a.log(&before, nil)
+		}
+		for _, it := range changes.CreateForwards {
+			it.CreateTime, it.UpdateTime = now, now
+			temp := fromDbForward(it)
+			if err := tx.Create(&temp).Error; err != nil {
+				return err
+			}
+			it.ID = temp.ID
+			a.log(nil, &it)
+		}
+		for _, it := range changes.UpdateForwards {
+			old, err := findById[Forward](tx, it.ID)
+			if err != nil {
+				return err
+			}
+			it.UpdateTime = now
+			temp := fromDbForward(it)
+			if err := tx.Omit("create_time").Save(&temp).Error; err != nil {
+				return err
+			}
+			if old != nil {
+				before := toDbForward(*old)
+				it.CreateTime = before.CreateTime
+				a.log(&before, &it)
+			} else {
+				a.log(nil, &it)
+			}
+		}
+		for _, it := range changes.DeleteForwards {
+			old, err := findById[Forward](tx, it.ID)
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				// 与内存存储一致，忽略不存在的记录，继续处理其他变更
+				continue
+			}
+			if err := tx.Delete(&Forward{}, it.ID).Error; err != nil {
+				return err
+			}
+			before := toDbForward(*old)
+			a.log(&before, nil)
+		}
+		for _, it := range changes.CreateHistoryExes {
+			temp := fromDbHistoryEx(it)
+			temp.CreateTime, temp.UpdateTime = now, now
+			if err := tx.Create(&temp).Error; err != nil {
+				return err
+			}
+			it.ID = temp.ID
+			a.log(nil, &it)
+		}
+		for _, it := range changes.UpdateHistoryExes {
+			old, err := findById[HistoryEx](tx, it.ID)
+			if err != nil {
+				return err
+			}
+			temp := fromDbHistoryEx(it)
+			temp.UpdateTime = now
+			if err := tx.Omit("create_time").Save(&temp).Error; err != nil {
+				return err
+			}
+			if old != nil {
+				before := toDbHistoryEx(*old)
+				a.log(&before, &it)
+			} else {
+				a.log(nil, &it)
+			}
+		}
+		for _, it := range changes.DeleteHistoryExes {
+			old, err := findById[HistoryEx](tx, it.ID)
+			if err != nil {
+				return err
+			}
+			if old == nil {
+				// 与内存存储一致，忽略不存在的记录，继续处理其他变更
+				continue
+			}
+			if err := tx.Delete(&HistoryEx{}, it.ID).Error; err != nil {
+				return err
+			}
+			before := toDbHistoryEx(*old)
+			a.log(&before, nil)
+		}
+		if a.err != nil {
+			return a.err
+		}
+		if changes.Empty() {
+			return nil
+		}
+		return bumpRuleVersion(tx)
+	})
+}
+
+// findById 查询ID为 id 的记录，不存在时返回 nil
+func findById[T any](tx *gorm.DB, id int64) (*T, error) {
+	var rows []T
+	if err := tx.Limit(1).Find(&rows, id).Error; err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+// auditor 在保存规则的事务中记录审计记录，audit_log 表不存在时（手动建表且未升级）不记录。
+// 第一次出错后不再记录，错误由调用者在事务结束前检查
+type auditor struct {
+	tx      *gorm.DB
+	changes db.RuleChanges
+	enabled bool
+	err     error
+}
+
+// log 的参数与 db.NewAuditLog 相同，action 根据 before 和 after 是否为 nil 确定
+func (a *auditor) log(before, after any) {
+	if !a.enabled || a.err != nil {
+		return
+	}
+	action := db.AuditUpdate
+	if before == nil {
+		action = db.AuditCreate
+	} else if after == nil {
+		action = db.AuditDelete
+	}
+	temp := fromDbAuditLog(db.NewAuditLog(a.changes, action, before, after))
+	a.err = a.tx.Create(&temp).Error
+}
+
+// FindAudit 查询满足条件的审计记录，按时间倒序排列
+func (s *Store) FindAudit(filter db.AuditFilter) ([]db.AuditLog, error) {
+	tx := s.db.Model(&AuditLog{})
+	if filter.ID != 0 {
+		tx = tx.Where("id = ?", filter.ID)
+	}
+	if filter.RuleType != "" {
+		tx = tx.Where("rule_type = ?", filter.RuleType)
+	}
+	if filter.RuleId != 0 {
+		tx = tx.Where("rule_id = ?", filter.RuleId)
+	}
+	if filter.ClientHost != nil {
+		tx = tx.Where("client_host = ?", *filter.ClientHost)
+	}
+	if filter.Actor != "" {
+		tx = tx.Where("actor = ?", filter.Actor)
+	}
+	if filter.ClientIp != "" {
+		tx = tx.Where("client_ip = ?", filter.ClientIp)
+	}
+	if !filter.Since.IsZero() {
+		tx = tx.Where("create_time >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		tx = tx.Where("create_time < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		tx = tx.Limit(filter.Limit)
+	}
+	var temps []AuditLog
+	if err := tx.Order("id DESC").Find(&temps).Error; err != nil {
+		return nil, err
+	}
+	logs := make([]db.AuditLog, len(temps))
+	for i, temp := range temps {
+		logs[i] = toDbAuditLog(temp)
+	}
+	return logs, nil
+}
+
+func (s *Store) FindHistoryByHost(host, scope string) ([]db.HistoryIp, []string, error) {
+	tx := s.db.Begin()
+	if tx.Error != nil {
+		return nil, nil, tx.Error
+	}
+	defer tx.Rollback()
+
+	// 查询全局和客户端对应的转发域名
+	var forwardTemps []Forward
+	err := tx.Where("enable = 'Y' AND (client_host IS NULL OR client_host = '' OR client_host = ?)", host).Find(&forwardTemps).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	forwards := make([]db.Forward, len(forwardTemps))
+	for i, temp := range forwardTemps {
+		forwards[i] = toDbForward(temp)
+	}
+	forwards = db.HistoryForwards(forwards, scope)
+
+	var his []db.HistoryIp
+	if scope == db.HistoryScopeAll {
+		// 查询转发域名对应的所有解析历史
+		names := make([]string, len(forwards))
+		for i, s := range forwards {
+			names[i] = s.Name
+		}
+		his, err = findHistoryHostsByNames(tx, names)
+	} else {
+		// 只查询实际生效的转发规则产生的解析历史
+		ids := make([]int64, len(forwards))
+		for i, s := range forwards {
+			ids[i] = s.ID
+		}
+		his, err = findHistoryHostsByForwardIds(tx, ids)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 查询需要排除的网段，比如内网网段
+	var historyExes []HistoryEx
+	err = tx.Where("client_host IS NULL OR client_host = '' OR client_host = ?", host).Find(&historyExes).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	exes := make([]db.HistoryEx, len(historyExes))
+	for i, temp := range historyExes {
+		exes[i] = toDbHistoryEx(temp)
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return nil, nil, err
+	}
+	return his, db.HistoryExNets(exes), nil
+}
+
+func (s *Store) SaveHistoryEx(ex db.HistoryEx) error {
+	return s.SaveRules(db.RuleChanges{CreateHistoryExes: []db.HistoryEx{ex}})
+}
@@ -0,0 +1,17 @@
+package sql
+
+import (
+	"testing"
+
+	"github.com/laeni/pri-dns/db/storetest"
+)
+
+func TestStore(t *testing.T) {
+	for name, newDb := range testDrivers() {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) storetest.Store {
+				return newTestStore(t, newDb(t))
+			})
+		})
+	}
+}
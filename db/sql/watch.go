@@ -0,0 +1,101 @@
+package sql
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// defaultPollInterval 默认查询规则是否变更的间隔
+const defaultPollInterval = 10 * time.Second
+
+// ruleState 用于判断规则是否变更。通过存储保存规则时 rule_version 表中的版本号会增加；
+// 直接修改数据库时只能通过记录数和最后修改时间判断，由于修改时间只精确到秒，同一秒内的多次修改可能无法识别
+type ruleState struct {
+	version                     int64
+	domainCount, forwardCount   int64
+	domainUpdate, forwardUpdate time.Time
+}
+
+// SetPollInterval 设置 Watch 查询规则是否变更的间隔
+func (s *Store) SetPollInterval(interval time.Duration) {
+	s.pollInterval = interval
+}
+
+// Watch 定期查询规则的版本号、记录数及最后修改时间，发生变化时通知
+func (s *Store) Watch(ctx context.Context) (<-chan struct{}, error) {
+	last, err := s.ruleState()
+	if err != nil {
+		return nil, err
+	}
+	interval := s.pollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			state, err := s.ruleState()
+			if err != nil {
+				// 数据库暂时不可用时等待下次查询
+				continue
+			}
+			if state != last {
+				last = state
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// ruleState 查询规则的当前状态。各项分别查询，不需要放在一个事务中，不一致时最多导致多一次通知
+func (s *Store) ruleState() (ruleState, error) {
+	var state ruleState
+	if s.db.Migrator().HasTable(&RuleVersion{}) {
+		var v RuleVersion
+		if err := s.db.Find(&v, 1).Error; err != nil {
+			return state, err
+		}
+		state.version = v.Version
+	}
+
+	var domain Domain
+	if err := s.db.Model(&Domain{}).Count(&state.domainCount).Error; err != nil {
+		return state, err
+	}
+	if err := s.db.Select("update_time").Order("update_time DESC").Limit(1).Find(&domain).Error; err != nil {
+		return state, err
+	}
+	state.domainUpdate = time.Time(domain.UpdateTime)
+
+	var forward Forward
+	if err := s.db.Model(&Forward{}).Count(&state.forwardCount).Error; err != nil {
+		return state, err
+	}
+	if err := s.db.Select("update_time").Order("update_time DESC").Limit(1).Find(&forward).Error; err != nil {
+		return state, err
+	}
+	state.forwardUpdate = time.Time(forward.UpdateTime)
+	return state, nil
+}
+
+// bumpRuleVersion 增加规则版本号，rule_version 表不存在时（没有执行迁移）什么也不做
+func bumpRuleVersion(tx *gorm.DB) error {
+	if !tx.Migrator().HasTable(&RuleVersion{}) {
+		return nil
+	}
+	return tx.Model(&RuleVersion{}).Where("id = ?", 1).Update("version", gorm.Expr("version + 1")).Error
+}
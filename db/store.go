@@ -1,22 +1,56 @@
 package db
 
 import (
+	"context"
 	"github.com/laeni/pri-dns/types"
+	"sort"
+	"time"
 )
 
+// Store 为规则及解析历史的存储。所有方法在存储不可用时都应返回错误，而不是返回空结果
 type Store interface {
 	// FindForwardByHostAndName 查询客户端对应的转发配置，当 host 为 “” 时表示查询全局配置.
-	FindForwardByHostAndName(host, name string) []Forward
+	FindForwardByHostAndName(host, name string) ([]Forward, error)
+
+	// FindForwardByHostAndNames 根据名称精确查询客户端对应的转发配置（包含全局配置），names 中的通配符不会进行展开
+	FindForwardByHostAndNames(host string, names []string) ([]Forward, error)
 
 	// FindDomainByHostAndName 查询 qname 的解析记录。如果 host 不为空，则查询host下的解析，如果为空则只查询全局解析
-	FindDomainByHostAndName(host, qname string) []Domain
+	FindDomainByHostAndName(host, qname string) ([]Domain, error)
+
+	// FindDomainByHost 查询生效范围为 host 的所有解析记录，当 host 为 “” 时表示查询全局解析。私有查询的结果不包含全局解析
+	FindDomainByHost(host string) ([]Domain, error)
+
+	// FindForwardByHost 查询生效范围为 host 的所有转发配置，当 host 为 “” 时表示查询全局配置。私有查询的结果不包含全局配置
+	FindForwardByHost(host string) ([]Forward, error)
+
+	// FindAllRules 查询所有生效范围的解析记录和转发配置，包含未启用的规则
+	FindAllRules() ([]Domain, []Forward, error)
+
+	// SaveRules 在一个事务中保存规则的变更，并为每条规则的变更记录一条审计记录
+	SaveRules(changes RuleChanges) error
+
+	// FindAudit 查询满足条件的审计记录，按时间倒序排列
+	FindAudit(filter AuditFilter) ([]AuditLog, error)
 
-	// SavaHistory 保存历史
-	SavaHistory(name string, newHis []string) error
+	// SavaHistory 保存历史，his.History 将与同一转发规则、同一客户端的已有历史合并
+	SavaHistory(his History) error
 
 	// FindHistoryByHost 查询客户端对应的解析历史，当 host 为 “” 时表示查询全局配置.
-	// 其中返回值的二个值表示需要排除的网段
-	FindHistoryByHost(host string) ([]string, []string)
+	// scope 为 HistoryScopeMine 时只包含客户端实际生效的转发规则产生的历史；为 HistoryScopeAll 时包含客户端转发的域名的所有历史.
+	// 其中返回值的第二个值表示需要排除的网段
+	FindHistoryByHost(host, scope string) ([]HistoryIp, []string, error)
+
+	// PruneHistory 删除最后解析时间早于 before 的解析历史，返回删除的IP数量
+	PruneHistory(before time.Time) (int64, error)
+}
+
+// ChangeFeed 为支持规则变更通知的存储。多个实例共享同一存储时，通过任意实例修改规则后，其他实例可以据此及时清理缓存。
+// 目前 SQL 存储（轮询规则版本号）和内存存储实现了该接口；etcd 和 Redis 存储尚未实现，其变更通知也不在此范围内
+type ChangeFeed interface {
+	// Watch 订阅规则变更，规则变更后通道中会收到一个通知，短时间内的多次变更可能合并为一次通知。
+	// ctx 取消或者订阅出错时通道将被关闭
+	Watch(ctx context.Context) (<-chan struct{}, error)
 }
 
 type RecordFilter interface {
@@ -35,10 +69,18 @@ type Domain struct {
 	DnsType    string          // 记录类型。<br />A | AAAA
 	DenyGlobal bool            // 是否拒绝全局解析
 	Enable     bool            // 是否启用
+	StartTime  time.Time       // 生效开始时间，为零值时表示不限
+	EndTime    time.Time       // 生效结束时间（不包含），为零值时表示不限
+	Schedule   string          // 每周的生效时间段，为空时表示不限。格式见 Schedule
 	CreateTime types.LocalTime // 创建时间
 	UpdateTime types.LocalTime // 修改时间
 }
 
+// Active 判断解析记录在 now 时是否生效
+func (d Domain) Active(now time.Time) bool {
+	return ruleActive(d.Enable, d.StartTime, d.EndTime, d.Schedule, now)
+}
+
 func (d Domain) ClientHostVal() string {
 	return d.ClientHost
 }
@@ -49,31 +91,194 @@ func (d Domain) DenyGlobalVal() bool {
 	return d.DenyGlobal
 }
 
+const (
+	ForwardModeSmart = "smart" // 智能转发模式
+	ForwardModeNext  = "next"  // 不转发，交给下一个插件解析，并将应答中的IP记录到该规则的解析历史
+
+	ListPrefix = "@" // 转发规则的域名以该前缀开头时表示引用外部域名列表，如 "@gfwlist"
+)
+
 // Forward 转发配置.
 type Forward struct {
-	ID         int64
-	ClientHost string          // 客户端地址（生效范围）。<br />如果全局生效，则该字段为空。
-	Name       string          // 需要转发解析的域名
-	DnsSvr     []string        // 转发目标DNS服务器
-	DenyGlobal bool            // 是否拒绝全局解析
-	Enable     bool            // 是否启用
-	CreateTime types.LocalTime // 创建时间
-	UpdateTime types.LocalTime // 修改时间
+	ID          int64
+	ClientHost  string          // 客户端地址（生效范围）。<br />如果全局生效，则该字段为空。
+	Name        string          // 需要转发解析的域名
+	DnsSvr      []string        // 转发目标DNS服务器
+	FallbackSvr []string        // 回退DNS服务器，当转发目标DNS服务器返回的应答被判定为污染时使用该服务器重新解析
+	Mode        string          // 转发模式。<br />为空表示普通模式；smart 表示同时询问所有转发目标DNS服务器，优先使用IP属于 IpSet 的应答；next 表示不转发，交给下一个插件解析并记录解析历史
+	IpSet       string          // 智能模式下期望的IP集合名称，对应 Corefile 中定义的 ipset
+	Policy      string          // 响应策略名称，对应 Corefile 中定义的 response_policy，为空时原样返回上游的应答
+	DenyGlobal  bool            // 是否拒绝全局解析
+	Enable      bool            // 是否启用
+	StartTime   time.Time       // 生效开始时间，为零值时表示不限
+	EndTime     time.Time       // 生效结束时间（不包含），为零值时表示不限
+	Schedule    string          // 每周的生效时间段，为空时表示不限。格式见 Schedule
+	CreateTime  types.LocalTime // 创建时间
+	UpdateTime  types.LocalTime // 修改时间
+
+	// MatchName 为域名列表规则（Name 以 '@' 开头）实际匹配到的域名，如 "*.example.com"，用于与普通规则比较优先级，不需要存储
+	MatchName string
+}
+
+// Active 判断转发规则在 now 时是否生效
+func (f Forward) Active(now time.Time) bool {
+	return ruleActive(f.Enable, f.StartTime, f.EndTime, f.Schedule, now)
 }
 
 func (f Forward) ClientHostVal() string {
 	return f.ClientHost
 }
 func (f Forward) NameVal() string {
+	if f.MatchName != "" {
+		return f.MatchName
+	}
 	return f.Name
 }
 func (f Forward) DenyGlobalVal() bool {
 	return f.DenyGlobal
 }
 
+// RuleChanges 表示一批解析记录、转发配置以及解析历史排除网段的变更，修改和删除时根据 ID 确定对应的记录.
+// 新增时 ID 为 0 则自动分配，否则使用指定的 ID（用于恢复已删除的规则）
+type RuleChanges struct {
+	CreateDomains     []Domain
+	UpdateDomains     []Domain
+	DeleteDomains     []Domain
+	CreateForwards    []Forward
+	UpdateForwards    []Forward
+	DeleteForwards    []Forward
+	CreateHistoryExes []HistoryEx
+	UpdateHistoryExes []HistoryEx
+	DeleteHistoryExes []HistoryEx
+
+	Actor    string // 操作者，记录到审计记录中
+	ClientIp string // 操作者的IP，记录到审计记录中
+}
+
+// Empty 判断是否没有任何变更
+func (c RuleChanges) Empty() bool {
+	return len(c.CreateDomains)+len(c.UpdateDomains)+len(c.DeleteDomains)+
+		len(c.CreateForwards)+len(c.UpdateForwards)+len(c.DeleteForwards)+
+		len(c.CreateHistoryExes)+len(c.UpdateHistoryExes)+len(c.DeleteHistoryExes) == 0
+}
+
+const (
+	HistoryScopeMine = "mine" // 只包含客户端实际生效的转发规则产生的解析历史
+	HistoryScopeAll  = "all"  // 包含客户端转发的域名对应的所有解析历史，不区分转发规则和客户端
+)
+
 // History 转发解析历史.
 type History struct {
-	ID      int64
-	Name    string   // 需要转发解析的域名
-	History []string // 解析记录，用于导出使用
+	ID         int64
+	Name       string      // 需要转发解析的域名
+	ForwardId  int64       // 产生该历史的转发规则ID，为 0 时表示未知（如升级前的历史）
+	ClientHost string      // 产生该历史的客户端地址，为空时表示未知
+	History    []HistoryIp // 解析记录，用于导出使用
+}
+
+// HistoryEx 需要从解析历史中排除的网段.
+type HistoryEx struct {
+	ID         int64
+	ClientHost string // 客户端地址（生效范围）。<br />如果全局生效，则该字段为空。
+	IpNet      string // 需要排除的网段
+	DenyGlobal bool   // 是否拒绝全局的同一网段
+	Label      string // 标签/分组
+	Enable     bool   // 是否启用
+}
+
+// HistoryForwards 从客户端可见的已启用的转发规则（全局和私有）中找出解析历史所属的规则。
+// 否定用途的私有规则以及被其否定的同名全局规则将被去除；scope 为 HistoryScopeMine 时，存在同名私有规则的全局规则也将被去除
+func HistoryForwards(forwards []Forward, scope string) []Forward {
+	denied := make(map[string]struct{}, 0)
+	private := make(map[string]struct{}, 0)
+	for _, row := range forwards {
+		if row.ClientHost == "" {
+			continue
+		}
+		if row.DenyGlobal {
+			denied[row.Name] = struct{}{}
+		} else {
+			private[row.Name] = struct{}{}
+		}
+	}
+	dst := make([]Forward, 0, len(forwards))
+	for _, row := range forwards {
+		if row.ClientHost == "" {
+			if _, ok := denied[row.Name]; ok {
+				continue
+			}
+			if _, ok := private[row.Name]; ok && scope != HistoryScopeAll {
+				continue
+			}
+		} else if row.DenyGlobal {
+			continue
+		}
+		dst = append(dst, row)
+	}
+	return dst
+}
+
+// HistoryExNets 从客户端可见的排除网段（全局和私有）中找出实际生效的网段，未启用的记录、否定用途的记录以及被其否定的全局记录将被去除
+func HistoryExNets(exes []HistoryEx) []string {
+	enabled := make([]HistoryEx, 0, len(exes))
+	for _, ex := range exes {
+		if ex.Enable {
+			enabled = append(enabled, ex)
+		}
+	}
+	exes = enabled
+
+	denied := make(map[string]struct{}, 0)
+	for _, ex := range exes {
+		if ex.ClientHost != "" && ex.DenyGlobal {
+			denied[ex.IpNet] = struct{}{}
+		}
+	}
+	dst := make([]string, 0, len(exes))
+	for _, ex := range exes {
+		if ex.ClientHost == "" {
+			if _, ok := denied[ex.IpNet]; ok {
+				continue
+			}
+		}
+		if ex.DenyGlobal {
+			continue
+		}
+		dst = append(dst, ex.IpNet)
+	}
+	return dst
+}
+
+// HistoryIp 解析历史中的单个IP（或网段）及其使用情况
+type HistoryIp struct {
+	IpNet     string    // IP或网段
+	FirstSeen time.Time // 第一次解析得到该IP的时间
+	LastSeen  time.Time // 最后一次解析得到该IP的时间
+	Count     int64     // 解析得到该IP的次数
+}
+
+// MergeHistoryIp 合并两组解析历史，相同IP的第一次解析时间取较小值，最后解析时间取较大值，次数累加。结果按IP排序
+func MergeHistoryIp(a, b []HistoryIp) []HistoryIp {
+	m := make(map[string]HistoryIp, len(a)+len(b))
+	for _, it := range append(append([]HistoryIp{}, a...), b...) {
+		old, ok := m[it.IpNet]
+		if ok {
+			if !old.FirstSeen.IsZero() && (it.FirstSeen.IsZero() || old.FirstSeen.Before(it.FirstSeen)) {
+				it.FirstSeen = old.FirstSeen
+			}
+			if old.LastSeen.After(it.LastSeen) {
+				it.LastSeen = old.LastSeen
+			}
+			it.Count += old.Count
+		}
+		m[it.IpNet] = it
+	}
+	dst := make([]HistoryIp, 0, len(m))
+	for _, it := range m {
+		dst = append(dst, it)
+	}
+	sort.Slice(dst, func(i, j int) bool {
+		return dst[i].IpNet < dst[j].IpNet
+	})
+	return dst
 }
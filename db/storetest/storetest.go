@@ -0,0 +1,712 @@
+// Package storetest 提供 db.Store 实现的通用测试，所有存储实现都应该通过这些测试，以保证生效范围、拒绝全局、泛解析等语义一致.
+//
+// 用法:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) storetest.Store {
+//			return NewStore(...)
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/laeni/pri-dns/db"
+)
+
+// Store 为测试所需的存储，除了 db.Store 外还需要能够添加需要从解析历史中排除的网段
+type Store interface {
+	db.Store
+	SaveHistoryEx(ex db.HistoryEx) error
+}
+
+// Run 执行所有测试，newStore 用于为每个测试创建一个新的空存储
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s Store)
+	}{
+		{"DomainMatch", testDomainMatch},
+		{"ForwardMatch", testForwardMatch},
+		{"PrivateAndGlobal", testPrivateAndGlobal},
+		{"Disabled", testDisabled},
+		{"SaveRules", testSaveRules},
+		{"DeleteMissing", testDeleteMissing},
+		{"FindAllRules", testFindAllRules},
+		{"HistoryMerge", testHistoryMerge},
+		{"HistoryScope", testHistoryScope},
+		{"HistoryDenyGlobal", testHistoryDenyGlobal},
+		{"HistoryEx", testHistoryEx},
+		{"PruneHistory", testPruneHistory},
+		{"Watch", testWatch},
+		{"Audit", testAudit},
+		{"Revert", testRevert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.f(t, newStore(t))
+		})
+	}
+}
+
+// 精确匹配、泛解析以及根泛解析 "*"
+func testDomainMatch(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{CreateDomains: []db.Domain{
+		domain("", "a.example.com", "1.1.1.1"),
+		domain("", "*.example.com", "1.1.1.2"),
+		domain("", "*.a.example.com", "1.1.1.3"),
+		domain("", "*", "1.1.1.4"),
+		domain("", "example.org", "1.1.1.5"),
+	}})
+
+	tests := []struct {
+		qname string
+		want  []string
+	}{
+		{"a.example.com", []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.1.4"}},
+		{"b.a.example.com", []string{"1.1.1.2", "1.1.1.3", "1.1.1.4"}},
+		{"example.com", []string{"1.1.1.2", "1.1.1.4"}},
+		{"example.org", []string{"1.1.1.4", "1.1.1.5"}},
+		{"www.example.org", []string{"1.1.1.4"}},
+	}
+	for _, tt := range tests {
+		if got := domainValues(findDomains(t, s, "", tt.qname)); !equal(got, tt.want) {
+			t.Errorf("FindDomainByHostAndName(%q) = %v, want %v", tt.qname, got, tt.want)
+		}
+	}
+}
+
+func testForwardMatch(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{
+		forward("", "*.example.com", "1.1.1.1"),
+		forward("", "www.example.com", "1.1.1.2"),
+		forward("", "@gfwlist", "1.1.1.3"),
+	}})
+
+	if got := forwardSvrs(findForwards(t, s, "", "www.example.com")); !equal(got, []string{"1.1.1.1", "1.1.1.2"}) {
+		t.Errorf("FindForwardByHostAndName() = %v", got)
+	}
+	if got := forwardSvrs(findForwards(t, s, "", "example.com")); !equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("FindForwardByHostAndName() = %v", got)
+	}
+	if got := forwardSvrs(findForwards(t, s, "", "example.org")); len(got) != 0 {
+		t.Errorf("FindForwardByHostAndName() = %v, want empty", got)
+	}
+	// 名称精确匹配，不展开通配符
+	if got := forwardSvrs(findForwardsByNames(t, s, "", []string{"@gfwlist", "*.example.org"})); !equal(got, []string{"1.1.1.3"}) {
+		t.Errorf("FindForwardByHostAndNames() = %v", got)
+	}
+}
+
+// 私有数据只对对应客户端可见，全局数据对所有客户端可见；按生效范围查询时只返回该范围的数据
+func testPrivateAndGlobal(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{
+		CreateDomains: []db.Domain{
+			domain("", "a.example.com", "1.1.1.1"),
+			domain("192.168.1.2", "a.example.com", "1.1.1.2"),
+			domain("192.168.1.3", "a.example.com", "1.1.1.3"),
+		},
+		CreateForwards: []db.Forward{
+			forward("", "*.example.com", "1.1.1.1"),
+			forward("192.168.1.2", "*.example.com", "1.1.1.2"),
+		},
+	})
+
+	if got := domainValues(findDomains(t, s, "", "a.example.com")); !equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("FindDomainByHostAndName(global) = %v", got)
+	}
+	if got := domainValues(findDomains(t, s, "192.168.1.2", "a.example.com")); !equal(got, []string{"1.1.1.1", "1.1.1.2"}) {
+		t.Errorf("FindDomainByHostAndName(192.168.1.2) = %v", got)
+	}
+	if got := forwardSvrs(findForwards(t, s, "192.168.1.3", "a.example.com")); !equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("FindForwardByHostAndName(192.168.1.3) = %v", got)
+	}
+
+	domains, err := s.FindDomainByHost("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domainValues(domains); !equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("FindDomainByHost(global) = %v", got)
+	}
+	domains, err = s.FindDomainByHost("192.168.1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domainValues(domains); !equal(got, []string{"1.1.1.3"}) {
+		t.Errorf("FindDomainByHost(192.168.1.3) = %v", got)
+	}
+	forwards, err := s.FindForwardByHost("192.168.1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := forwardSvrs(forwards); !equal(got, []string{"1.1.1.2"}) {
+		t.Errorf("FindForwardByHost(192.168.1.2) = %v", got)
+	}
+}
+
+// 查询时返回禁用的数据（由调用者根据 Enable 过滤），但解析历史不包含禁用的转发规则
+func testDisabled(t *testing.T, s Store) {
+	d := domain("", "a.example.com", "1.1.1.1")
+	d.Enable = false
+	f := forward("", "*.example.com", "1.1.1.1")
+	f.Enable = false
+	mustSaveRules(t, s, db.RuleChanges{CreateDomains: []db.Domain{d}, CreateForwards: []db.Forward{f}})
+
+	domains := findDomains(t, s, "", "a.example.com")
+	if len(domains) != 1 || domains[0].Enable {
+		t.Errorf("FindDomainByHostAndName() = %+v, want 1 disabled", domains)
+	}
+	forwards := findForwards(t, s, "", "a.example.com")
+	if len(forwards) != 1 || forwards[0].Enable {
+		t.Fatalf("FindForwardByHostAndName() = %+v, want 1 disabled", forwards)
+	}
+
+	saveHistory(t, s, forwards[0], "10.0.0.1")
+	for _, scope := range []string{db.HistoryScopeMine, db.HistoryScopeAll} {
+		if his, _ := findHistory(t, s, "", scope); len(his) != 0 {
+			t.Errorf("FindHistoryByHost(%s) = %v, want empty", scope, his)
+		}
+	}
+}
+
+// 保存的字段可以原样读取，修改和删除只影响指定的数据
+func testSaveRules(t *testing.T, s Store) {
+	start := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 12, 31, 20, 0, 0, 0, time.UTC)
+	f := db.Forward{
+		ClientHost:  "192.168.1.2",
+		Name:        "*.example.com",
+		DnsSvr:      []string{"1.1.1.1", "tls://8.8.8.8"},
+		FallbackSvr: []string{"9.9.9.9"},
+		Mode:        db.ForwardModeSmart,
+		IpSet:       "china",
+		Policy:      "ipv4",
+		DenyGlobal:  true,
+		Enable:      true,
+		StartTime:   start,
+		EndTime:     end,
+		Schedule:    "Mon-Fri 09:00-18:00",
+	}
+	d := db.Domain{ClientHost: "192.168.1.2", Name: "a.example.com", Value: "2001:db8::1", Ttl: 300, DnsType: "AAAA", DenyGlobal: true, Enable: true,
+		StartTime: start, Schedule: "Sat,Sun 22:00-06:00"}
+	mustSaveRules(t, s, db.RuleChanges{
+		CreateDomains:  []db.Domain{d, domain("192.168.1.2", "b.example.com", "1.1.1.2")},
+		CreateForwards: []db.Forward{f, forward("192.168.1.2", "*.example.org", "1.1.1.2")},
+	})
+
+	domains, err := s.FindDomainByHost("192.168.1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 2 {
+		t.Fatalf("FindDomainByHost() = %+v", domains)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	got := domains[0]
+	if got.ID == 0 || got.ClientHost != d.ClientHost || got.Name != d.Name || got.Value != d.Value || got.Ttl != d.Ttl ||
+		got.DnsType != d.DnsType || got.DenyGlobal != d.DenyGlobal || got.Enable != d.Enable ||
+		!got.StartTime.Equal(d.StartTime) || !got.EndTime.IsZero() || got.Schedule != d.Schedule {
+		t.Errorf("domain = %+v, want %+v", got, d)
+	}
+
+	forwards, err := s.FindForwardByHost("192.168.1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(forwards) != 2 {
+		t.Fatalf("FindForwardByHost() = %+v", forwards)
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Name < forwards[j].Name })
+	gotF := forwards[0]
+	if gotF.ID == 0 || gotF.ClientHost != f.ClientHost || gotF.Name != f.Name || !equal(gotF.DnsSvr, f.DnsSvr) ||
+		!equal(gotF.FallbackSvr, f.FallbackSvr) || gotF.Mode != f.Mode || gotF.IpSet != f.IpSet || gotF.Policy != f.Policy || gotF.DenyGlobal != f.DenyGlobal || gotF.Enable != f.Enable ||
+		!gotF.StartTime.Equal(f.StartTime) || !gotF.EndTime.Equal(f.EndTime) || gotF.Schedule != f.Schedule {
+		t.Errorf("forward = %+v, want %+v", gotF, f)
+	}
+
+	// 修改第一条，删除第二条
+	got.Value = "2001:db8::2"
+	gotF.DnsSvr = []string{"1.0.0.1"}
+	mustSaveRules(t, s, db.RuleChanges{
+		UpdateDomains:  []db.Domain{got},
+		DeleteDomains:  []db.Domain{domains[1]},
+		UpdateForwards: []db.Forward{gotF},
+		DeleteForwards: []db.Forward{forwards[1]},
+	})
+	domains, _ = s.FindDomainByHost("192.168.1.2")
+	if got := domainValues(domains); !equal(got, []string{"2001:db8::2"}) {
+		t.Errorf("FindDomainByHost() after update = %v", got)
+	}
+	forwards, _ = s.FindForwardByHost("192.168.1.2")
+	if got := forwardSvrs(forwards); !equal(got, []string{"1.0.0.1"}) {
+		t.Errorf("FindForwardByHost() after update = %v", got)
+	}
+}
+
+// 删除不存在的记录时忽略该记录，同一批中的其他变更仍然保存
+func testDeleteMissing(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{
+		DeleteDomains:     []db.Domain{{ID: 999}},
+		DeleteForwards:    []db.Forward{{ID: 998}},
+		DeleteHistoryExes: []db.HistoryEx{{ID: 997}},
+		CreateDomains:     []db.Domain{domain("", "a.example.com", "1.1.1.1")},
+		CreateForwards:    []db.Forward{forward("", "a.com", "8.8.8.8")},
+		CreateHistoryExes: []db.HistoryEx{{IpNet: "10.0.0.0/8", Enable: true}},
+	})
+
+	domains, forwards, err := s.FindAllRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domainValues(domains); !equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("domains = %v", got)
+	}
+	if got := forwardSvrs(forwards); !equal(got, []string{"8.8.8.8"}) {
+		t.Errorf("forwards = %v", got)
+	}
+	if _, exes := findHistory(t, s, "", db.HistoryScopeMine); !equal(exes, []string{"10.0.0.0/8"}) {
+		t.Errorf("history exes = %v", exes)
+	}
+}
+
+// 查询所有规则时包含所有生效范围以及未启用的规则
+func testFindAllRules(t *testing.T, s Store) {
+	disabled := domain("192.168.1.3", "b.example.com", "1.1.1.3")
+	disabled.Enable = false
+	mustSaveRules(t, s, db.RuleChanges{
+		CreateDomains:  []db.Domain{domain("", "a.example.com", "1.1.1.1"), domain("192.168.1.2", "a.example.com", "1.1.1.2"), disabled},
+		CreateForwards: []db.Forward{forward("", "example.org", "8.8.8.8"), forward("192.168.1.2", "*.example.org", "1.0.0.1")},
+	})
+
+	domains, forwards, err := s.FindAllRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domainValues(domains); !equal(got, []string{"1.1.1.1", "1.1.1.2", "1.1.1.3"}) {
+		t.Errorf("FindAllRules() domains = %v", got)
+	}
+	if got := forwardSvrs(forwards); !equal(got, []string{"1.0.0.1", "8.8.8.8"}) {
+		t.Errorf("FindAllRules() forwards = %v", got)
+	}
+	for _, it := range domains {
+		if it.ID == 0 {
+			t.Errorf("domain %+v has no ID", it)
+		}
+	}
+}
+
+// 同一转发规则、客户端和IP的解析历史合并为一条，第一次解析时间取较早的，最后解析时间取较晚的，次数累加
+func testHistoryMerge(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{forward("", "*.example.com", "1.1.1.1")}})
+	f := findForwards(t, s, "", "example.com")[0]
+
+	t1 := time.Unix(1700000000, 0)
+	t2 := t1.Add(time.Hour)
+	his := db.History{Name: f.Name, ForwardId: f.ID, ClientHost: "192.168.1.2"}
+	his.History = []db.HistoryIp{{IpNet: "10.0.0.1", FirstSeen: t2, LastSeen: t2, Count: 2}}
+	mustSaveHistory(t, s, his)
+	his.History = []db.HistoryIp{{IpNet: "10.0.0.1", FirstSeen: t1, LastSeen: t1, Count: 1}, {IpNet: "10.0.0.2", LastSeen: t1, Count: 1}}
+	mustSaveHistory(t, s, his)
+	// 其他客户端产生的相同IP
+	his.ClientHost = "192.168.1.3"
+	his.History = []db.HistoryIp{{IpNet: "10.0.0.1", FirstSeen: t1, LastSeen: t1, Count: 1}}
+	mustSaveHistory(t, s, his)
+
+	got, _ := findHistory(t, s, "192.168.1.2", db.HistoryScopeMine)
+	want := []db.HistoryIp{
+		{IpNet: "10.0.0.1", FirstSeen: t1, LastSeen: t2, Count: 4},
+		{IpNet: "10.0.0.2", FirstSeen: t1, LastSeen: t1, Count: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("FindHistoryByHost() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].IpNet != want[i].IpNet || !got[i].FirstSeen.Equal(want[i].FirstSeen) || !got[i].LastSeen.Equal(want[i].LastSeen) || got[i].Count != want[i].Count {
+			t.Errorf("FindHistoryByHost()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// mine 只包含客户端实际生效的规则产生的历史，all 包含同名规则的所有历史
+func testHistoryScope(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{
+		forward("", "*.example.com", "1.1.1.1"),
+		forward("192.168.1.2", "*.example.com", "1.1.1.2"),
+		forward("", "*.example.org", "1.1.1.1"),
+	}})
+	for _, f := range findForwardsByNames(t, s, "192.168.1.2", []string{"*.example.com", "*.example.org"}) {
+		ip := "10.0.0.1"
+		if f.ClientHost != "" {
+			ip = "10.0.0.2"
+		} else if f.Name == "*.example.org" {
+			ip = "10.0.0.3"
+		}
+		saveHistory(t, s, f, ip)
+	}
+
+	tests := []struct {
+		host, scope string
+		want        []string
+	}{
+		{"192.168.1.2", db.HistoryScopeMine, []string{"10.0.0.2", "10.0.0.3"}},
+		{"192.168.1.2", db.HistoryScopeAll, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"192.168.1.3", db.HistoryScopeMine, []string{"10.0.0.1", "10.0.0.3"}},
+		{"192.168.1.3", db.HistoryScopeAll, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		his, _ := findHistory(t, s, tt.host, tt.scope)
+		if got := historyIps(his); !equal(got, tt.want) {
+			t.Errorf("FindHistoryByHost(%s, %s) = %v, want %v", tt.host, tt.scope, got, tt.want)
+		}
+	}
+}
+
+// 私有的拒绝全局规则使同名的全局规则对该客户端失效，且其本身不产生历史
+func testHistoryDenyGlobal(t *testing.T, s Store) {
+	deny := forward("192.168.1.2", "*.example.com", "")
+	deny.DnsSvr, deny.DenyGlobal = nil, true
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{forward("", "*.example.com", "1.1.1.1"), deny}})
+	for _, f := range findForwards(t, s, "192.168.1.2", "example.com") {
+		if f.ClientHost == "" {
+			saveHistory(t, s, f, "10.0.0.1")
+		}
+	}
+
+	for _, scope := range []string{db.HistoryScopeMine, db.HistoryScopeAll} {
+		if his, _ := findHistory(t, s, "192.168.1.2", scope); len(his) != 0 {
+			t.Errorf("FindHistoryByHost(192.168.1.2, %s) = %v, want empty", scope, his)
+		}
+	}
+	if his, _ := findHistory(t, s, "192.168.1.3", db.HistoryScopeMine); !equal(historyIps(his), []string{"10.0.0.1"}) {
+		t.Errorf("FindHistoryByHost(192.168.1.3) = %v", his)
+	}
+}
+
+// 全局排除网段对所有客户端生效，私有的拒绝全局记录使同一网段对该客户端失效，已禁用的记录不生效
+func testHistoryEx(t *testing.T, s Store) {
+	for _, ex := range []db.HistoryEx{
+		{IpNet: "10.0.0.0/8", Enable: true},
+		{IpNet: "172.16.0.0/12", Enable: true},
+		{IpNet: "198.18.0.0/15"},
+		{ClientHost: "192.168.1.2", IpNet: "10.0.0.0/8", DenyGlobal: true, Enable: true},
+		{ClientHost: "192.168.1.2", IpNet: "192.168.0.0/16", Enable: true},
+		{ClientHost: "192.168.1.3", IpNet: "100.64.0.0/10", Enable: true},
+		{ClientHost: "192.168.1.3", IpNet: "172.16.0.0/12", DenyGlobal: true},
+	} {
+		if err := s.SaveHistoryEx(ex); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{"", []string{"10.0.0.0/8", "172.16.0.0/12"}},
+		{"192.168.1.2", []string{"172.16.0.0/12", "192.168.0.0/16"}},
+		{"192.168.1.3", []string{"10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12"}},
+	}
+	for _, tt := range tests {
+		_, exes := findHistory(t, s, tt.host, db.HistoryScopeMine)
+		sort.Strings(exes)
+		if !equal(exes, tt.want) {
+			t.Errorf("FindHistoryByHost(%q) exclude = %v, want %v", tt.host, exes, tt.want)
+		}
+	}
+}
+
+func testPruneHistory(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{forward("", "*.example.com", "1.1.1.1")}})
+	f := findForwards(t, s, "", "example.com")[0]
+
+	t1 := time.Unix(1700000000, 0)
+	his := db.History{Name: f.Name, ForwardId: f.ID}
+	his.History = []db.HistoryIp{{IpNet: "10.0.0.1", LastSeen: t1, Count: 1}, {IpNet: "10.0.0.2", LastSeen: t1.Add(time.Hour), Count: 1}}
+	mustSaveHistory(t, s, his)
+
+	removed, err := s.PruneHistory(t1.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("PruneHistory() = %d, want 1", removed)
+	}
+	if his, _ := findHistory(t, s, "", db.HistoryScopeMine); !equal(historyIps(his), []string{"10.0.0.2"}) {
+		t.Errorf("FindHistoryByHost() after prune = %v", his)
+	}
+}
+
+// 支持变更通知的存储在新增、修改、删除规则后都应该通知，取消订阅后通道关闭
+func testWatch(t *testing.T, s Store) {
+	feed, ok := s.(db.ChangeFeed)
+	if !ok {
+		t.Skip("store does not implement db.ChangeFeed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := feed.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := func(op string) {
+		t.Helper()
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				t.Fatalf("channel closed after %s", op)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change notification after %s", op)
+		}
+	}
+
+	mustSaveRules(t, s, db.RuleChanges{CreateDomains: []db.Domain{domain("", "example.com", "1.1.1.1")}})
+	wait("create")
+	domains := findDomains(t, s, "", "example.com")
+	domains[0].Value = "1.1.1.2"
+	mustSaveRules(t, s, db.RuleChanges{UpdateDomains: domains})
+	wait("update")
+	mustSaveRules(t, s, db.RuleChanges{DeleteDomains: domains})
+	wait("delete")
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		for ok {
+			_, ok = <-ch
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+// 每条规则的每次变更记录一条审计记录，包含操作者以及变更前后的规则
+func testAudit(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{
+		CreateDomains: []db.Domain{domain("192.168.1.2", "a.example.com", "1.1.1.1")},
+		Actor:         "alice",
+		ClientIp:      "192.168.1.2",
+	})
+	d := findDomains(t, s, "192.168.1.2", "a.example.com")[0]
+	d.Value = "1.1.1.2"
+	mustSaveRules(t, s, db.RuleChanges{UpdateDomains: []db.Domain{d}, Actor: "admin", ClientIp: "127.0.0.1"})
+	mustSaveRules(t, s, db.RuleChanges{DeleteDomains: []db.Domain{d}, Actor: "admin", ClientIp: "127.0.0.1"})
+	if err := s.SaveHistoryEx(db.HistoryEx{IpNet: "10.0.0.0/8", Enable: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := findAudit(t, s, db.AuditFilter{RuleType: db.RuleTypeDomain, RuleId: d.ID})
+	if len(logs) != 3 {
+		t.Fatalf("FindAudit() = %+v, want 3 logs", logs)
+	}
+	want := []struct {
+		action, actor string
+		before, after bool
+	}{
+		{db.AuditDelete, "admin", true, false},
+		{db.AuditUpdate, "admin", true, true},
+		{db.AuditCreate, "alice", false, true},
+	}
+	for i, it := range want {
+		got := logs[i]
+		if got.Action != it.action || got.Actor != it.actor || (got.Before != "") != it.before || (got.After != "") != it.after ||
+			got.ClientHost != "192.168.1.2" || got.ID == 0 {
+			t.Errorf("logs[%d] = %+v, want %s by %s", i, got, it.action, it.actor)
+		}
+	}
+	var before db.Domain
+	if err := json.Unmarshal([]byte(logs[1].Before), &before); err != nil || before.Value != "1.1.1.1" {
+		t.Errorf("update before = %s, %v", logs[1].Before, err)
+	}
+
+	alice := "192.168.1.2"
+	tests := []struct {
+		name   string
+		filter db.AuditFilter
+		want   int
+	}{
+		{"all", db.AuditFilter{}, 4},
+		{"limit", db.AuditFilter{Limit: 2}, 2},
+		{"type", db.AuditFilter{RuleType: db.RuleTypeHistoryEx}, 1},
+		{"actor", db.AuditFilter{Actor: "alice"}, 1},
+		{"clientIp", db.AuditFilter{ClientIp: "127.0.0.1"}, 2},
+		{"clientHost", db.AuditFilter{ClientHost: &alice}, 3},
+		{"id", db.AuditFilter{ID: logs[1].ID}, 1},
+		{"since", db.AuditFilter{Since: time.Now().Add(time.Hour)}, 0},
+		{"until", db.AuditFilter{Until: time.Now().Add(time.Hour)}, 4},
+	}
+	for _, tt := range tests {
+		if got := findAudit(t, s, tt.filter); len(got) != tt.want {
+			t.Errorf("FindAudit(%s) = %d logs, want %d", tt.name, len(got), tt.want)
+		}
+	}
+}
+
+// 恢复到某个版本后规则与该版本一致，已删除的规则使用原来的ID重新创建
+func testRevert(t *testing.T, s Store) {
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{forward("", "*.example.com", "1.1.1.1")}})
+	f := findForwards(t, s, "", "example.com")[0]
+	f.DnsSvr = []string{"8.8.8.8"}
+	mustSaveRules(t, s, db.RuleChanges{UpdateForwards: []db.Forward{f}})
+	mustSaveRules(t, s, db.RuleChanges{DeleteForwards: []db.Forward{f}})
+	logs := findAudit(t, s, db.AuditFilter{RuleType: db.RuleTypeForward, RuleId: f.ID})
+	if len(logs) != 3 {
+		t.Fatalf("FindAudit() = %+v, want 3 logs", logs)
+	}
+
+	revert := func(log db.AuditLog) {
+		t.Helper()
+		changes, err := db.RevertChanges(s, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustSaveRules(t, s, changes)
+	}
+	// 恢复到第一个版本，规则已删除所以重新创建
+	revert(logs[2])
+	forwards := findForwards(t, s, "", "example.com")
+	if len(forwards) != 1 || forwards[0].ID != f.ID || !equal(forwards[0].DnsSvr, []string{"1.1.1.1"}) {
+		t.Fatalf("after revert to create = %+v", forwards)
+	}
+	// 恢复到修改后的版本
+	revert(logs[1])
+	if got := forwardSvrs(findForwards(t, s, "", "example.com")); !equal(got, []string{"8.8.8.8"}) {
+		t.Errorf("after revert to update = %v", got)
+	}
+	// 恢复到删除的版本
+	revert(logs[0])
+	if got := findForwards(t, s, "", "example.com"); len(got) != 0 {
+		t.Errorf("after revert to delete = %+v", got)
+	}
+	if got := findAudit(t, s, db.AuditFilter{RuleType: db.RuleTypeForward, RuleId: f.ID}); len(got) != 6 {
+		t.Errorf("FindAudit() after revert = %d logs, want 6", len(got))
+	}
+
+	// 新增的规则不会与恢复的规则ID冲突
+	mustSaveRules(t, s, db.RuleChanges{CreateForwards: []db.Forward{forward("", "*.example.org", "1.0.0.1")}})
+	revert(logs[2])
+	if got := forwardSvrs(findForwards(t, s, "", "example.com")); !equal(got, []string{"1.1.1.1"}) {
+		t.Errorf("after second revert = %v", got)
+	}
+}
+
+func domain(host, name, value string) db.Domain {
+	return db.Domain{ClientHost: host, Name: name, Value: value, Ttl: 60, DnsType: "A", Enable: true}
+}
+
+func forward(host, name, svr string) db.Forward {
+	return db.Forward{ClientHost: host, Name: name, DnsSvr: []string{svr}, Enable: true}
+}
+
+func findDomains(t *testing.T, s Store, host, qname string) []db.Domain {
+	t.Helper()
+	domains, err := s.FindDomainByHostAndName(host, qname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return domains
+}
+
+func findForwards(t *testing.T, s Store, host, name string) []db.Forward {
+	t.Helper()
+	forwards, err := s.FindForwardByHostAndName(host, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwards
+}
+
+func findForwardsByNames(t *testing.T, s Store, host string, names []string) []db.Forward {
+	t.Helper()
+	forwards, err := s.FindForwardByHostAndNames(host, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forwards
+}
+
+func findHistory(t *testing.T, s Store, host, scope string) ([]db.HistoryIp, []string) {
+	t.Helper()
+	his, exes, err := s.FindHistoryByHost(host, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return his, exes
+}
+
+func findAudit(t *testing.T, s Store, filter db.AuditFilter) []db.AuditLog {
+	t.Helper()
+	logs, err := s.FindAudit(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return logs
+}
+
+func mustSaveRules(t *testing.T, s Store, changes db.RuleChanges) {
+	t.Helper()
+	if err := s.SaveRules(changes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSaveHistory(t *testing.T, s Store, his db.History) {
+	t.Helper()
+	if err := s.SavaHistory(his); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saveHistory 保存转发规则 f 产生的一个IP
+func saveHistory(t *testing.T, s Store, f db.Forward, ip string) {
+	t.Helper()
+	now := time.Now().Truncate(time.Second)
+	mustSaveHistory(t, s, db.History{Name: f.Name, ForwardId: f.ID, ClientHost: f.ClientHost, History: []db.HistoryIp{{IpNet: ip, LastSeen: now, Count: 1}}})
+}
+
+// 以下函数返回排序后的结果，以便与期望值比较
+
+func domainValues(domains []db.Domain) []string {
+	dst := make([]string, len(domains))
+	for i, it := range domains {
+		dst[i] = it.Value
+	}
+	sort.Strings(dst)
+	return dst
+}
+
+func forwardSvrs(forwards []db.Forward) []string {
+	var dst []string
+	for _, it := range forwards {
+		dst = append(dst, it.DnsSvr...)
+	}
+	sort.Strings(dst)
+	return dst
+}
+
+func historyIps(his []db.HistoryIp) []string {
+	dst := make([]string, len(his))
+	for i, it := range his {
+		dst[i] = it.IpNet
+	}
+	sort.Strings(dst)
+	return dst
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
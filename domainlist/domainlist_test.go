@@ -0,0 +1,79 @@
+package domainlist
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	gfwList := base64.StdEncoding.EncodeToString([]byte(`[AutoProxy 0.2.9]
+! comment
+||google.com
+|https://www.example.org/path
+.twitter.com
+@@||cn.bing.com
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+keyword
+`))
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   []string
+	}{
+		{
+			name:   "plain",
+			format: FormatPlain,
+			data:   "# comment\nexample.com\n\nFoo.Example.ORG.\n",
+			want:   []string{"example.com", "foo.example.org"},
+		},
+		{
+			name:   "dnsmasq",
+			format: FormatDnsmasq,
+			data:   "# comment\nserver=/baidu.com/114.114.114.114\nserver=/a.cn/b.cn/223.5.5.5\naddress=/x.com/1.2.3.4\n",
+			want:   []string{"baidu.com", "a.cn", "b.cn"},
+		},
+		{
+			name:   "gfwlist",
+			format: FormatGfwList,
+			data:   gfwList[:10] + "\n" + gfwList[10:],
+			want:   []string{"google.com", "www.example.org", "twitter.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.format, []byte(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatcher_Match(t *testing.T) {
+	m := NewMatcher([]string{"example.com", "a.example.com", "org"})
+	tests := []struct {
+		qname  string
+		want   string
+		wantOk bool
+	}{
+		{"example.com", "example.com", true},
+		{"b.example.com.", "example.com", true},
+		{"x.a.example.com", "a.example.com", true},
+		{"example.org", "org", true},
+		{"example.net", "", false},
+		{"badexample.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			got, ok := m.Match(tt.qname)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Match() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
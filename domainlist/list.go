@@ -0,0 +1,106 @@
+// Package domainlist 实现从外部域名列表（如 gfwlist、dnsmasq-china-list）加载域名集合，并定期刷新.
+package domainlist
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+var log = clog.NewWithPlugin("pri-dns")
+
+// 下载远程域名列表的超时时间
+var fetchTimeout = 30 * time.Second
+
+// List 表示一个外部域名列表
+type List struct {
+	Name    string        // 列表名称，转发规则中使用 "@名称" 引用该列表
+	Source  string        // 列表来源，可以是本地文件路径或者 http(s) 地址
+	Format  string        // 列表格式
+	Refresh time.Duration // 刷新间隔，为 0 时表示只在启动时加载一次
+
+	matcher atomic.Pointer[Matcher]
+	stop    chan struct{}
+}
+
+// NewList 创建域名列表，此时不会加载数据
+func NewList(name, source, format string, refresh time.Duration) *List {
+	return &List{Name: name, Source: source, Format: format, Refresh: refresh}
+}
+
+// Load 从来源加载并编译域名列表，加载失败时保留原有数据
+func (l *List) Load() error {
+	data, err := l.read()
+	if err != nil {
+		return err
+	}
+	names, err := Parse(l.Format, data)
+	if err != nil {
+		return err
+	}
+	l.matcher.Store(NewMatcher(names))
+	log.Infof("域名列表 %s 已加载，共 %d 个域名", l.Name, len(names))
+	return nil
+}
+
+func (l *List) read() ([]byte, error) {
+	if !strings.HasPrefix(l.Source, "http://") && !strings.HasPrefix(l.Source, "https://") {
+		return os.ReadFile(l.Source)
+	}
+
+	client := http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(l.Source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("下载域名列表 %s 失败: %s", l.Source, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Match 返回 qname 在列表中匹配到的最长后缀
+func (l *List) Match(qname string) (string, bool) {
+	return l.matcher.Load().Match(qname)
+}
+
+// Start 加载列表并按刷新间隔定期重新加载，加载失败只记录日志，等待下一次刷新
+func (l *List) Start() {
+	if err := l.Load(); err != nil {
+		log.Errorf("域名列表 %s 加载失败: %v", l.Name, err)
+	}
+	if l.Refresh <= 0 {
+		return
+	}
+
+	l.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.Refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.Load(); err != nil {
+					log.Errorf("域名列表 %s 刷新失败: %v", l.Name, err)
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止定期刷新
+func (l *List) Stop() {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
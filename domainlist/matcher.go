@@ -0,0 +1,45 @@
+package domainlist
+
+import "strings"
+
+// Matcher 域名后缀匹配器，列表中的域名匹配其自身以及所有子域名
+type Matcher struct {
+	names map[string]struct{}
+}
+
+// NewMatcher 根据域名列表创建匹配器
+func NewMatcher(names []string) *Matcher {
+	m := &Matcher{names: make(map[string]struct{}, len(names))}
+	for _, name := range names {
+		m.names[normalize(name)] = struct{}{}
+	}
+	return m
+}
+
+// Match 返回 qname 在列表中匹配到的最长后缀，如 "a.b.example.com" 在列表中存在 "example.com" 时返回 "example.com"。
+// 如果没有匹配则 ok 为 false
+func (m *Matcher) Match(qname string) (suffix string, ok bool) {
+	if m == nil {
+		return "", false
+	}
+	name := normalize(qname)
+	for name != "" {
+		if _, ok := m.names[name]; ok {
+			return name, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i == -1 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return "", false
+}
+
+// Len 返回列表中的域名数量
+func (m *Matcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return len(m.names)
+}
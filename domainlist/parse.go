@@ -0,0 +1,112 @@
+package domainlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	FormatPlain   = "plain"   // 每行一个域名，'#' 开头的行为注释
+	FormatDnsmasq = "dnsmasq" // dnsmasq 格式，如 server=/example.com/114.114.114.114，常见于 dnsmasq-china-list
+	FormatGfwList = "gfwlist" // gfwlist 格式，即经过 base64 编码的 AutoProxy 规则
+)
+
+// Parse 根据格式 format 从 data 中解析出域名列表，返回的域名均为小写且不以'.'结尾
+func Parse(format string, data []byte) ([]string, error) {
+	switch format {
+	case "", FormatPlain:
+		return parsePlain(data), nil
+	case FormatDnsmasq:
+		return parseDnsmasq(data), nil
+	case FormatGfwList:
+		return parseGfwList(data)
+	}
+	return nil, fmt.Errorf("不支持的域名列表格式: %s", format)
+}
+
+func parsePlain(data []byte) []string {
+	var names []string
+	eachLine(data, func(line string) {
+		if strings.HasPrefix(line, "#") {
+			return
+		}
+		if name := normalize(line); name != "" {
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+// 解析 dnsmasq 格式，只关注 server=/domain[/domain...]/upstream 这类配置中的域名
+func parseDnsmasq(data []byte) []string {
+	var names []string
+	eachLine(data, func(line string) {
+		if strings.HasPrefix(line, "#") {
+			return
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || (key != "server" && key != "local") || !strings.HasPrefix(value, "/") {
+			return
+		}
+		parts := strings.Split(value, "/")
+		// parts[0] 为空，最后一项为上游地址
+		for _, part := range parts[1 : len(parts)-1] {
+			if name := normalize(part); name != "" {
+				names = append(names, name)
+			}
+		}
+	})
+	return names
+}
+
+// 解析 gfwlist 格式。由于只需要域名，所以例外规则（@@）、正则规则以及无法提取出域名的规则都会被忽略
+func parseGfwList(data []byte) ([]string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(data), nil)))
+	if err != nil {
+		return nil, fmt.Errorf("gfwlist base64 解码失败: %w", err)
+	}
+
+	var names []string
+	eachLine(decoded, func(line string) {
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "/") {
+			return
+		}
+		line = strings.TrimLeft(line, "|.")
+		// 去掉协议头以及路径，只保留主机部分
+		if strings.Contains(line, "://") {
+			u, err := url.Parse(line)
+			if err != nil {
+				return
+			}
+			line = u.Hostname()
+		}
+		if i := strings.IndexAny(line, "/*:^"); i != -1 {
+			line = line[:i]
+		}
+		// 规则中至少需要包含一个'.'才视为域名
+		if !strings.Contains(line, ".") {
+			return
+		}
+		if name := normalize(line); name != "" {
+			names = append(names, name)
+		}
+	})
+	return names, nil
+}
+
+func eachLine(data []byte, f func(line string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			f(line)
+		}
+	}
+}
+
+func normalize(name string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+}
@@ -0,0 +1,81 @@
+package pri_dns
+
+import (
+	"context"
+	"github.com/coredns/coredns/request"
+	"github.com/laeni/pri-dns/db"
+	myForward "github.com/laeni/pri-dns/forward"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+	"net"
+)
+
+const (
+	fallbackPathPrimary  = "primary"  // 转发目标DNS服务器的应答正常，直接使用
+	fallbackPathFallback = "fallback" // 转发目标DNS服务器的应答被污染，改用回退DNS服务器的应答
+)
+
+// exchangeWithFallback 将请求转发给 forward 中的转发目标DNS服务器，如果该转发规则配置了回退DNS服务器且应答被判定为污染，
+// 则透明地使用回退DNS服务器重新解析。返回值中的 path 表示最终采用的路径，未配置回退DNS服务器时为空
+func exchangeWithFallback(d *PriDns, ctx context.Context, state request.Request, forward *db.Forward) (ret *dns.Msg, path string, err error) {
+	proxies, release, err := myForward.GetProxy(d.Config, d, forward.DnsSvr)
+	defer release()
+	if err != nil {
+		return nil, "", err
+	}
+	ret, err = exchange(d, ctx, state, forward, proxies)
+	if err != nil || len(forward.FallbackSvr) == 0 {
+		return ret, "", err
+	}
+
+	if !isPolluted(d.Config, ret) {
+		myForward.FallbackCount.WithLabelValues(fallbackPathPrimary).Add(1)
+		return ret, fallbackPathPrimary, nil
+	}
+
+	log.Debugf("应答被判定为污染，使用回退DNS服务器重新解析: %s => %v", state.Name(), forward.FallbackSvr)
+	myForward.FallbackCount.WithLabelValues(fallbackPathFallback).Add(1)
+	proxies, releaseFallback, err := myForward.GetProxy(d.Config, d, forward.FallbackSvr)
+	defer releaseFallback()
+	if err != nil {
+		return nil, fallbackPathFallback, err
+	}
+	// 回退失败时不能使用被污染的应答，直接将错误返回
+	ret, err = exchange(d, ctx, state, forward, proxies)
+	return ret, fallbackPathFallback, err
+}
+
+// isPolluted 根据 fallback 配置判断应答是否被污染。
+// 应答中只要有一个IP属于 bogus 集合，或者不属于任何 expect 集合，则视为被污染
+func isPolluted(config *types.Config, ret *dns.Msg) bool {
+	for _, rr := range ret.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		for _, name := range config.Fallback.Bogus {
+			if config.IpSets[name].Contains(ip) {
+				return true
+			}
+		}
+		if len(config.Fallback.Expect) != 0 {
+			expected := false
+			for _, name := range config.Fallback.Expect {
+				if config.IpSets[name].Contains(ip) {
+					expected = true
+					break
+				}
+			}
+			if !expected {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package pri_dns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+func Test_isPolluted(t *testing.T) {
+	ipSets := map[string]*cidrMerger.IpSet{
+		"bogus": mustLoadIpSet("127.0.0.1", "0.0.0.0"),
+		"cn":    mustLoadIpSet("1.0.0.0/8", "2001:db8::/32"),
+	}
+	bogus := &types.Config{IpSets: ipSets, Fallback: types.FallbackConfig{Bogus: []string{"bogus"}}}
+	expect := &types.Config{IpSets: ipSets, Fallback: types.FallbackConfig{Bogus: []string{"bogus"}, Expect: []string{"cn"}}}
+
+	tests := []struct {
+		name   string
+		config *types.Config
+		answer []dns.RR
+		want   bool
+	}{
+		{"没有应答", expect, nil, false},
+		{"只有CNAME", expect, []dns.RR{test.CNAME("example.com. 60 IN CNAME cdn.example.com.")}, false},
+		{"正常应答", bogus, []dns.RR{test.A("example.com. 60 IN A 8.8.8.8")}, false},
+		{"属于bogus", bogus, []dns.RR{test.A("example.com. 60 IN A 127.0.0.1")}, true},
+		{"部分属于bogus", bogus, []dns.RR{test.A("example.com. 60 IN A 8.8.8.8"), test.A("example.com. 60 IN A 0.0.0.0")}, true},
+		{"属于expect", expect, []dns.RR{test.A("example.com. 60 IN A 1.2.3.4"), test.AAAA("example.com. 60 IN AAAA 2001:db8::1")}, false},
+		{"不属于expect", expect, []dns.RR{test.A("example.com. 60 IN A 1.2.3.4"), test.A("example.com. 60 IN A 8.8.8.8")}, true},
+		{"IPv6不属于expect", expect, []dns.RR{test.AAAA("example.com. 60 IN AAAA 2001:4860::1")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isPolluted(tt.config, &dns.Msg{Answer: tt.answer}); got != tt.want {
+				t.Errorf("isPolluted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// stubUpstream 启动一个对所有A记录查询都在 delay 之后应答 ip 的DNS服务器，queries 记录收到的查询次数。
+// dnstest.NewServer 将处理函数注册在全局的 dns.DefaultServeMux 上，无法同时启动多个应答不同的服务器，所以这里单独设置 Handler
+func stubUpstream(t *testing.T, ip string, delay time.Duration) (addr string, queries *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries = new(atomic.Int32)
+	started := make(chan struct{})
+	s := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		time.Sleep(delay)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = []dns.RR{test.A(r.Question[0].Name + " 60 IN A " + ip)}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = s.ActivateAndServe() }()
+	<-started
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return pc.LocalAddr().String(), queries
+}
+
+// serveA 通过 d 查询 example.com. 的A记录，返回应答中的IP
+func serveA(t *testing.T, d *PriDns) ([]string, error) {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := d.ServeDNS(context.Background(), rec, r); err != nil {
+		return nil, err
+	}
+	if rec.Msg == nil {
+		t.Fatal("no answer")
+	}
+	var ips []string
+	for _, rr := range rec.Msg.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A.String())
+		}
+	}
+	return ips, nil
+}
+
+func TestFallbackServeDNS(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryIp     string
+		want          string
+		wantFallbacks int32 // 回退DNS服务器收到的查询次数
+	}{
+		{"应答正常", "8.8.8.8", "8.8.8.8", 0},
+		{"应答被污染", "127.0.0.1", "1.2.3.4", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, _ := stubUpstream(t, tt.primaryIp, 0)
+			fallback, fallbackQueries := stubUpstream(t, "1.2.3.4", 0)
+
+			store := memory.NewStore()
+			if err := store.SaveRules(db.RuleChanges{CreateForwards: []db.Forward{
+				{Name: "example.com", DnsSvr: []string{primary}, FallbackSvr: []string{fallback}, Enable: true},
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			d := NewPriDns(&types.Config{
+				IpSets:   map[string]*cidrMerger.IpSet{"bogus": mustLoadIpSet("127.0.0.1")},
+				Fallback: types.FallbackConfig{Bogus: []string{"bogus"}},
+			}, store)
+			defer func() { _ = d.closeFunc() }()
+
+			if got, err := serveA(t, d); err != nil || len(got) != 1 || got[0] != tt.want {
+				t.Errorf("answer = %v, %v, want [%s]", got, err, tt.want)
+			}
+			if got := fallbackQueries.Load(); got != tt.wantFallbacks {
+				t.Errorf("fallback queries = %d, want %d", got, tt.wantFallbacks)
+			}
+		})
+	}
+}
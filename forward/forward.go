@@ -13,6 +13,7 @@ import (
 	"github.com/laeni/pri-dns/util"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin/debug"
@@ -38,15 +39,28 @@ var (
 	maxDnsSvr     = 4  // 单条记录转发上游的最大数量。
 	maxProxyCache = 20 // 最大代理实例缓存数量
 
+	// 并发转发时收到第一个不满足 prefer 的成功应答后，继续等待满足 prefer 的应答的最长时间，以免个别上游无响应时每次查询都需要等待超时
+	preferWait = 200 * time.Millisecond
+
 	// ErrNoHealthy means no healthy proxies left.
 	ErrNoHealthy = errors.New("no healthy proxies")
 	// ErrCachedClosed means cached connection was closed by peer.
 	ErrCachedClosed = errors.New("cached connection was closed by peer")
 )
 
-// Run 使用代理实际进行转发.
+// Run 使用代理实际进行转发，并将上游的应答写回客户端.
 // 该代码几乎复制于 forward 插件
 func Run(proxies []*Proxy, ctx context.Context, state request.Request) (int, error, []string) {
+	ret, err := Exchange(proxies, ctx, state)
+	if err != nil {
+		return dns.RcodeServerFailure, err, nil
+	}
+	return Write(state, ret)
+}
+
+// Exchange 使用代理将请求转发给上游并返回上游的应答，但不会写回客户端，便于调用方在写回前对应答进行检查.
+// 如果上游的应答与请求不匹配，则返回一个 dns.RcodeFormatError 应答
+func Exchange(proxies []*Proxy, ctx context.Context, state request.Request) (*dns.Msg, error) {
 	fails := 0
 	var upstreamErr error
 	i := 0
@@ -106,26 +120,86 @@ func Run(proxies []*Proxy, ctx context.Context, state request.Request) (int, err
 
 			formerr := new(dns.Msg)
 			formerr.SetRcode(state.Req, dns.RcodeFormatError)
-			state.W.WriteMsg(formerr)
-			return dns.RcodeSuccess, nil, nil
+			return formerr, nil
 		}
 
-		_ = state.W.WriteMsg(ret)
-		return dns.RcodeSuccess, nil, getAddress(ret)
+		return ret, nil
 	}
 
 	if upstreamErr != nil {
-		return dns.RcodeServerFailure, upstreamErr, nil
+		return nil, upstreamErr
 	}
 
-	return dns.RcodeServerFailure, ErrNoHealthy, nil
+	return nil, ErrNoHealthy
 }
 
-func getAddress(ret *dns.Msg) []string {
+// ExchangeParallel 并发地将请求转发给所有上游，返回第一个满足 prefer 的应答；如果所有应答都不满足 prefer，则返回最先到达的成功应答.
+// 收到第一个成功应答后最多再等待 preferWait，之后仍没有满足 prefer 的应答时不再等待其他上游。返回值中的 preferred 表示返回的应答是否满足 prefer
+func ExchangeParallel(proxies []*Proxy, ctx context.Context, state request.Request, prefer func(*dns.Msg) bool) (ret *dns.Msg, preferred bool, err error) {
+	type result struct {
+		ret *dns.Msg
+		err error
+	}
+	// 带缓冲，不再等待时其余的 goroutine 也可以正常退出
+	results := make(chan result, len(proxies))
+	for _, proxy := range proxies {
+		// Connect 会修改请求的 Id，所以每个上游都需要使用独立的请求副本
+		st := request.Request{W: state.W, Req: state.Req.Copy()}
+		go func(proxy *Proxy) {
+			ret, err := Exchange([]*Proxy{proxy}, ctx, st)
+			results <- result{ret: ret, err: err}
+		}(proxy)
+	}
+
+	var wait <-chan time.Time // 收到第一个成功应答后开始计时
+	for range proxies {
+		var res result
+		select {
+		case res = <-results:
+		case <-wait:
+			return ret, false, nil
+		}
+		if res.err != nil {
+			err = res.err
+			continue
+		}
+		if prefer(res.ret) {
+			return res.ret, true, nil
+		}
+		if ret == nil {
+			ret = res.ret
+			timer := time.NewTimer(preferWait)
+			defer timer.Stop()
+			wait = timer.C
+		}
+	}
+	if ret != nil {
+		return ret, false, nil
+	}
+	if err == nil {
+		err = ErrNoHealthy
+	}
+	return nil, false, err
+}
+
+// Write 将 Exchange 得到的应答写回客户端，返回值与 Run 相同
+func Write(state request.Request, ret *dns.Msg) (int, error, []string) {
+	_ = state.W.WriteMsg(ret)
+	if ret.Rcode == dns.RcodeFormatError {
+		return dns.RcodeSuccess, nil, nil
+	}
+	return dns.RcodeSuccess, nil, GetAddress(ret)
+}
+
+// GetAddress 获取应答中解析得到的IP地址
+func GetAddress(ret *dns.Msg) []string {
 	ads := make([]string, 0, len(ret.Answer)+len(ret.Ns)+len(ret.Extra))
 	for _, rr := range ret.Answer {
-		if v, ok := rr.(*dns.A); ok {
+		switch v := rr.(type) {
+		case *dns.A:
 			ads = append(ads, v.A.String())
+		case *dns.AAAA:
+			ads = append(ads, v.AAAA.String())
 		}
 	}
 	return ads
@@ -137,7 +211,20 @@ type proxyCacheWrapper struct {
 	dnsSvr       string    // 上游DNS地址
 	activityTime time.Time // 最后活跃时间，如果不活跃的可能会从缓存中剔除
 	proxy        *Proxy
-	closeHook    func()
+
+	owners  map[any]struct{} // 使用该代理的插件实例，没有实例使用时才会被 RetainProxy 移除
+	inUse   int              // 正在使用该代理的查询数量
+	evicted bool             // 已经从缓存中移除，inUse 为 0 时关闭
+	closed  bool             // 已经关闭
+}
+
+// evict 标记代理已从缓存中移除，没有正在使用该代理的查询时立即关闭，否则等到最后一个查询释放时关闭。调用时需持有 proxyCacheMu
+func (w *proxyCacheWrapper) evict() {
+	w.evicted = true
+	if w.inUse == 0 && !w.closed {
+		w.closed = true
+		w.proxy.stop()
+	}
 }
 
 type proxyCacheType []*proxyCacheWrapper
@@ -163,14 +250,67 @@ func (pc proxyCacheType) Swap(i, j int) {
 	pc[i], pc[j] = pc[j], pc[i]
 }
 
-var proxyCache = make(proxyCacheType, 0, maxProxyCache)
+var (
+	proxyCache   = make(proxyCacheType, 0, maxProxyCache)
+	proxyCacheMu sync.Mutex
+)
+
+// RetainProxy 释放插件实例 owner 对不属于 dnsSvrArray 的代理的使用，用于规则变更或者实例关闭（dnsSvrArray 为空）后释放不再使用的上游。
+// 不再被任何实例使用的代理将从缓存中移除并关闭，正在被查询使用的代理在查询结束后关闭。返回移除的数量
+func RetainProxy(owner any, dnsSvrArray []string) int {
+	keep := make(map[string]struct{})
+	for _, dnsSvr := range dnsSvrArray {
+		toHosts, err := parse.HostPortOrFile(dnsSvr)
+		if err != nil {
+			continue
+		}
+		for _, svr := range toHosts {
+			keep[svr] = struct{}{}
+		}
+	}
+
+	proxyCacheMu.Lock()
+	defer proxyCacheMu.Unlock()
+	retained := proxyCache[:0]
+	removed := 0
+	for _, it := range proxyCache {
+		if _, ok := keep[it.dnsSvr]; !ok {
+			delete(it.owners, owner)
+		}
+		if len(it.owners) > 0 {
+			retained = append(retained, it)
+			continue
+		}
+		it.evict()
+		removed++
+	}
+	proxyCache = retained
+	return removed
+}
+
+// releaseProxy 释放 GetProxy 返回的代理，已从缓存中移除的代理在最后一个查询释放后关闭
+func releaseProxy(used []*proxyCacheWrapper) {
+	proxyCacheMu.Lock()
+	defer proxyCacheMu.Unlock()
+
+	for _, it := range used {
+		it.inUse--
+		if it.evicted {
+			it.evict()
+		}
+	}
+}
 
 // endregion
 
-// GetProxy 根据 forwards 数据从缓存查询对应的 Proxy 实例，如果缓存不存在则创建新实例加入缓存
-func GetProxy(config *types.Config, dnsSvrArray []string, RegisterCloseHook func(func()) func()) ([]*Proxy, error) {
-	var proxies []*Proxy
-	var err error
+// GetProxy 根据 forwards 数据从缓存查询插件实例 owner 使用的 Proxy 实例，如果缓存不存在则创建新实例加入缓存。
+// 使用完毕后需要调用 release，在此之前代理不会被关闭
+func GetProxy(config *types.Config, owner any, dnsSvrArray []string) (proxies []*Proxy, release func(), err error) {
+	proxyCacheMu.Lock()
+	defer proxyCacheMu.Unlock()
+
+	var used []*proxyCacheWrapper
+	release = func() { releaseProxy(used) }
 	for _, dnsSvr := range dnsSvrArray {
 		// 规范化DNS地址
 		toHosts, perErr := parse.HostPortOrFile(dnsSvr)
@@ -181,7 +321,7 @@ func GetProxy(config *types.Config, dnsSvrArray []string, RegisterCloseHook func
 
 		for _, svr := range toHosts {
 			if len(proxies) >= maxDnsSvr {
-				return proxies, nil
+				return proxies, release, nil
 			}
 
 			wrapper := proxyCache.get(svr)
@@ -192,7 +332,7 @@ func GetProxy(config *types.Config, dnsSvrArray []string, RegisterCloseHook func
 					dnsSvr:       svr,
 					activityTime: time.Now(),
 					proxy:        p,
-					closeHook:    RegisterCloseHook(p.stop),
+					owners:       make(map[any]struct{}),
 				}
 				// 如果缓存已经超过最大限制，则删除不活跃的
 				if len(proxyCache) > maxProxyCache {
@@ -201,19 +341,20 @@ func GetProxy(config *types.Config, dnsSvrArray []string, RegisterCloseHook func
 					proxyCache = proxyCacheTmp
 					// 移除的代理需要关闭健康检查
 					for _, it := range removed {
-						it.proxy.stop()
-						// 已经关闭的Proxy要取消注册
-						it.closeHook()
+						it.evict()
 					}
 				}
 				proxyCache = append(proxyCache, wrapper)
 			} else {
 				wrapper.activityTime = time.Now()
 			}
+			wrapper.owners[owner] = struct{}{}
+			wrapper.inUse++
+			used = append(used, wrapper)
 			proxies = append(proxies, wrapper.proxy)
 		}
 	}
-	return proxies, err
+	return proxies, release, err
 }
 
 func newProxy(dnsSvr string, tlsConfigMap map[string]*tls.Config) *Proxy {
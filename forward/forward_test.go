@@ -0,0 +1,63 @@
+package forward
+
+import (
+	"testing"
+
+	"github.com/laeni/pri-dns/types"
+)
+
+// cached 返回缓存中 svr 对应的代理
+func cached(svr string) *proxyCacheWrapper {
+	proxyCacheMu.Lock()
+	defer proxyCacheMu.Unlock()
+	return proxyCache.get(svr)
+}
+
+func TestRetainProxy(t *testing.T) {
+	config := &types.Config{}
+	a, b := new(int), new(int) // 两个插件实例
+	t.Cleanup(func() {
+		RetainProxy(a, nil)
+		RetainProxy(b, nil)
+	})
+
+	get := func(owner any, svr string) func() {
+		_, release, err := GetProxy(config, owner, []string{svr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return release
+	}
+	get(a, "127.0.0.1:10053")()
+	get(a, "127.0.0.1:10054")()
+	get(b, "127.0.0.1:10054")()
+	get(b, "127.0.0.1:10055")()
+
+	// 只释放实例 a 不再使用的代理，同时被实例 b 使用的代理保留
+	if removed := RetainProxy(a, nil); removed != 1 {
+		t.Errorf("RetainProxy() = %d, want 1", removed)
+	}
+	if cached("127.0.0.1:10053") != nil {
+		t.Error("proxy only used by a should be removed")
+	}
+	if cached("127.0.0.1:10054") == nil || cached("127.0.0.1:10055") == nil {
+		t.Error("proxies used by b should be retained")
+	}
+
+	// 正在被查询使用的代理在查询结束后才关闭
+	release := get(b, "127.0.0.1:10056")
+	w := cached("127.0.0.1:10056")
+	if removed := RetainProxy(b, []string{"127.0.0.1:10054", "127.0.0.1:10055"}); removed != 1 {
+		t.Errorf("RetainProxy() = %d, want 1", removed)
+	}
+	if cached("127.0.0.1:10056") != nil {
+		t.Error("proxy not kept by b should be removed")
+	}
+	if w.closed {
+		t.Error("proxy in use should not be closed")
+	}
+	release()
+	if !w.closed {
+		t.Error("proxy should be closed after release")
+	}
+}
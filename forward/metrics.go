@@ -58,4 +58,16 @@ var (
 		Name:      "conn_cache_misses_total",
 		Help:      "Counter of connection cache misses per upstream and protocol.",
 	}, []string{"to", "proto"})
+	FallbackCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "fallback_total",
+		Help:      "Counter of forwarded queries per path taken by rules with fallback upstreams.",
+	}, []string{"path"})
+	SmartCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "smart_total",
+		Help:      "Counter of smart forwarded queries per result, preferred or not.",
+	}, []string{"result"})
 )
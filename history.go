@@ -0,0 +1,223 @@
+package pri_dns
+
+import (
+	"sync"
+	"time"
+
+	"github.com/laeni/pri-dns/db"
+	myForward "github.com/laeni/pri-dns/forward"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultHistoryFlushInterval = time.Minute // 默认的解析历史写入间隔
+	defaultHistoryBatchSize     = 1000        // 默认的待写入IP数量，达到该数量时立即写入
+	defaultHistoryQueueSize     = 1000        // 默认的解析结果队列长度
+
+	// historyMaxPendingBatches 写入失败的解析历史将在下次写入时重试，待写入的IP数量最多为 batchSize 的该倍数，超出时丢弃
+	historyMaxPendingBatches = 10
+)
+
+// 丢弃解析历史的原因
+const (
+	historyDropQueueFull  = "queue_full"  // 队列已满
+	historyDropClosed     = "closed"      // 已经停止
+	historyDropWriteError = "write_error" // 写入存储失败且无法重试
+)
+
+// address 一次转发应答中的IP及其归属
+type address struct {
+	hisKey
+	ads []string
+	at  time.Time // 解析时间
+}
+
+// historyCollector 汇总转发应答中的IP并批量写入存储。DNS 查询中只进行非阻塞的入队，队列已满或者已经停止时丢弃并计数；
+// 停止时将队列中剩余的以及尚未写入的解析历史全部写入存储
+type historyCollector struct {
+	store     db.Store
+	interval  time.Duration
+	batchSize int
+
+	queue     chan address
+	mu        sync.RWMutex // 保护 stopped，保证停止后不会再有数据入队
+	stopped   bool
+	stopCh    chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+
+	// 以下字段只在 run 中访问
+	pending      map[hisKey]map[string]db.HistoryIp
+	pendingCount int  // pending 中的IP数量
+	failed       bool // 上次写入是否有失败，此时达到 batchSize 不再立即写入，而是等到下一个写入间隔，避免存储不可用时频繁重试
+}
+
+func newHistoryCollector(store db.Store, config types.HistoryConfig) *historyCollector {
+	c := &historyCollector{
+		store:     store,
+		interval:  config.FlushInterval,
+		batchSize: config.BatchSize,
+		stopCh:    make(chan struct{}),
+		done:      make(chan struct{}),
+		pending:   make(map[hisKey]map[string]db.HistoryIp),
+	}
+	if c.interval <= 0 {
+		c.interval = defaultHistoryFlushInterval
+	}
+	if c.batchSize <= 0 {
+		c.batchSize = defaultHistoryBatchSize
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultHistoryQueueSize
+	}
+	c.queue = make(chan address, queueSize)
+	return c
+}
+
+// push 将解析结果加入队列，不会阻塞
+func (c *historyCollector) push(a address) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.stopped {
+		historyDroppedCount.WithLabelValues(historyDropClosed).Add(float64(len(a.ads)))
+		return
+	}
+	select {
+	case c.queue <- a:
+	default:
+		historyDroppedCount.WithLabelValues(historyDropQueueFull).Add(float64(len(a.ads)))
+	}
+}
+
+// start 开始在后台汇总并定期写入解析历史，可以重复调用
+func (c *historyCollector) start() {
+	c.startOnce.Do(func() {
+		go c.run()
+	})
+}
+
+// stop 停止接收解析结果，并等待所有已入队的解析历史写入存储，可以重复调用
+func (c *historyCollector) stop() {
+	c.stopOnce.Do(func() {
+		c.mu.Lock()
+		c.stopped = true
+		c.mu.Unlock()
+
+		c.start()
+		close(c.stopCh)
+	})
+	<-c.done
+}
+
+func (c *historyCollector) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case a := <-c.queue:
+			c.add(a)
+			if c.pendingCount >= c.batchSize && !c.failed {
+				c.flush()
+			}
+		case <-ticker.C:
+			c.flush()
+		case <-c.stopCh:
+			// 停止后不会再有数据入队，取出剩余的数据后最后写入一次
+			for drained := false; !drained; {
+				select {
+				case a := <-c.queue:
+					c.add(a)
+				default:
+					drained = true
+				}
+			}
+			c.flush()
+			if c.pendingCount > 0 {
+				historyDroppedCount.WithLabelValues(historyDropWriteError).Add(float64(c.pendingCount))
+			}
+			return
+		}
+	}
+}
+
+// add 将解析结果汇总到待写入的解析历史中
+func (c *historyCollector) add(a address) {
+	ips := c.pending[a.hisKey]
+	if ips == nil {
+		ips = make(map[string]db.HistoryIp)
+		c.pending[a.hisKey] = ips
+	}
+	for _, ip := range a.ads {
+		it, ok := ips[ip]
+		if !ok {
+			it = db.HistoryIp{IpNet: ip, FirstSeen: a.at}
+			c.pendingCount++
+		}
+		it.LastSeen, it.Count = a.at, it.Count+1
+		ips[ip] = it
+	}
+}
+
+// flush 写入所有待写入的解析历史，写入失败的将在下次写入时重试
+func (c *historyCollector) flush() {
+	if len(c.pending) == 0 {
+		return
+	}
+	batch := c.pending
+	c.pending, c.pendingCount = make(map[hisKey]map[string]db.HistoryIp), 0
+
+	var failed []db.History
+	for key, ips := range batch {
+		his := db.History{Name: key.name, ForwardId: key.forwardId, ClientHost: key.clientHost, History: make([]db.HistoryIp, 0, len(ips))}
+		for _, it := range ips {
+			his.History = append(his.History, it)
+		}
+		if err := c.store.SavaHistory(his); err != nil {
+			log.Errorf("save history: %v", err)
+			failed = append(failed, his)
+		}
+	}
+	for _, his := range failed {
+		c.retry(his)
+	}
+	c.failed = len(failed) > 0
+}
+
+// retry 将写入失败的解析历史放回待写入的数据中，待写入的IP数量超出上限时丢弃
+func (c *historyCollector) retry(his db.History) {
+	if c.pendingCount+len(his.History) > c.batchSize*historyMaxPendingBatches {
+		historyDroppedCount.WithLabelValues(historyDropWriteError).Add(float64(len(his.History)))
+		return
+	}
+	key := hisKey{name: his.Name, forwardId: his.ForwardId, clientHost: his.ClientHost}
+	ips := c.pending[key]
+	if ips == nil {
+		ips = make(map[string]db.HistoryIp)
+		c.pending[key] = ips
+	}
+	for _, it := range his.History {
+		if old, ok := ips[it.IpNet]; ok {
+			it = db.MergeHistoryIp([]db.HistoryIp{old}, []db.HistoryIp{it})[0]
+		} else {
+			c.pendingCount++
+		}
+		ips[it.IpNet] = it
+	}
+}
+
+// historyWriter 记录写入的应答中的IP，用于记录下一个插件的解析结果
+type historyWriter struct {
+	dns.ResponseWriter
+	ads []string
+}
+
+func (w *historyWriter) WriteMsg(m *dns.Msg) error {
+	w.ads = append(w.ads, myForward.GetAddress(m)...)
+	return w.ResponseWriter.WriteMsg(m)
+}
@@ -0,0 +1,287 @@
+package pri_dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// historyStore 记录写入的解析历史，fail 大于 0 时接下来的 fail 次写入失败
+type historyStore struct {
+	db.Store
+
+	mu    sync.Mutex
+	fail  int
+	saved map[string]db.HistoryIp
+}
+
+func (s *historyStore) SavaHistory(his db.History) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("store down")
+	}
+	if s.saved == nil {
+		s.saved = make(map[string]db.HistoryIp)
+	}
+	for _, it := range his.History {
+		if old, ok := s.saved[it.IpNet]; ok {
+			it = db.MergeHistoryIp([]db.HistoryIp{old}, []db.HistoryIp{it})[0]
+		}
+		s.saved[it.IpNet] = it
+	}
+	return nil
+}
+
+// count 返回已写入的解析次数
+func (s *historyStore) count() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, it := range s.saved {
+		n += it.Count
+	}
+	return n
+}
+
+// waitCount 等待已写入的解析次数达到 want
+func (s *historyStore) waitCount(t *testing.T, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("saved %d, want %d", s.count(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitFailed 等待写入失败的次数用完
+func (s *historyStore) waitFailed(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		fail := s.fail
+		s.mu.Unlock()
+		if fail == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d writes not failed yet", fail)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testAddress(ip string) address {
+	return address{hisKey: hisKey{name: "example.com", forwardId: 1, clientHost: "10.240.0.1"}, ads: []string{ip}, at: time.Now()}
+}
+
+func historyDropped() float64 {
+	return testutil.ToFloat64(historyDroppedCount.WithLabelValues(historyDropQueueFull)) +
+		testutil.ToFloat64(historyDroppedCount.WithLabelValues(historyDropClosed)) +
+		testutil.ToFloat64(historyDroppedCount.WithLabelValues(historyDropWriteError))
+}
+
+func TestHistoryCollector_stop(t *testing.T) {
+	store := &historyStore{}
+	c := newHistoryCollector(store, types.HistoryConfig{FlushInterval: time.Hour, QueueSize: 16})
+	c.start()
+	droppedBefore := historyDropped()
+
+	// 停止的同时仍有查询在写入解析历史，不会 panic，且每个解析结果要么被写入，要么被计为丢弃
+	const workers, pushes = 8, 200
+	var wg, started sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < pushes; j++ {
+				c.push(testAddress(fmt.Sprintf("10.%d.%d.%d", i, j/256, j%256)))
+				if j == 0 {
+					started.Done()
+				}
+			}
+		}(i)
+	}
+	started.Wait()
+	c.stop()
+	wg.Wait()
+	c.stop()
+
+	if got := float64(store.count()) + historyDropped() - droppedBefore; got != workers*pushes {
+		t.Errorf("saved + dropped = %v, want %d", got, workers*pushes)
+	}
+}
+
+func TestHistoryCollector_batchSize(t *testing.T) {
+	store := &historyStore{}
+	c := newHistoryCollector(store, types.HistoryConfig{FlushInterval: time.Hour, BatchSize: 2})
+	c.start()
+	defer c.stop()
+
+	// 待写入的IP数量达到 batchSize 时不等待写入间隔立即写入
+	c.push(testAddress("1.1.1.1"))
+	c.push(testAddress("1.1.1.1"))
+	c.push(testAddress("2.2.2.2"))
+	store.waitCount(t, 3)
+}
+
+func TestHistoryCollector_retry(t *testing.T) {
+	store := &historyStore{fail: 1}
+	c := newHistoryCollector(store, types.HistoryConfig{FlushInterval: 10 * time.Millisecond})
+	c.start()
+	defer c.stop()
+
+	// 第一次写入失败，失败的解析历史与之后的解析结果合并后重新写入
+	c.push(testAddress("1.1.1.1"))
+	store.waitFailed(t)
+	c.push(testAddress("1.1.1.1"))
+	store.waitCount(t, 2)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if it := store.saved["1.1.1.1"]; !it.LastSeen.After(it.FirstSeen) {
+		t.Errorf("history not merged: %+v", it)
+	}
+}
+
+func TestHistoryCapture(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string // 转发规则的模式
+		domain  bool   // 是否存在自定义解析
+		history types.HistoryConfig
+		acl     types.AclConfig
+		want    []string
+	}{
+		{"交给下一个插件的规则", db.ForwardModeNext, false, types.HistoryConfig{}, types.AclConfig{}, []string{"1.2.3.4"}},
+		{"自定义解析", "", true, types.HistoryConfig{CaptureDomain: true}, types.AclConfig{}, []string{"10.0.0.1"}},
+		{"不记录自定义解析", "", true, types.HistoryConfig{}, types.AclConfig{}, nil},
+		{"不允许转发的客户端", "", false, types.HistoryConfig{CaptureNext: true}, types.AclConfig{Forward: mustLoadIpSet("192.168.0.0/16")}, []string{"1.2.3.4"}},
+		{"不记录不允许转发的客户端", "", false, types.HistoryConfig{}, types.AclConfig{Forward: mustLoadIpSet("192.168.0.0/16")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.NewStore()
+			changes := db.RuleChanges{CreateForwards: []db.Forward{
+				{Name: "example.com", DnsSvr: []string{"127.0.0.1:1"}, Mode: tt.mode, Enable: true},
+			}}
+			if tt.domain {
+				changes.CreateDomains = []db.Domain{{Name: "example.com", Value: "10.0.0.1", Ttl: 60, DnsType: "A", Enable: true}}
+			}
+			if err := store.SaveRules(changes); err != nil {
+				t.Fatal(err)
+			}
+			d := NewPriDns(&types.Config{History: tt.history, Acl: tt.acl}, store)
+			defer func() { _ = d.closeFunc() }()
+			d.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.Answer = []dns.RR{test.A("example.com. 60 IN A 1.2.3.4")}
+				return dns.RcodeSuccess, w.WriteMsg(m)
+			})
+
+			r := new(dns.Msg)
+			r.SetQuestion("example.com.", dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := d.ServeDNS(context.Background(), rec, r); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+				t.Fatalf("answer = %v", rec.Msg)
+			}
+
+			// 停止后尚未写入的解析历史将全部写入存储
+			d.drain()
+			his, _, err := store.FindHistoryByHost("10.240.0.1", db.HistoryScopeMine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, it := range his {
+				got = append(got, it.IpNet)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("history = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pruneStore 记录清理解析历史的次数
+type pruneStore struct {
+	db.Store
+	pruned atomic.Int32
+}
+
+func (s *pruneStore) PruneHistory(time.Time) (int64, error) {
+	s.pruned.Add(1)
+	return 0, nil
+}
+
+// 关闭实例后不再定时清理解析历史
+func TestPruneHistoryStop(t *testing.T) {
+	defer func(old time.Duration) { historyPruneInterval = old }(historyPruneInterval)
+	historyPruneInterval = time.Millisecond
+
+	store := &pruneStore{Store: memory.NewStore()}
+	d := NewPriDns(&types.Config{}, store)
+	defer func() { _ = d.closeFunc() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.pruneHistory(ctx, time.Hour)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for store.pruned.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("history not pruned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prune not stopped")
+	}
+
+	// 关闭实例时停止定时清理，并等待清理的 goroutine 退出
+	d2 := NewPriDns(&types.Config{History: types.HistoryConfig{Expire: time.Hour}}, store)
+	if err := d2.initFunc(); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		_ = d2.closeFunc()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close not returned")
+	}
+}
@@ -0,0 +1,161 @@
+package pri_dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+const (
+	ipLineFormatPlain     = "plain"                // 以逗号分割的网段，默认格式
+	ipLineFormatWireGuard = "wireguard-allowedips" // WireGuard 配置文件中的 AllowedIPs
+	ipLineFormatIpset     = "ipset-restore"        // ipset restore 脚本
+	ipLineFormatNft       = "nft-set"              // nft -f 脚本
+	ipLineFormatRouterOS  = "routeros"             // RouterOS address-list 脚本
+	ipLineFormatClash     = "clash-rule"           // Clash 规则
+	ipLineFormatJson      = "json"                 // JSON 数组
+)
+
+// ipLineOptions 为各个格式的可选参数
+type ipLineOptions struct {
+	name   string // ipset 集合名称、nft 集合名称或 RouterOS 地址列表名称
+	table  string // nft 表名称
+	policy string // Clash 策略名称，为空时输出 rule-provider 格式
+}
+
+// 集合、表及策略名称会原样写入脚本，只允许字母、数字、下划线和连字符，避免注入其他命令
+var ipLineNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validate 检查各个名称是否合法，为空表示未指定（由调用方设置默认值）
+func (o ipLineOptions) validate() error {
+	for _, it := range []struct{ param, value string }{{"name", o.name}, {"table", o.table}, {"policy", o.policy}} {
+		if it.value != "" && !ipLineNamePattern.MatchString(it.value) {
+			return fmt.Errorf("参数 %s 只能包含字母、数字、下划线和连字符: %q", it.param, it.value)
+		}
+	}
+	return nil
+}
+
+// renderIpLine 将网段按照 format 指定的格式输出，ipNets 需要已排序
+func renderIpLine(format string, ipNets []*net.IPNet, opts ipLineOptions) (contentType string, body []byte, err error) {
+	if err := opts.validate(); err != nil {
+		return "", nil, err
+	}
+	var sb strings.Builder
+	switch format {
+	case "", ipLineFormatPlain:
+		sb.WriteString(strings.Join(ipNetStrings(ipNets), ","))
+		return "text/plain", []byte(sb.String()), nil
+	case ipLineFormatWireGuard:
+		sb.WriteString("AllowedIPs = ")
+		sb.WriteString(strings.Join(ipNetStrings(ipNets), ", "))
+		sb.WriteString("\n")
+	case ipLineFormatIpset:
+		v4, v6 := splitFamily(ipNets)
+		for _, it := range []struct {
+			name   string
+			family string
+			nets   []*net.IPNet
+		}{{opts.name, "inet", v4}, {opts.name + "6", "inet6", v6}} {
+			if len(it.nets) == 0 {
+				continue
+			}
+			fmt.Fprintf(&sb, "create %s hash:net family %s -exist\n", it.name, it.family)
+			fmt.Fprintf(&sb, "flush %s\n", it.name)
+			for _, ipNet := range it.nets {
+				fmt.Fprintf(&sb, "add %s %s\n", it.name, ipNet)
+			}
+		}
+	case ipLineFormatNft:
+		v4, v6 := splitFamily(ipNets)
+		fmt.Fprintf(&sb, "table inet %s {\n}\n", opts.table)
+		for _, it := range []struct {
+			name string
+			typ  string
+			nets []*net.IPNet
+		}{{opts.name, "ipv4_addr", v4}, {opts.name + "6", "ipv6_addr", v6}} {
+			if len(it.nets) == 0 {
+				continue
+			}
+			fmt.Fprintf(&sb, "add set inet %s %s { type %s; flags interval; }\n", opts.table, it.name, it.typ)
+			fmt.Fprintf(&sb, "flush set inet %s %s\n", opts.table, it.name)
+			fmt.Fprintf(&sb, "add element inet %s %s { %s }\n", opts.table, it.name, strings.Join(ipNetStrings(it.nets), ", "))
+		}
+	case ipLineFormatRouterOS:
+		v4, v6 := splitFamily(ipNets)
+		for _, it := range []struct {
+			path string
+			nets []*net.IPNet
+		}{{"/ip firewall address-list", v4}, {"/ipv6 firewall address-list", v6}} {
+			if len(it.nets) == 0 {
+				continue
+			}
+			fmt.Fprintf(&sb, "%s\nremove [find list=%s]\n", it.path, opts.name)
+			for _, ipNet := range it.nets {
+				fmt.Fprintf(&sb, "add list=%s address=%s\n", opts.name, ipNet)
+			}
+		}
+	case ipLineFormatClash:
+		// 指定了策略时输出可以直接放入 rules 中的规则，否则输出 classical 类型的 rule-provider
+		indent := ""
+		if opts.policy == "" {
+			sb.WriteString("payload:\n")
+			indent = "  "
+		}
+		for _, ipNet := range ipNets {
+			rule := "IP-CIDR"
+			if ipNet.IP.To4() == nil {
+				rule = "IP-CIDR6"
+			}
+			if opts.policy == "" {
+				fmt.Fprintf(&sb, "%s- %s,%s,no-resolve\n", indent, rule, ipNet)
+			} else {
+				fmt.Fprintf(&sb, "- %s,%s,%s,no-resolve\n", rule, ipNet, opts.policy)
+			}
+		}
+	case ipLineFormatJson:
+		body, err := json.Marshal(ipNetStrings(ipNets))
+		return "application/json", body, err
+	default:
+		return "", nil, fmt.Errorf("不支持的格式: %s", format)
+	}
+	return "text/plain", []byte(sb.String()), nil
+}
+
+func ipNetStrings(ipNets []*net.IPNet) []string {
+	ss := make([]string, len(ipNets))
+	for i, ipNet := range ipNets {
+		ss[i] = ipNet.String()
+	}
+	return ss
+}
+
+// splitFamily 将网段按 IPv4 和 IPv6 分开
+func splitFamily(ipNets []*net.IPNet) (v4, v6 []*net.IPNet) {
+	for _, ipNet := range ipNets {
+		if ipNet.IP.To4() != nil {
+			v4 = append(v4, ipNet)
+		} else {
+			v6 = append(v6, ipNet)
+		}
+	}
+	return
+}
+
+// etagMatch 判断 If-None-Match 请求头 header 是否与 etag 匹配。header 为 "*" 或者以逗号分割的实体标签列表（RFC 9110），
+// If-None-Match 使用弱比较，所以忽略 "W/" 前缀
+func etagMatch(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, it := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(it), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package pri_dns
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_renderIpLine(t *testing.T) {
+	var ipNets []*net.IPNet
+	for _, it := range []string{"1.2.3.0/24", "5.6.7.8/32", "2001:db8::/32"} {
+		_, ipNet, _ := net.ParseCIDR(it)
+		ipNets = append(ipNets, ipNet)
+	}
+	opts := ipLineOptions{name: "pri_dns", table: "pri_dns"}
+
+	tests := []struct {
+		format string
+		opts   ipLineOptions
+		want   string
+	}{
+		{
+			format: "",
+			opts:   opts,
+			want:   "1.2.3.0/24,5.6.7.8/32,2001:db8::/32",
+		},
+		{
+			format: ipLineFormatWireGuard,
+			opts:   opts,
+			want:   "AllowedIPs = 1.2.3.0/24, 5.6.7.8/32, 2001:db8::/32\n",
+		},
+		{
+			format: ipLineFormatIpset,
+			opts:   opts,
+			want: "create pri_dns hash:net family inet -exist\nflush pri_dns\nadd pri_dns 1.2.3.0/24\nadd pri_dns 5.6.7.8/32\n" +
+				"create pri_dns6 hash:net family inet6 -exist\nflush pri_dns6\nadd pri_dns6 2001:db8::/32\n",
+		},
+		{
+			format: ipLineFormatNft,
+			opts:   opts,
+			want: "table inet pri_dns {\n}\n" +
+				"add set inet pri_dns pri_dns { type ipv4_addr; flags interval; }\nflush set inet pri_dns pri_dns\nadd element inet pri_dns pri_dns { 1.2.3.0/24, 5.6.7.8/32 }\n" +
+				"add set inet pri_dns pri_dns6 { type ipv6_addr; flags interval; }\nflush set inet pri_dns pri_dns6\nadd element inet pri_dns pri_dns6 { 2001:db8::/32 }\n",
+		},
+		{
+			format: ipLineFormatRouterOS,
+			opts:   opts,
+			want: "/ip firewall address-list\nremove [find list=pri_dns]\nadd list=pri_dns address=1.2.3.0/24\nadd list=pri_dns address=5.6.7.8/32\n" +
+				"/ipv6 firewall address-list\nremove [find list=pri_dns]\nadd list=pri_dns address=2001:db8::/32\n",
+		},
+		{
+			format: ipLineFormatClash,
+			opts:   opts,
+			want:   "payload:\n  - IP-CIDR,1.2.3.0/24,no-resolve\n  - IP-CIDR,5.6.7.8/32,no-resolve\n  - IP-CIDR6,2001:db8::/32,no-resolve\n",
+		},
+		{
+			format: ipLineFormatClash,
+			opts:   ipLineOptions{policy: "PROXY"},
+			want:   "- IP-CIDR,1.2.3.0/24,PROXY,no-resolve\n- IP-CIDR,5.6.7.8/32,PROXY,no-resolve\n- IP-CIDR6,2001:db8::/32,PROXY,no-resolve\n",
+		},
+		{
+			format: ipLineFormatJson,
+			opts:   opts,
+			want:   `["1.2.3.0/24","5.6.7.8/32","2001:db8::/32"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			_, got, err := renderIpLine(tt.format, ipNets, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("renderIpLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := renderIpLine("unknown", ipNets, opts); err == nil {
+		t.Error("renderIpLine() 不支持的格式应返回错误")
+	}
+
+	// 名称会写入脚本，不允许包含空白、分号等字符
+	for _, invalid := range []ipLineOptions{
+		{name: "pri_dns\ndestroy", table: "pri_dns"},
+		{name: "pri_dns", table: "t; flush ruleset"},
+		{name: "pri_dns", table: "pri dns"},
+		{name: "pri_dns", table: "pri_dns", policy: "PROXY,x"},
+	} {
+		if _, _, err := renderIpLine(ipLineFormatIpset, ipNets, invalid); err == nil {
+			t.Errorf("renderIpLine(%+v) 名称不合法时应返回错误", invalid)
+		}
+	}
+}
+
+func Test_etagMatch(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`"abc"`, true},
+		{`*`, true},
+		{` * `, true},
+		{`"xyz", "abc"`, true},
+		{`"xyz",W/"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz"`, false},
+		{`"abcd", "ab"`, false},
+		{`abc`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.header, etag); got != tt.want {
+			t.Errorf("etagMatch(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
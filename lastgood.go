@@ -0,0 +1,134 @@
+package pri_dns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+)
+
+// lastGoodMaxEntries 每类规则最多缓存的查询结果数量，超出后随机丢弃一条
+const lastGoodMaxEntries = 10000
+
+// errStore 表示查询存储出错，ServeDNS 根据 types.Config.StoreErrorPolicy 决定如何响应
+var errStore = errors.New("store error")
+
+// lookupKey 查询规则时的客户端地址和查询名称，多个名称以逗号连接
+type lookupKey struct {
+	host string
+	name string
+}
+
+// lastGood 缓存最近一次从存储成功查询到的规则，用于在存储不可用时继续提供解析
+type lastGood struct {
+	mu       sync.RWMutex
+	domains  map[lookupKey][]db.Domain
+	forwards map[lookupKey][]db.Forward
+}
+
+func newLastGood() *lastGood {
+	return &lastGood{
+		domains:  make(map[lookupKey][]db.Domain),
+		forwards: make(map[lookupKey][]db.Forward),
+	}
+}
+
+// reset 清空缓存，规则变更后缓存的结果可能已经不再正确
+func (l *lastGood) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.domains = make(map[lookupKey][]db.Domain)
+	l.forwards = make(map[lookupKey][]db.Forward)
+}
+
+func (l *lastGood) putDomains(key lookupKey, domains []db.Domain) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	putBounded(l.domains, key, domains)
+}
+
+func (l *lastGood) getDomains(key lookupKey) ([]db.Domain, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	domains, ok := l.domains[key]
+	return domains, ok
+}
+
+func (l *lastGood) putForwards(key lookupKey, forwards []db.Forward) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	putBounded(l.forwards, key, forwards)
+}
+
+func (l *lastGood) getForwards(key lookupKey) ([]db.Forward, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	forwards, ok := l.forwards[key]
+	return forwards, ok
+}
+
+func putBounded[T any](m map[lookupKey][]T, key lookupKey, items []T) {
+	if _, ok := m[key]; !ok && len(m) >= lastGoodMaxEntries {
+		for k := range m {
+			delete(m, k)
+			break
+		}
+	}
+	m[key] = items
+}
+
+// findDomains 查询 host 可见的 qname 的解析记录。策略为 last_good 时缓存查询结果，存储出错时使用缓存
+func (d *PriDns) findDomains(host, qname string) ([]db.Domain, error) {
+	key := lookupKey{host: host, name: qname}
+	domains, err := d.Store.FindDomainByHostAndName(host, qname)
+	if err != nil {
+		storeErrorCount.WithLabelValues(d.storeErrorPolicy()).Inc()
+		if d.Config.StoreErrorPolicy == types.StoreErrorLastGood {
+			if cached, ok := d.lastGood.getDomains(key); ok {
+				log.Warningf("store error, serving last good domains for %s: %v", qname, err)
+				return cached, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %v", errStore, err)
+	}
+	if d.Config.StoreErrorPolicy == types.StoreErrorLastGood {
+		d.lastGood.putDomains(key, domains)
+	}
+	return domains, nil
+}
+
+// findForwards 查询 host 可见的 names 中任意名称的转发规则。策略为 last_good 时缓存查询结果，存储出错时使用缓存
+func (d *PriDns) findForwards(host string, names []string) ([]db.Forward, error) {
+	key := lookupKey{host: host, name: strings.Join(names, ",")}
+	forwards, err := d.Store.FindForwardByHostAndNames(host, names)
+	if err != nil {
+		storeErrorCount.WithLabelValues(d.storeErrorPolicy()).Inc()
+		if d.Config.StoreErrorPolicy == types.StoreErrorLastGood {
+			if cached, ok := d.lastGood.getForwards(key); ok {
+				log.Warningf("store error, serving last good forwards for %s: %v", key.name, err)
+				return copyForwards(cached), nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %v", errStore, err)
+	}
+	if d.Config.StoreErrorPolicy == types.StoreErrorLastGood {
+		d.lastGood.putForwards(key, copyForwards(forwards))
+	}
+	return forwards, nil
+}
+
+// storeErrorPolicy 返回实际生效的存储异常处理策略
+func (d *PriDns) storeErrorPolicy() string {
+	if d.Config.StoreErrorPolicy == "" {
+		return types.StoreErrorServfail
+	}
+	return d.Config.StoreErrorPolicy
+}
+
+// copyForwards 复制转发规则，调用者会修改其中的 MatchName，不能与缓存共用
+func copyForwards(forwards []db.Forward) []db.Forward {
+	return append([]db.Forward(nil), forwards...)
+}
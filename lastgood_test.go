@@ -0,0 +1,87 @@
+package pri_dns
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+// failingStore 在 fail 为 true 时查询规则返回错误，用于模拟存储不可用
+type failingStore struct {
+	*memory.Store
+	fail bool
+}
+
+func (s *failingStore) FindDomainByHostAndName(host, qname string) ([]db.Domain, error) {
+	if s.fail {
+		return nil, errors.New("connection refused")
+	}
+	return s.Store.FindDomainByHostAndName(host, qname)
+}
+
+func (s *failingStore) FindForwardByHostAndNames(host string, names []string) ([]db.Forward, error) {
+	if s.fail {
+		return nil, errors.New("connection refused")
+	}
+	return s.Store.FindForwardByHostAndNames(host, names)
+}
+
+func TestStoreErrorPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		warm     bool // 存储出错前是否已成功查询过一次
+		wantCode int
+		wantErr  bool
+		wantA    bool // 是否应答了自定义解析
+	}{
+		{"默认响应SERVFAIL", "", true, dns.RcodeServerFailure, true, false},
+		{"servfail", types.StoreErrorServfail, true, dns.RcodeServerFailure, true, false},
+		{"fallthrough", types.StoreErrorFallthrough, true, dns.RcodeRefused, false, false},
+		{"last_good有缓存", types.StoreErrorLastGood, true, dns.RcodeSuccess, false, true},
+		{"last_good无缓存", types.StoreErrorLastGood, false, dns.RcodeServerFailure, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &failingStore{Store: memory.NewStore()}
+			err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{
+				{Name: "example.com", Value: "10.0.0.1", Ttl: 60, DnsType: "A", Enable: true},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := NewPriDns(&types.Config{StoreErrorPolicy: tt.policy}, store)
+			d.Next = test.NextHandler(dns.RcodeRefused, nil)
+			defer func() { _ = d.closeFunc() }()
+
+			query := func() (int, *dnstest.Recorder, error) {
+				r := new(dns.Msg)
+				r.SetQuestion("example.com.", dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{})
+				code, err := d.ServeDNS(context.Background(), rec, r)
+				return code, rec, err
+			}
+			if tt.warm {
+				if code, _, err := query(); code != dns.RcodeSuccess || err != nil {
+					t.Fatalf("warm up: code = %d, err = %v", code, err)
+				}
+			}
+
+			store.fail = true
+			code, rec, err := query()
+			if code != tt.wantCode || (err != nil) != tt.wantErr {
+				t.Fatalf("code = %d, err = %v, want code %d, wantErr %v", code, err, tt.wantCode, tt.wantErr)
+			}
+			if got := rec.Msg != nil && len(rec.Msg.Answer) == 1; got != tt.wantA {
+				t.Errorf("answered = %v, want %v", got, tt.wantA)
+			}
+		})
+	}
+}
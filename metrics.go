@@ -0,0 +1,42 @@
+package pri_dns
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Variables declared for monitoring.
+var (
+	storeErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "store_errors_total",
+		Help:      "Counter of failed rule lookups per store error policy.",
+	}, []string{"policy"})
+	ruleChangeCount = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "rule_changes_total",
+		Help:      "Counter of rule change notifications received from the store.",
+	})
+	rateLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "rate_limited_total",
+		Help:      "Counter of queries that exceeded the per-client rate limit per query kind and response.",
+	}, []string{"kind", "response"})
+	aclDeniedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "acl_denied_total",
+		Help:      "Counter of requests denied by the access control list per feature.",
+	}, []string{"feature"})
+	historyDroppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "pridns",
+		Name:      "history_dropped_total",
+		Help:      "Counter of resolved IPs dropped from the history pipeline per reason.",
+	}, []string{"reason"})
+)
@@ -2,13 +2,16 @@ package pri_dns
 
 import (
 	"context"
+	"errors"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/google/uuid"
 	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/domainlist"
 	myForward "github.com/laeni/pri-dns/forward"
 	"github.com/laeni/pri-dns/types"
+	"github.com/laeni/pri-dns/util"
 	"github.com/miekg/dns"
 	"net"
 	"strings"
@@ -17,16 +20,24 @@ import (
 )
 
 const (
-	storeTypeMySQL = "mysql" // 表示使用 mysql 作为存储介质
+	storeTypeSQL   = "sql"   // 表示使用关系型数据库（MySQL、PostgreSQL、SQLite）作为存储介质
 	storeTypeEtcd  = "etcd"  // 表示使用 etcd 作为存储介质
 	storeTypeRedis = "redis" // 表示使用 redis 作为存储介质
 )
 
 var log = clog.NewWithPlugin("pri-dns")
 
-type address struct {
-	name string
-	ads  []string
+// watchRetryInterval 订阅规则变更失败后重新订阅的间隔
+var watchRetryInterval = time.Minute
+
+// historyPruneInterval 清理过期的解析历史的间隔
+var historyPruneInterval = time.Hour
+
+// hisKey 解析历史的归属，即产生该历史的转发规则和客户端
+type hisKey struct {
+	name       string // 转发规则的域名
+	forwardId  int64  // 转发规则ID
+	clientHost string // 客户端地址
 }
 
 type PriDns struct {
@@ -37,76 +48,108 @@ type PriDns struct {
 	closeHook map[string]func()
 	// closeFunc 函数将在实例销毁时调用
 	closeFunc   func() error
-	pushHisChan chan address
 	hisMutex    sync.Mutex
 	initFunc    func() error
+	history     *historyCollector  // 汇总并写入解析历史
+	domainLists []*domainlist.List // 外部域名列表
+	lastGood    *lastGood          // 最近一次成功查询到的规则，存储异常处理策略为 last_good 时使用
+	stopWatch   func()             // 停止订阅规则变更
+	stopPrune   func()             // 停止定时清理过期的解析历史
+
+	forwardLimiter *rateLimiter // 转发查询的速率限制，为 nil 时不限
+	localLimiter   *rateLimiter // 本地应答查询的速率限制，为 nil 时不限
+
+	policies map[string]responsePolicy // 转发应答的响应策略，key 为策略名称
+
+	admin *adminServer // 后台服务，没有配置 serverPort 时为 nil
 }
 
 func NewPriDns(config *types.Config, store db.Store) *PriDns {
 	closeHook := make(map[string]func())
-	// 域名和IP. {"laeni.cn": {"127.0.0.1":nil, "127.0.0.2":nil}}
-	adsHistory := make(map[string]map[string]struct{})
-	pushHisChan := make(chan address, 1000)
-	ticker := time.NewTicker(time.Minute)
 
 	d := &PriDns{
-		Config:      config,
-		Store:       store,
-		closeHook:   closeHook,
-		pushHisChan: pushHisChan,
+		Config:    config,
+		Store:     store,
+		closeHook: closeHook,
+		history:   newHistoryCollector(store, config.History),
+		lastGood:  newLastGood(),
+
+		forwardLimiter: newRateLimiter(config.RateLimit.Forward),
+		localLimiter:   newRateLimiter(config.RateLimit.Local),
+	}
+	for name, it := range config.ResponsePolicies {
+		if d.policies == nil {
+			d.policies = make(map[string]responsePolicy)
+		}
+		d.policies[name] = newResponsePolicy(it)
+	}
+	for _, it := range config.DomainLists {
+		d.domainLists = append(d.domainLists, domainlist.NewList(it.Name, it.Source, it.Format, it.Refresh))
+	}
+	if config.ServerPort != "" {
+		d.admin = newAdminServer(config, store)
 	}
 
 	d.initFunc = func() error {
-		// 汇总地址
-		go func() {
-			for his := range pushHisChan {
-				func() {
-					d.hisMutex.Lock()
-					defer d.hisMutex.Unlock()
-
-					if adsHistory[his.name] == nil {
-						adsHistory[his.name] = make(map[string]struct{})
-					}
-					for _, ip := range his.ads {
-						adsHistory[his.name][ip] = struct{}{}
-					}
-				}()
+		// 启动后台服务，重新加载配置时将使用新的配置和存储
+		if d.admin != nil {
+			if err := d.admin.start(); err != nil {
+				return err
 			}
-		}()
-
-		// 定时入库, 每分钟执行一次
-		go func() {
-			for range ticker.C {
-				var mapTmp map[string]map[string]struct{}
-				func() {
-					d.hisMutex.Lock()
-					defer d.hisMutex.Unlock()
-					mapTmp, adsHistory = adsHistory, make(map[string]map[string]struct{})
-				}()
-
-				// 入库
-				for name, mp := range mapTmp {
-					his := make([]string, len(mp))
-					i := 0
-					for it := range mp {
-						his[i] = it
-						i++
-					}
-					if err := d.Store.SavaHistory(name, his); err != nil {
-						log.Error(err)
-					}
-				}
+		}
+
+		// 加载外部域名列表
+		for _, list := range d.domainLists {
+			list.Start()
+		}
+
+		// 汇总并定期写入解析历史
+		d.history.start()
+
+		// 订阅规则变更，其他实例修改规则后及时清理缓存
+		if feed, ok := d.Store.(db.ChangeFeed); ok {
+			ctx, cancel := context.WithCancel(context.Background())
+			d.stopWatch = cancel
+			changes, err := feed.Watch(ctx)
+			if err != nil {
+				log.Errorf("watch rules: %v", err)
 			}
-		}()
+			go d.watchRules(ctx, feed, changes)
+		}
+
+		// 定时清理过期的解析历史
+		if expire := config.History.Expire; expire > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			// 等待正在进行的清理完成，关闭后不再访问存储
+			d.stopPrune = func() {
+				cancel()
+				<-done
+			}
+			go func() {
+				defer close(done)
+				d.pruneHistory(ctx, expire)
+			}()
+		}
 		return nil
 	}
 	d.closeFunc = func() error {
+		d.drain()
 		for key, f := range closeHook {
 			f()
 			delete(closeHook, key)
 		}
-		close(pushHisChan)
-		ticker.Stop()
+		if d.stopWatch != nil {
+			d.stopWatch()
+		}
+		// 释放本实例使用的上游，不再被其他实例使用的将被关闭
+		myForward.RetainProxy(d, nil)
+		if d.stopPrune != nil {
+			d.stopPrune()
+		}
+		for _, list := range d.domainLists {
+			list.Stop()
+		}
 		return nil
 	}
 
@@ -120,9 +163,21 @@ func (d *PriDns) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	log.Debugf("qname: %s RemoteIp: %s Type: %s QType: %v Class: %s QClass: %v",
 		state.Name(), state.IP(), state.Type(), state.QType(), state.Class(), state.QClass())
 
+	// 不允许使用插件的客户端直接交给下一个插件处理
+	if !aclAllowed(d.Config.Acl, state.IP(), "") {
+		aclDeniedCount.WithLabelValues("dns").Inc()
+		return plugin.NextOrFailure(d.Name(), d.Next, ctx, w, r)
+	}
+
 	// step.1 如果配置了自定义解析，则直接响应配置的自定义解析即可
-	answers := handQuery(d, state)
+	answers, err := handQuery(d, state)
+	if err != nil {
+		return d.onStoreError(ctx, w, r, err)
+	}
 	if len(answers) != 0 {
+		if !d.localLimiter.allow(state.IP()) {
+			return d.rateLimited(state, rateLimitLocal)
+		}
 		log.Debugf("已找到自定义解析记录: %v", answers)
 		m := new(dns.Msg)
 		m.SetReply(r)
@@ -131,11 +186,17 @@ func (d *PriDns) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 		if err := w.WriteMsg(m); err != nil {
 			return dns.RcodeServerFailure, err
 		}
+		if d.Config.History.CaptureDomain {
+			d.captureLocal(state, m)
+		}
 		return dns.RcodeSuccess, nil
 	}
 
 	// step.2 如果没有配置自定义解析则可能需要根据配置将域名转发给特定的DNS服务器进行解析
 	if ok, code, err := handForward(d, ctx, state); ok {
+		if errors.Is(err, errStore) {
+			return d.onStoreError(ctx, w, r, err)
+		}
 		return code, err
 	}
 
@@ -143,6 +204,85 @@ func (d *PriDns) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	return plugin.NextOrFailure(d.Name(), d.Next, ctx, w, r)
 }
 
+// watchRules 处理规则变更通知直到 ctx 取消，changes 为 nil（订阅失败）或者订阅中断时每隔 watchRetryInterval 重新订阅
+func (d *PriDns) watchRules(ctx context.Context, feed db.ChangeFeed, changes <-chan struct{}) {
+	for {
+		if changes != nil {
+			for range changes {
+				d.onRulesChanged()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+		var err error
+		if changes, err = feed.Watch(ctx); err != nil {
+			log.Errorf("watch rules: %v", err)
+		}
+	}
+}
+
+// pruneHistory 每隔 historyPruneInterval 删除超过 expire 未再解析到的解析历史，直到 ctx 取消
+func (d *PriDns) pruneHistory(ctx context.Context, expire time.Duration) {
+	ticker := time.NewTicker(historyPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		removed, err := d.Store.PruneHistory(time.Now().Add(-expire))
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if removed > 0 {
+			log.Infof("pruned %d history entries not seen for %s", removed, expire)
+		}
+	}
+}
+
+// onRulesChanged 规则变更后清理缓存的规则，并释放本实例的转发规则不再使用的上游
+func (d *PriDns) onRulesChanged() {
+	ruleChangeCount.Inc()
+	d.lastGood.reset()
+
+	_, forwards, err := d.Store.FindAllRules()
+	if err != nil {
+		log.Errorf("load rules after change: %v", err)
+		return
+	}
+	var dnsSvr []string
+	for _, it := range forwards {
+		dnsSvr = append(append(dnsSvr, it.DnsSvr...), it.FallbackSvr...)
+	}
+	if removed := myForward.RetainProxy(d, dnsSvr); removed > 0 {
+		log.Infof("released %d unused upstream proxies after rule change", removed)
+	}
+}
+
+// onStoreError 按配置的策略处理查询存储出错的请求。策略为 last_good 时没有可用的缓存也会走到这里，此时响应 SERVFAIL
+func (d *PriDns) onStoreError(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, err error) (int, error) {
+	log.Error(err)
+	if d.Config.StoreErrorPolicy == types.StoreErrorFallthrough {
+		return plugin.NextOrFailure(d.Name(), d.Next, ctx, w, r)
+	}
+	return dns.RcodeServerFailure, err
+}
+
+// drain 停止后台服务并等待正在处理的请求完成，然后停止接收解析历史并将其全部写入存储。需要在关闭存储之前调用，可以重复调用
+func (d *PriDns) drain() {
+	if d.admin != nil {
+		if err := d.admin.stop(); err != nil {
+			log.Errorf("stop admin server: %v", err)
+		}
+	}
+	d.history.stop()
+}
+
 // Name implements the plugin.Handle interface.
 func (d *PriDns) Name() string { return "pri-dns" }
 
@@ -169,12 +309,12 @@ func (d *PriDns) RegisterCloseHook(f func()) func() {
 	}
 }
 
-// filterRecord 根据查询域名 qname 及优先级找一个最佳的
-func filterRecord(records []db.Forward) *db.Forward {
+// filterRecord 根据查询域名 qname 及优先级找一个最佳的，只考虑在 now 时生效的转发
+func filterRecord(records []db.Forward, now time.Time) *db.Forward {
 	var t *db.Forward
 	for i := range records {
 		record := &records[i]
-		if !record.Enable {
+		if !record.Active(now) {
 			continue
 		}
 		if t == nil {
@@ -189,12 +329,12 @@ func filterRecord(records []db.Forward) *db.Forward {
 	return t
 }
 
-// filterDomain 根据查询域名 qname 及优先级找最佳的解析，同一个域名的解析记录可能有多个
-func filterDomain(domains []db.Domain) map[string][]db.Domain {
-	// 根据解析类型分类（A、AAAA等）并排除禁用的
+// filterDomain 根据查询域名 qname 及优先级找最佳的解析，同一个域名的解析记录可能有多个。只考虑在 now 时生效的解析
+func filterDomain(domains []db.Domain, now time.Time) map[string][]db.Domain {
+	// 根据解析类型分类（A、AAAA等）并排除禁用以及不在生效时间内的
 	domainByDnsType := make(map[string][]db.Domain)
 	for _, domain := range domains {
-		if !domain.Enable {
+		if !domain.Active(now) {
 			continue
 		}
 		if domainByDnsType[domain.DnsType] == nil {
@@ -274,21 +414,24 @@ func matchPriorityCompare(a, b db.RecordFilter) int {
 //  1. 先查询本地添加的解析
 //  2. 如果本地没有对应解析则根据规则转发给上游服务器处理
 //     如果在规则列表中，则转发到根据规则中指定的上游服务器，否则让下一个插件处理
-func handQuery(d *PriDns, state request.Request) []dns.RR {
+func handQuery(d *PriDns, state request.Request) ([]dns.RR, error) {
 	qname := state.Name()
 	qname = qname[:len(qname)-1]
 
 	// 目前该插件只处理 IPv4 和 IPv6 查询
 	if (state.QType() != dns.TypeA && state.QType() != dns.TypeAAAA) || (state.QClass() != dns.ClassINET) {
-		return nil
+		return nil, nil
 	}
 
 	// 一次查询私有解析（clientHost 对应的数据）和全局解析（clientHost 对空的数据）
-	domains := d.Store.FindDomainByHostAndName(state.IP(), qname)
+	domains, err := d.findDomains(state.IP(), qname)
+	if err != nil {
+		return nil, err
+	}
 	// 根据优先级找到最匹配的一个
-	domainByType := filterDomain(domains)
+	domainByType := filterDomain(domains, time.Now())
 	if len(domainByType) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	answers := make([]dns.RR, 0, len(domains))
@@ -313,7 +456,7 @@ func handQuery(d *PriDns, state request.Request) []dns.RR {
 		}
 	}
 
-	return answers
+	return answers, nil
 }
 
 // endregion
@@ -321,45 +464,148 @@ func handQuery(d *PriDns, state request.Request) []dns.RR {
 // region forward
 
 // 尝试处理转发，如果 handForward 已经做出响应（如一个查询需要进行转发或者出现异常情况需要返回），则 ok 为 true，此时直接将 code, err 作为 ServeDNS 返回值即可
-// 如果 ok 为 false，则表示 handForward 方法不处理查询，这时一般需要转发给下一个插件处理
+// 如果 ok 为 false，则表示 handForward 方法不处理查询，这时一般需要转发给下一个插件处理。查询存储出错时 ok 为 true，err 为 errStore
 func handForward(d *PriDns, ctx context.Context, state request.Request) (ok bool, code int, err error) {
 	qname := state.Name()
 	qname = qname[:len(qname)-1]
 
-	// 一次查询私有转发（clientHost 对应的数据）和全局转发（clientHost 对空的数据）
-	forwards := d.Store.FindForwardByHostAndName(state.IP(), qname)
-	if len(forwards) == 0 {
-		return
+	forward, err := matchForward(d, state)
+	if err != nil {
+		return true, dns.RcodeServerFailure, err
 	}
-	// 根据优先级找到最合适的个转发配置
-	forward := filterRecord(forwards)
-	if forward == nil || forward.DenyGlobal {
+	if forward == nil {
 		log.Debug("没有有效的转发记录")
 		return
 	}
+	// 不转发的规则交给下一个插件解析，并记录解析历史
+	if forward.Mode == db.ForwardModeNext {
+		code, err = d.serveNext(ctx, state, forward)
+		return true, code, err
+	}
+	if !aclAllowed(d.Config.Acl, state.IP(), aclForward) {
+		aclDeniedCount.WithLabelValues(aclForward).Inc()
+		log.Debugf("客户端 %s 不允许使用转发规则", state.IP())
+		if d.Config.History.CaptureNext {
+			code, err = d.serveNext(ctx, state, forward)
+			return true, code, err
+		}
+		return
+	}
+	if !d.forwardLimiter.allow(state.IP()) {
+		code, err = d.rateLimited(state, rateLimitForward)
+		return true, code, err
+	}
 	log.Debugf("解析转发: %s => %v", qname, forward.DnsSvr)
 	ok = true
 
-	// 查询对应的 Proxy 实例
-	proxies, err2 := myForward.GetProxy(d.Config, forward.DnsSvr, d.RegisterCloseHook)
+	// 转发请求，必要时使用回退DNS服务器重新解析
+	ret, path, err2 := exchangeWithFallback(d, ctx, state, forward)
 	if err2 != nil {
 		code = dns.RcodeServerFailure
 		err = err2
 		return
 	}
+	if path != "" {
+		log.Debugf("解析路径: %s => %s", qname, path)
+	}
 
-	// 转发请求
+	// 按转发规则的响应策略处理应答后再写回客户端
+	d.applyPolicy(forward, ret)
 	var rrs []string
-	code, err, rrs = myForward.Run(proxies, ctx, state)
+	code, err, rrs = myForward.Write(state, ret)
 
 	if rrs != nil {
 		log.Debugf("解析结果: %v", rrs)
 		// 存储解析历史
-		d.pushHisChan <- address{name: forwards[0].Name, ads: rrs}
+		d.pushHistory(state, forward, rrs)
 	}
 	return
 }
 
+// matchForward 根据优先级找到查询 state 最合适的转发规则，没有生效的转发规则或者最合适的规则为否定用途时返回 nil
+func matchForward(d *PriDns, state request.Request) (*db.Forward, error) {
+	qname := state.Name()
+	qname = qname[:len(qname)-1]
+
+	// 一次查询私有转发（clientHost 对应的数据）和全局转发（clientHost 对空的数据）
+	forwards, err := d.findForwards(state.IP(), util.GenAllMatchDomain(qname))
+	if err != nil {
+		return nil, err
+	}
+	// 引用了外部域名列表的转发
+	listForwards, err := findListForward(d, state.IP(), qname)
+	if err != nil {
+		return nil, err
+	}
+	forwards = append(forwards, listForwards...)
+	if len(forwards) == 0 {
+		return nil, nil
+	}
+	forward := filterRecord(forwards, time.Now())
+	if forward == nil || forward.DenyGlobal {
+		return nil, nil
+	}
+	return forward, nil
+}
+
+// serveNext 将查询交给下一个插件处理，并将应答中的IP记录到转发规则 forward 的解析历史
+func (d *PriDns) serveNext(ctx context.Context, state request.Request, forward *db.Forward) (int, error) {
+	w := &historyWriter{ResponseWriter: state.W}
+	code, err := plugin.NextOrFailure(d.Name(), d.Next, ctx, w, state.Req)
+	if len(w.ads) > 0 {
+		log.Debugf("下一个插件的解析结果: %v", w.ads)
+		d.pushHistory(state, forward, w.ads)
+	}
+	return code, err
+}
+
+// captureLocal 将自定义解析的应答 m 中的IP记录到查询对应的转发规则的解析历史，没有对应的转发规则时不记录
+func (d *PriDns) captureLocal(state request.Request, m *dns.Msg) {
+	ads := myForward.GetAddress(m)
+	if len(ads) == 0 {
+		return
+	}
+	forward, err := matchForward(d, state)
+	if err != nil {
+		log.Errorf("find forward for history: %v", err)
+		return
+	}
+	if forward != nil {
+		d.pushHistory(state, forward, ads)
+	}
+}
+
+// pushHistory 将查询 state 得到的IP ads 记录到转发规则 forward 的解析历史
+func (d *PriDns) pushHistory(state request.Request, forward *db.Forward, ads []string) {
+	d.history.push(address{hisKey: hisKey{name: forward.Name, forwardId: forward.ID, clientHost: state.IP()}, ads: ads, at: time.Now()})
+}
+
+// findListForward 查询 qname 所在的外部域名列表对应的转发配置，如列表 gfwlist 包含 qname 时查询域名为 "@gfwlist" 的转发配置
+func findListForward(d *PriDns, host, qname string) ([]db.Forward, error) {
+	var names []string
+	matchNames := make(map[string]string)
+	for _, list := range d.domainLists {
+		if suffix, ok := list.Match(qname); ok {
+			name := db.ListPrefix + list.Name
+			names = append(names, name)
+			// 列表中的域名匹配其自身及所有子域名，所以在比较优先级时视为泛解析
+			matchNames[name] = "*." + suffix
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	forwards, err := d.findForwards(host, names)
+	if err != nil {
+		return nil, err
+	}
+	for i := range forwards {
+		forwards[i].MatchName = matchNames[forwards[i].Name]
+	}
+	return forwards, nil
+}
+
 // endregion
 
 // 规划化域名 '.' 'example.com.' - _ = plugin.Host("example.com.").NormalizeExact()[0]
@@ -0,0 +1,113 @@
+package pri_dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/domainlist"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+// 不在生效时间内的规则与禁用的规则一样不参与匹配
+func Test_filterRecord(t *testing.T) {
+	// 2024-01-01 为周一
+	workday := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	weekend := time.Date(2024, 1, 6, 10, 0, 0, 0, time.Local)
+	forwards := []db.Forward{
+		{ClientHost: "192.168.1.2", Name: "example.com", DnsSvr: []string{"10.0.0.1"}, Enable: true, Schedule: "Mon-Fri 09:00-18:00"},
+		{Name: "example.com", DnsSvr: []string{"8.8.8.8"}, Enable: true},
+	}
+	if got := filterRecord(forwards, workday); got == nil || got.DnsSvr[0] != "10.0.0.1" {
+		t.Errorf("filterRecord(workday) = %+v, want 10.0.0.1", got)
+	}
+	if got := filterRecord(forwards, weekend); got == nil || got.DnsSvr[0] != "8.8.8.8" {
+		t.Errorf("filterRecord(weekend) = %+v, want 8.8.8.8", got)
+	}
+}
+
+func Test_filterDomain(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.Local)
+	domains := []db.Domain{
+		{ClientHost: "192.168.1.2", Name: "example.com", Value: "10.0.0.1", DnsType: "A", Enable: true, EndTime: now},
+		{Name: "example.com", Value: "10.0.0.2", DnsType: "A", Enable: true, StartTime: now.Add(-time.Hour)},
+		{Name: "example.com", Value: "2001:db8::1", DnsType: "AAAA", Enable: false},
+	}
+	got := filterDomain(domains, now)
+	if len(got) != 1 || len(got["A"]) != 1 || got["A"][0].Value != "10.0.0.2" {
+		t.Errorf("filterDomain() = %+v, want only 10.0.0.2", got)
+	}
+}
+
+// 引用外部域名列表的转发规则在比较优先级时视为列表中匹配到的域名的泛解析
+func TestListForwardServeDNS(t *testing.T) {
+	listFile := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(listFile, []byte("example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	list, _ := stubUpstream(t, "1.1.1.1", 0)
+	other, _ := stubUpstream(t, "2.2.2.2", 0)
+
+	tests := []struct {
+		name     string
+		forwards []db.Forward
+		want     string // 应答的IP，9.9.9.9 表示交给下一个插件处理
+	}{
+		{"匹配列表", []db.Forward{
+			{Name: "@gfw", DnsSvr: []string{list}, Enable: true},
+		}, "1.1.1.1"},
+		{"列表规则优先于更短的泛解析", []db.Forward{
+			{Name: "@gfw", DnsSvr: []string{list}, Enable: true},
+			{Name: "*.com", DnsSvr: []string{other}, Enable: true},
+		}, "1.1.1.1"},
+		{"精准匹配优先于列表规则", []db.Forward{
+			{Name: "@gfw", DnsSvr: []string{list}, Enable: true},
+			{Name: "example.com", DnsSvr: []string{other}, Enable: true},
+		}, "2.2.2.2"},
+		{"私有泛解析优先于同等精度的全局列表规则", []db.Forward{
+			{Name: "@gfw", DnsSvr: []string{list}, Enable: true},
+			{ClientHost: "10.240.0.1", Name: "*.example.com", DnsSvr: []string{other}, Enable: true},
+		}, "2.2.2.2"},
+		{"私有规则拒绝全局列表规则", []db.Forward{
+			{Name: "@gfw", DnsSvr: []string{list}, Enable: true},
+			{ClientHost: "10.240.0.1", Name: "@gfw", DenyGlobal: true, Enable: true},
+		}, "9.9.9.9"},
+		{"不在列表中的查询不匹配", []db.Forward{
+			{Name: "@other", DnsSvr: []string{list}, Enable: true},
+		}, "9.9.9.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.NewStore()
+			if err := store.SaveRules(db.RuleChanges{CreateForwards: tt.forwards}); err != nil {
+				t.Fatal(err)
+			}
+			d := NewPriDns(&types.Config{DomainLists: []types.DomainListConfig{
+				{Name: "gfw", Source: listFile, Format: domainlist.FormatPlain},
+				{Name: "other", Source: listFile, Format: domainlist.FormatPlain},
+			}}, store)
+			defer func() { _ = d.closeFunc() }()
+			// 只加载 gfw 列表，other 列表为空
+			if err := d.domainLists[0].Load(); err != nil {
+				t.Fatal(err)
+			}
+			d.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+				m := new(dns.Msg)
+				m.SetReply(r)
+				m.Answer = []dns.RR{test.A(r.Question[0].Name + " 60 IN A 9.9.9.9")}
+				return dns.RcodeSuccess, w.WriteMsg(m)
+			})
+
+			if got, err := serveA(t, d); err != nil || len(got) != 1 || got[0] != tt.want {
+				t.Errorf("answer = %v, %v, want [%s]", got, err, tt.want)
+			}
+		})
+	}
+}
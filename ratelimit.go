@@ -0,0 +1,105 @@
+package pri_dns
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/request"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterMaxClients 每个限速器最多记录的客户端数量，超出后先清理近期没有查询的客户端
+const rateLimiterMaxClients = 10000
+
+// 限速的查询类型，同时作为指标的标签
+const (
+	rateLimitForward = "forward"
+	rateLimitLocal   = "local"
+)
+
+// rateLimiter 按客户端限制查询速率，每个客户端一个令牌桶
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// newRateLimiter 创建限速器，r.QPS 为 0 时返回 nil，表示不限速
+func newRateLimiter(r types.Rate) *rateLimiter {
+	if r.QPS <= 0 {
+		return nil
+	}
+	burst := r.Burst
+	if burst <= 0 {
+		burst = max(1, int(r.QPS))
+	}
+	return &rateLimiter{limit: rate.Limit(r.QPS), burst: burst, limiters: make(map[string]*rate.Limiter)}
+}
+
+// allow 判断客户端 client 的本次查询是否在速率限制内，l 为 nil 时总是返回 true
+func (l *rateLimiter) allow(client string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.limiters[client]
+	if !ok {
+		if len(l.limiters) >= rateLimiterMaxClients {
+			l.sweep()
+		}
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[client] = lim
+	}
+	return lim.Allow()
+}
+
+// sweep 删除令牌已满的客户端，这些客户端近期没有查询，删除后重新创建的效果相同。
+// 如果仍然超出数量限制（如大量客户端同时查询），则随机删除一个。调用时需持有锁
+func (l *rateLimiter) sweep() {
+	for client, lim := range l.limiters {
+		if lim.Tokens() >= float64(l.burst) {
+			delete(l.limiters, client)
+		}
+	}
+	for client := range l.limiters {
+		if len(l.limiters) < rateLimiterMaxClients {
+			break
+		}
+		delete(l.limiters, client)
+	}
+}
+
+// rateLimited 按配置响应超出速率限制的查询，kind 为 rateLimitForward 或 rateLimitLocal
+func (d *PriDns) rateLimited(state request.Request, kind string) (int, error) {
+	response := d.Config.RateLimit.Response
+	if response == types.RateLimitTruncate && state.Proto() != "udp" {
+		response = types.RateLimitRefused
+	}
+	if response == "" {
+		response = types.RateLimitRefused
+	}
+	rateLimitedCount.WithLabelValues(kind, response).Inc()
+	log.Debugf("rate limited: %s %s %s", kind, state.IP(), state.Name())
+
+	switch response {
+	case types.RateLimitDrop:
+		// 不写入任何应答，客户端将会超时
+		return dns.RcodeSuccess, nil
+	case types.RateLimitTruncate:
+		m := new(dns.Msg)
+		m.SetReply(state.Req)
+		m.Truncated = true
+		if err := state.W.WriteMsg(m); err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		return dns.RcodeSuccess, nil
+	default:
+		// 由 CoreDNS 写入 REFUSED 应答
+		return dns.RcodeRefused, nil
+	}
+}
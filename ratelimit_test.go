@@ -0,0 +1,88 @@
+package pri_dns
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	if l := newRateLimiter(types.Rate{}); l != nil || !l.allow("192.168.1.2") {
+		t.Fatal("zero rate should not limit")
+	}
+	l := newRateLimiter(types.Rate{QPS: 0.001, Burst: 2})
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow("192.168.1.2"); got != want {
+			t.Errorf("allow() #%d = %v, want %v", i, got, want)
+		}
+	}
+	if !l.allow("192.168.1.3") {
+		t.Error("other client should not be limited")
+	}
+
+	// 客户端数量达到上限后清理令牌已满的客户端，被限速的客户端保留
+	for i := 0; i < rateLimiterMaxClients; i++ {
+		l.allow(strconv.Itoa(i))
+	}
+	if len(l.limiters) > rateLimiterMaxClients {
+		t.Errorf("len(limiters) = %d, want <= %d", len(l.limiters), rateLimiterMaxClients)
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		tcp       bool
+		wantCode  int
+		wantWrite bool // 是否写入了应答
+		wantTC    bool
+	}{
+		{"默认REFUSED", "", false, dns.RcodeRefused, false, false},
+		{"drop", types.RateLimitDrop, false, dns.RcodeSuccess, false, false},
+		{"truncate", types.RateLimitTruncate, false, dns.RcodeSuccess, true, true},
+		{"TCP不能truncate", types.RateLimitTruncate, true, dns.RcodeRefused, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.NewStore()
+			err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{
+				{Name: "example.com", Value: "10.0.0.1", Ttl: 60, DnsType: "A", Enable: true},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &types.Config{RateLimit: types.RateLimitConfig{Local: types.Rate{QPS: 0.001, Burst: 1}, Response: tt.response}}
+			d := NewPriDns(config, store)
+			defer func() { _ = d.closeFunc() }()
+
+			query := func() (int, *dnstest.Recorder, error) {
+				r := new(dns.Msg)
+				r.SetQuestion("example.com.", dns.TypeA)
+				rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tt.tcp})
+				code, err := d.ServeDNS(context.Background(), rec, r)
+				return code, rec, err
+			}
+			if code, rec, err := query(); code != dns.RcodeSuccess || err != nil || len(rec.Msg.Answer) != 1 {
+				t.Fatalf("first query: code = %d, err = %v", code, err)
+			}
+			code, rec, err := query()
+			if code != tt.wantCode || err != nil {
+				t.Fatalf("code = %d, err = %v, want %d", code, err, tt.wantCode)
+			}
+			if (rec.Msg != nil) != tt.wantWrite {
+				t.Fatalf("written = %v, want %v", rec.Msg != nil, tt.wantWrite)
+			}
+			if rec.Msg != nil && (rec.Msg.Truncated != tt.wantTC || len(rec.Msg.Answer) != 0) {
+				t.Errorf("msg = %v, want truncated %v without answers", rec.Msg, tt.wantTC)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package pri_dns
+
+import (
+	"fmt"
+	"net"
+
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+// responseTransform 处理转发应答的一个步骤，直接修改 m
+type responseTransform func(m *dns.Msg)
+
+// responsePolicy 转发应答写回客户端之前依次执行的处理步骤，为空时原样返回应答
+type responsePolicy []responseTransform
+
+// newResponsePolicy 根据配置生成处理步骤，先去除记录再限制TTL，最后去除非必要的记录
+func newResponsePolicy(config types.ResponsePolicyConfig) responsePolicy {
+	var p responsePolicy
+	if config.Exclude != nil {
+		p = append(p, excludeAddress(config.Exclude))
+	}
+	if config.NoAAAA {
+		p = append(p, stripAAAA)
+	}
+	if config.MinTtl > 0 || config.MaxTtl > 0 {
+		p = append(p, clampTtl(config.MinTtl, config.MaxTtl))
+	}
+	if config.Minimal {
+		p = append(p, minimalResponse)
+	}
+	return p
+}
+
+// apply 依次执行所有处理步骤
+func (p responsePolicy) apply(m *dns.Msg) {
+	for _, transform := range p {
+		transform(m)
+	}
+}
+
+// excludeAddress 去除 Answer 中IP属于 set 的 A、AAAA 记录
+func excludeAddress(set *cidrMerger.IpSet) responseTransform {
+	return func(m *dns.Msg) {
+		m.Answer = filterRR(m.Answer, func(rr dns.RR) bool {
+			var ip net.IP
+			switch v := rr.(type) {
+			case *dns.A:
+				ip = v.A
+			case *dns.AAAA:
+				ip = v.AAAA
+			default:
+				return true
+			}
+			return !set.Contains(ip)
+		})
+	}
+}
+
+// stripAAAA 去除 Answer 和 Additional 中的 AAAA 记录
+func stripAAAA(m *dns.Msg) {
+	notAAAA := func(rr dns.RR) bool {
+		return rr.Header().Rrtype != dns.TypeAAAA
+	}
+	m.Answer = filterRR(m.Answer, notAAAA)
+	m.Extra = filterRR(m.Extra, notAAAA)
+}
+
+// clampTtl 将所有记录（OPT 除外）的TTL限制在 [minTtl, maxTtl] 之间，为 0 的一端不限
+func clampTtl(minTtl, maxTtl uint32) responseTransform {
+	return func(m *dns.Msg) {
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, rr := range section {
+				h := rr.Header()
+				if h.Rrtype == dns.TypeOPT {
+					continue
+				}
+				if minTtl > 0 && h.Ttl < minTtl {
+					h.Ttl = minTtl
+				}
+				if maxTtl > 0 && h.Ttl > maxTtl {
+					h.Ttl = maxTtl
+				}
+			}
+		}
+	}
+}
+
+// minimalResponse 有应答时去除 Authority 和 Additional 中的记录（OPT 除外）。没有应答时保留，以便客户端根据 SOA 缓存否定应答
+func minimalResponse(m *dns.Msg) {
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		return
+	}
+	m.Ns = nil
+	m.Extra = filterRR(m.Extra, func(rr dns.RR) bool {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+}
+
+// applyPolicy 按转发规则引用的响应策略处理应答 m，没有引用或者引用了未定义的策略时原样返回
+func (d *PriDns) applyPolicy(forward *db.Forward, m *dns.Msg) {
+	if forward.Policy == "" {
+		return
+	}
+	policy, ok := d.policies[forward.Policy]
+	if !ok {
+		log.Warningf("转发规则 %d 引用了未定义的 response_policy: %s，将原样返回应答", forward.ID, forward.Policy)
+		return
+	}
+	policy.apply(m)
+}
+
+// checkPolicy 检查 changes 中新增和修改的转发规则引用的响应策略是否已在 Corefile 中定义
+func checkPolicy(policies map[string]types.ResponsePolicyConfig, changes db.RuleChanges) error {
+	for _, forwards := range [][]db.Forward{changes.CreateForwards, changes.UpdateForwards} {
+		for _, it := range forwards {
+			if _, ok := policies[it.Policy]; it.Policy != "" && !ok {
+				return fmt.Errorf("转发规则 %s 引用了未定义的 response_policy: %s", it.Name, it.Policy)
+			}
+		}
+	}
+	return nil
+}
+
+// filterRR 返回 rrs 中 keep 为 true 的记录
+func filterRR(rrs []dns.RR, keep func(rr dns.RR) bool) []dns.RR {
+	var dst []dns.RR
+	for _, rr := range rrs {
+		if keep(rr) {
+			dst = append(dst, rr)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,122 @@
+package pri_dns
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+func Test_newResponsePolicy(t *testing.T) {
+	newMsg := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Response = true
+		m.Answer = []dns.RR{
+			test.CNAME("example.com. 30 IN CNAME cdn.example.com."),
+			test.A("cdn.example.com. 30 IN A 1.2.3.4"),
+			test.A("cdn.example.com. 3600 IN A 10.0.0.1"),
+			test.AAAA("cdn.example.com. 300 IN AAAA 2001:db8::1"),
+		}
+		m.Ns = []dns.RR{test.NS("example.com. 86400 IN NS ns.example.com.")}
+		m.Extra = []dns.RR{test.AAAA("ns.example.com. 86400 IN AAAA 2001:db8::53")}
+		m.SetEdns0(4096, false)
+		return m
+	}
+	// summary 返回每个记录的类型和TTL，以及 Authority 和 Additional 中的记录数量
+	summary := func(m *dns.Msg) []string {
+		var dst []string
+		for _, rr := range m.Answer {
+			dst = append(dst, fmt.Sprintf("%s/%d", dns.TypeToString[rr.Header().Rrtype], rr.Header().Ttl))
+		}
+		return append(dst, fmt.Sprintf("ns=%d", len(m.Ns)), fmt.Sprintf("extra=%d", len(m.Extra)))
+	}
+
+	tests := []struct {
+		name   string
+		config types.ResponsePolicyConfig
+		want   []string
+	}{
+		{"不处理", types.ResponsePolicyConfig{}, []string{"CNAME/30", "A/30", "A/3600", "AAAA/300", "ns=1", "extra=2"}},
+		{"限制TTL", types.ResponsePolicyConfig{MinTtl: 60, MaxTtl: 600}, []string{"CNAME/60", "A/60", "A/600", "AAAA/300", "ns=1", "extra=2"}},
+		{"只限制最大TTL", types.ResponsePolicyConfig{MaxTtl: 100}, []string{"CNAME/30", "A/30", "A/100", "AAAA/100", "ns=1", "extra=2"}},
+		{"去除AAAA", types.ResponsePolicyConfig{NoAAAA: true}, []string{"CNAME/30", "A/30", "A/3600", "ns=1", "extra=1"}},
+		{"去除排除网段", types.ResponsePolicyConfig{Exclude: mustLoadIpSet("10.0.0.0/8")}, []string{"CNAME/30", "A/30", "AAAA/300", "ns=1", "extra=2"}},
+		{"最小应答", types.ResponsePolicyConfig{Minimal: true}, []string{"CNAME/30", "A/30", "A/3600", "AAAA/300", "ns=0", "extra=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMsg()
+			newResponsePolicy(tt.config).apply(m)
+			if got := summary(m); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			// OPT 记录的TTL包含扩展标志，不能修改
+			if opt := m.IsEdns0(); opt == nil || opt.Hdr.Ttl != 0 {
+				t.Errorf("OPT record changed: %v", opt)
+			}
+		})
+	}
+
+	// 没有应答时保留 Authority 中的 SOA，以便客户端缓存否定应答
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeAAAA)
+	m.Ns = []dns.RR{test.SOA("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 300")}
+	newResponsePolicy(types.ResponsePolicyConfig{Minimal: true}).apply(m)
+	if len(m.Ns) != 1 {
+		t.Errorf("SOA removed from negative answer")
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	d := NewPriDns(&types.Config{ResponsePolicies: map[string]types.ResponsePolicyConfig{"ipv4": {NoAAAA: true}}}, nil)
+	defer func() { _ = d.closeFunc() }()
+
+	tests := []struct {
+		policy string
+		want   int
+	}{
+		{"", 2},
+		{"ipv4", 1},
+		{"undefined", 2}, // 引用了未定义的策略时原样返回
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{test.A("example.com. 60 IN A 1.2.3.4"), test.AAAA("example.com. 60 IN AAAA 2001:db8::1")}
+		d.applyPolicy(&db.Forward{ID: 1, Policy: tt.policy}, m)
+		if len(m.Answer) != tt.want {
+			t.Errorf("policy %q: answers = %d, want %d", tt.policy, len(m.Answer), tt.want)
+		}
+	}
+}
+
+func Test_checkPolicy(t *testing.T) {
+	policies := map[string]types.ResponsePolicyConfig{"ipv4": {NoAAAA: true}}
+	tests := []struct {
+		name    string
+		changes db.RuleChanges
+		wantErr bool
+	}{
+		{"没有引用", db.RuleChanges{CreateForwards: []db.Forward{{Name: "example.com"}}}, false},
+		{"已定义", db.RuleChanges{UpdateForwards: []db.Forward{{Name: "example.com", Policy: "ipv4"}}}, false},
+		{"新增时未定义", db.RuleChanges{CreateForwards: []db.Forward{{Name: "example.com", Policy: "undefined"}}}, true},
+		{"修改时未定义", db.RuleChanges{UpdateForwards: []db.Forward{{Name: "example.com", Policy: "undefined"}}}, true},
+		{"删除的规则不检查", db.RuleChanges{DeleteForwards: []db.Forward{{Name: "example.com", Policy: "undefined"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPolicy(policies, tt.changes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && ruleioStatus(err) != http.StatusBadRequest {
+				t.Errorf("ruleioStatus() = %d, want 400", ruleioStatus(err))
+			}
+		})
+	}
+}
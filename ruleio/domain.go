@@ -0,0 +1,123 @@
+package ruleio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/laeni/pri-dns/db"
+	"github.com/miekg/dns"
+)
+
+const (
+	FormatZone  = "zone"  // RFC 1035 区域文件
+	FormatHosts = "hosts" // hosts 文件
+)
+
+// 导入时没有指定 TTL 的解析记录使用的默认 TTL
+const defaultTtl = 600
+
+func encodeDomains(format string, domains []db.Domain, w io.Writer) ([]string, error) {
+	var skipped []string
+	bw := bufio.NewWriter(w)
+	for _, domain := range domains {
+		if domain.DenyGlobal {
+			skipped = append(skipped, fmt.Sprintf("%s: 不支持导出拒绝全局解析的记录", domain.Name))
+			continue
+		}
+		if domain.DnsType != "A" && domain.DnsType != "AAAA" {
+			skipped = append(skipped, fmt.Sprintf("%s %s: 不支持的记录类型", domain.Name, domain.DnsType))
+			continue
+		}
+		switch format {
+		case FormatZone:
+			_, _ = fmt.Fprintf(bw, "%s\t%d\tIN\t%s\t%s\n", dns.Fqdn(domain.Name), domain.Ttl, domain.DnsType, domain.Value)
+		case FormatHosts:
+			// hosts 文件不支持泛解析
+			if strings.Contains(domain.Name, "*") {
+				skipped = append(skipped, fmt.Sprintf("%s: hosts 文件不支持泛解析", domain.Name))
+				continue
+			}
+			_, _ = fmt.Fprintf(bw, "%s\t%s\n", domain.Value, domain.Name)
+		default:
+			return nil, fmt.Errorf("解析记录不支持该格式: %s", format)
+		}
+	}
+	return skipped, bw.Flush()
+}
+
+func decodeDomains(format string, r io.Reader) ([]db.Domain, []string, error) {
+	switch format {
+	case FormatZone:
+		return decodeZone(r)
+	case FormatHosts:
+		return decodeHosts(r)
+	}
+	return nil, nil, fmt.Errorf("解析记录不支持该格式: %s", format)
+}
+
+// 解析区域文件，只导入 A 和 AAAA 记录，其他类型的记录会被跳过
+func decodeZone(r io.Reader) ([]db.Domain, []string, error) {
+	var domains []db.Domain
+	var skipped []string
+	zp := dns.NewZoneParser(r, ".", "")
+	zp.SetDefaultTTL(defaultTtl)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		domain := db.Domain{Name: normalizeName(hdr.Name), Ttl: int32(hdr.Ttl), Enable: true}
+		switch v := rr.(type) {
+		case *dns.A:
+			domain.DnsType, domain.Value = "A", v.A.String()
+		case *dns.AAAA:
+			domain.DnsType, domain.Value = "AAAA", v.AAAA.String()
+		default:
+			skipped = append(skipped, fmt.Sprintf("%s %s: 不支持的记录类型", hdr.Name, dns.TypeToString[hdr.Rrtype]))
+			continue
+		}
+		domains = append(domains, domain)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, nil, err
+	}
+	return domains, skipped, nil
+}
+
+// 解析 hosts 文件，格式为 "IP 域名 [别名...]"，'#' 之后的内容为注释
+func decodeHosts(r io.Reader) ([]db.Domain, []string, error) {
+	var domains []db.Domain
+	var skipped []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i != -1 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			skipped = append(skipped, fmt.Sprintf("第 %d 行: 格式错误", line))
+			continue
+		}
+		dnsType := "AAAA"
+		if ip.To4() != nil {
+			dnsType = "A"
+		}
+		for _, name := range fields[1:] {
+			domains = append(domains, db.Domain{Name: normalizeName(name), Value: ip.String(), Ttl: defaultTtl, DnsType: dnsType, Enable: true})
+		}
+	}
+	return domains, skipped, scanner.Err()
+}
+
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return "*"
+	}
+	return name
+}
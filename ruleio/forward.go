@@ -0,0 +1,355 @@
+package ruleio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/laeni/pri-dns/db"
+)
+
+const (
+	FormatDnsmasq = "dnsmasq" // dnsmasq 配置，如 server=/example.com/1.2.3.4#53
+	FormatUnbound = "unbound" // Unbound forward-zone 配置
+	FormatCoreDNS = "coredns" // CoreDNS forward 插件配置块
+)
+
+// 这些格式中的转发区域均匹配区域本身及其所有子域名，对应 pri-dns 中的泛域名（*.example.com 同样匹配 example.com）。
+// 所以导出时 example.com 和 *.example.com 都转换为区域 example.com，导入时区域 example.com 转换为 *.example.com
+
+// 将转发规则的域名转换为区域名称，"*" 对应根区域，返回值不以 '.' 结尾，根区域返回空字符串
+func zoneOf(name string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(name, "*"), ".")
+}
+
+// 将区域名称转换为转发规则的域名
+func nameOfZone(zone string) string {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	if zone == "" {
+		return "*"
+	}
+	return "*." + zone
+}
+
+// 上游地址
+type upstream struct {
+	tls  bool
+	host string
+	port string
+}
+
+func parseUpstream(dnsSvr string) (upstream, error) {
+	trans, addr := parse.Transport(dnsSvr)
+	if trans != transport.DNS && trans != transport.TLS {
+		return upstream{}, fmt.Errorf("不支持的协议: %s", dnsSvr)
+	}
+	u := upstream{tls: trans == transport.TLS, host: addr, port: "53"}
+	if u.tls {
+		u.port = "853"
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		u.host, u.port = host, port
+	}
+	if net.ParseIP(u.host) == nil {
+		return upstream{}, fmt.Errorf("上游地址必须为IP: %s", dnsSvr)
+	}
+	return u, nil
+}
+
+// 转换为 pri-dns 中的上游地址格式，使用默认端口时省略端口
+func (u upstream) String() string {
+	if u.tls {
+		if u.port == "853" {
+			return transport.TLS + "://" + u.host
+		}
+		return transport.TLS + "://" + net.JoinHostPort(u.host, u.port)
+	}
+	if u.port == "53" {
+		return u.host
+	}
+	return net.JoinHostPort(u.host, u.port)
+}
+
+func encodeForwards(format string, forwards []db.Forward, w io.Writer) ([]string, error) {
+	var skipped []string
+	bw := bufio.NewWriter(w)
+	for _, forward := range forwards {
+		if forward.DenyGlobal {
+			skipped = append(skipped, fmt.Sprintf("%s: 不支持导出拒绝全局转发的规则", forward.Name))
+			continue
+		}
+		if strings.HasPrefix(forward.Name, db.ListPrefix) {
+			skipped = append(skipped, fmt.Sprintf("%s: 不支持导出域名列表规则", forward.Name))
+			continue
+		}
+		var ups []upstream
+		for _, dnsSvr := range forward.DnsSvr {
+			u, err := parseUpstream(dnsSvr)
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("%s: %v", forward.Name, err))
+				continue
+			}
+			ups = append(ups, u)
+		}
+		if len(ups) == 0 {
+			continue
+		}
+
+		zone := zoneOf(forward.Name)
+		switch format {
+		case FormatDnsmasq:
+			if zone == "" {
+				zone = "#"
+			}
+			for _, u := range ups {
+				// dnsmasq 不支持 DNS over TLS
+				if u.tls {
+					skipped = append(skipped, fmt.Sprintf("%s: dnsmasq 不支持 %s", forward.Name, u))
+					continue
+				}
+				_, _ = fmt.Fprintf(bw, "server=/%s/%s#%s\n", zone, u.host, u.port)
+			}
+		case FormatUnbound:
+			// Unbound 的 forward-tls-upstream 对整个区域生效，所以同一区域只能使用同一种协议，这里以第一个上游为准
+			_, _ = fmt.Fprintf(bw, "forward-zone:\n\tname: \"%s.\"\n", zone)
+			for _, u := range ups {
+				if u.tls != ups[0].tls {
+					skipped = append(skipped, fmt.Sprintf("%s: Unbound 同一区域不支持混合协议 %s", forward.Name, u))
+					continue
+				}
+				_, _ = fmt.Fprintf(bw, "\tforward-addr: %s@%s\n", u.host, u.port)
+			}
+			if ups[0].tls {
+				_, _ = fmt.Fprint(bw, "\tforward-tls-upstream: yes\n")
+			}
+		case FormatCoreDNS:
+			to := make([]string, len(ups))
+			for i, u := range ups {
+				to[i] = u.String()
+			}
+			_, _ = fmt.Fprintf(bw, "%s. {\n\tforward . %s\n}\n", zone, strings.Join(to, " "))
+		default:
+			return nil, fmt.Errorf("转发规则不支持该格式: %s", format)
+		}
+	}
+	return skipped, bw.Flush()
+}
+
+func decodeForwards(format string, r io.Reader) ([]db.Forward, []string, error) {
+	switch format {
+	case FormatDnsmasq:
+		return decodeDnsmasq(r)
+	case FormatUnbound:
+		return decodeUnbound(r)
+	case FormatCoreDNS:
+		return decodeCoreDNS(r)
+	}
+	return nil, nil, fmt.Errorf("转发规则不支持该格式: %s", format)
+}
+
+// forwardBuilder 用于按出现顺序汇总同一域名的多个上游
+type forwardBuilder struct {
+	forwards []db.Forward
+	index    map[string]int
+}
+
+func (b *forwardBuilder) add(name string, dnsSvr ...string) {
+	if b.index == nil {
+		b.index = make(map[string]int)
+	}
+	i, ok := b.index[name]
+	if !ok {
+		i = len(b.forwards)
+		b.index[name] = i
+		b.forwards = append(b.forwards, db.Forward{Name: name, Enable: true})
+	}
+	for _, svr := range dnsSvr {
+		if !containsString(b.forwards[i].DnsSvr, svr) {
+			b.forwards[i].DnsSvr = append(b.forwards[i].DnsSvr, svr)
+		}
+	}
+}
+
+func decodeDnsmasq(r io.Reader) ([]db.Forward, []string, error) {
+	var b forwardBuilder
+	var skipped []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(text, "=")
+		if key != "server" || !strings.HasPrefix(value, "/") {
+			skipped = append(skipped, fmt.Sprintf("第 %d 行: 不支持的配置", line))
+			continue
+		}
+		parts := strings.Split(value, "/")
+		addr := parts[len(parts)-1]
+		host, port, found := strings.Cut(addr, "#")
+		if !found {
+			port = "53"
+		}
+		if net.ParseIP(host) == nil {
+			skipped = append(skipped, fmt.Sprintf("第 %d 行: 上游地址必须为IP", line))
+			continue
+		}
+		svr := upstream{host: host, port: port}.String()
+		for _, zone := range parts[1 : len(parts)-1] {
+			if zone == "#" {
+				zone = ""
+			}
+			b.add(nameOfZone(zone), svr)
+		}
+	}
+	return b.forwards, skipped, scanner.Err()
+}
+
+func decodeUnbound(r io.Reader) ([]db.Forward, []string, error) {
+	var b forwardBuilder
+	var skipped []string
+
+	// 当前 forward-zone 的内容
+	var zone *string
+	var addrs []string
+	tls := false
+	flush := func() {
+		if zone != nil && len(addrs) > 0 {
+			svrs := make([]string, 0, len(addrs))
+			for _, addr := range addrs {
+				host, port, _ := strings.Cut(strings.SplitN(addr, "#", 2)[0], "@")
+				if port == "" {
+					port = "53"
+					if tls {
+						port = "853"
+					}
+				}
+				if net.ParseIP(host) == nil {
+					skipped = append(skipped, fmt.Sprintf("%s: 上游地址必须为IP: %s", *zone, addr))
+					continue
+				}
+				svrs = append(svrs, upstream{tls: tls, host: host, port: port}.String())
+			}
+			if len(svrs) > 0 {
+				b.add(nameOfZone(*zone), svrs...)
+			}
+		}
+		zone, addrs, tls = nil, nil, false
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(text, ":")
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		switch key {
+		case "forward-zone":
+			flush()
+			empty := ""
+			zone = &empty
+		case "name":
+			if zone != nil {
+				zone = &value
+			}
+		case "forward-addr":
+			addrs = append(addrs, value)
+		case "forward-tls-upstream", "forward-ssl-upstream":
+			tls = value == "yes"
+		case "":
+		default:
+			// 其他配置（如 server:、forward-host 等）忽略，遇到新的配置段时结束当前 forward-zone
+			if strings.HasSuffix(text, ":") {
+				flush()
+			}
+		}
+	}
+	flush()
+	return b.forwards, skipped, scanner.Err()
+}
+
+// 解析 CoreDNS 配置，只关注服务块中的 forward 插件，服务块的每个区域对应一条转发规则
+func decodeCoreDNS(r io.Reader) ([]db.Forward, []string, error) {
+	var b forwardBuilder
+	var skipped []string
+
+	var zones []string
+	depth := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i != -1 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if depth == 0 {
+			if fields[len(fields)-1] != "{" {
+				return nil, nil, fmt.Errorf("第 %d 行: 缺少 '{'", line)
+			}
+			zones = zones[:0]
+			for _, key := range fields[:len(fields)-1] {
+				_, key = parse.Transport(key)
+				if host, _, err := net.SplitHostPort(key); err == nil {
+					key = host
+				}
+				zones = append(zones, key)
+			}
+			depth++
+			continue
+		}
+
+		if fields[0] == "forward" && depth == 1 {
+			if len(fields) < 3 {
+				return nil, nil, fmt.Errorf("第 %d 行: forward 参数错误", line)
+			}
+			var svrs []string
+			for _, to := range fields[2:] {
+				if to == "{" {
+					break
+				}
+				u, err := parseUpstream(to)
+				if err != nil {
+					skipped = append(skipped, fmt.Sprintf("第 %d 行: %v", line, err))
+					continue
+				}
+				svrs = append(svrs, u.String())
+			}
+			if len(svrs) > 0 {
+				for _, zone := range zones {
+					b.add(nameOfZone(zone), svrs...)
+				}
+			}
+		}
+		for _, field := range fields {
+			switch field {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, nil, fmt.Errorf("缺少 '}'")
+	}
+	return b.forwards, skipped, scanner.Err()
+}
+
+func containsString(ss []string, s string) bool {
+	for _, it := range ss {
+		if it == s {
+			return true
+		}
+	}
+	return false
+}
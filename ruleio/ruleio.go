@@ -0,0 +1,186 @@
+// Package ruleio 实现解析记录和转发规则与常见标准格式之间的相互转换，用于批量导入导出.
+//
+// 解析记录支持 RFC 1035 区域文件以及 hosts 文件；转发规则支持 dnsmasq、Unbound forward-zone 以及 CoreDNS forward 配置块。
+package ruleio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/laeni/pri-dns/db"
+)
+
+const (
+	KindDomain  = "domain"  // 解析记录
+	KindForward = "forward" // 转发规则
+)
+
+// ErrStore 表示导入导出时访问存储出错，而不是文件内容或参数有误
+var ErrStore = errors.New("存储异常")
+
+// Options 导入导出选项
+type Options struct {
+	Kind    string // 规则类型。domain | forward
+	Format  string // 文件格式
+	Host    string // 生效范围，即客户端地址，为空时表示全局规则
+	Replace bool   // 导入时是否删除生效范围内导入文件中不存在的规则，否则只新增和修改
+	DryRun  bool   // 导入时只计算变更而不实际保存
+
+	Actor    string // 导入时的操作者，记录到审计记录中
+	ClientIp string // 导入时操作者的IP，记录到审计记录中
+
+	// Check 在保存（或 DryRun 返回）前检查导入产生的变更，返回错误时不保存并将该错误原样返回，如检查规则数量是否超出限制
+	Check func(changes db.RuleChanges) error
+}
+
+// Result 导入结果
+type Result struct {
+	Changes db.RuleChanges // 导入产生的变更
+	Skipped []string       // 由于格式不支持等原因被跳过的内容
+}
+
+// Export 将生效范围内的规则按指定格式写入 w，返回由于格式不支持而被跳过的规则
+func Export(store db.Store, opts Options, w io.Writer) ([]string, error) {
+	switch opts.Kind {
+	case KindDomain:
+		domains, err := store.FindDomainByHost(opts.Host)
+		if err != nil {
+			return nil, storeErr(err)
+		}
+		return encodeDomains(opts.Format, domains, w)
+	case KindForward:
+		forwards, err := store.FindForwardByHost(opts.Host)
+		if err != nil {
+			return nil, storeErr(err)
+		}
+		return encodeForwards(opts.Format, forwards, w)
+	}
+	return nil, fmt.Errorf("不支持的规则类型: %s", opts.Kind)
+}
+
+// Import 从 r 中按指定格式读取规则，与生效范围内现有的规则比较得出变更，如果不是 DryRun 则在一个事务中保存这些变更
+func Import(store db.Store, opts Options, r io.Reader) (*Result, error) {
+	result := &Result{}
+	switch opts.Kind {
+	case KindDomain:
+		domains, skipped, err := decodeDomains(opts.Format, r)
+		if err != nil {
+			return nil, err
+		}
+		old, err := store.FindDomainByHost(opts.Host)
+		if err != nil {
+			return nil, storeErr(err)
+		}
+		for i := range domains {
+			domains[i].ClientHost = opts.Host
+		}
+		result.Skipped = skipped
+		result.Changes.CreateDomains, result.Changes.UpdateDomains, result.Changes.DeleteDomains = DiffDomains(old, domains, opts.Replace)
+	case KindForward:
+		forwards, skipped, err := decodeForwards(opts.Format, r)
+		if err != nil {
+			return nil, err
+		}
+		old, err := store.FindForwardByHost(opts.Host)
+		if err != nil {
+			return nil, storeErr(err)
+		}
+		for i := range forwards {
+			forwards[i].ClientHost = opts.Host
+		}
+		result.Skipped = skipped
+		result.Changes.CreateForwards, result.Changes.UpdateForwards, result.Changes.DeleteForwards = DiffForwards(old, forwards, opts.Replace)
+	default:
+		return nil, fmt.Errorf("不支持的规则类型: %s", opts.Kind)
+	}
+
+	if opts.Check != nil {
+		if err := opts.Check(result.Changes); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.DryRun && !result.Changes.Empty() {
+		changes := result.Changes
+		changes.Actor, changes.ClientIp = opts.Actor, opts.ClientIp
+		if err := store.SaveRules(changes); err != nil {
+			return nil, storeErr(err)
+		}
+	}
+	return result, nil
+}
+
+func storeErr(err error) error {
+	return fmt.Errorf("%w: %v", ErrStore, err)
+}
+
+// DiffDomains 比较现有解析记录 old 和导入的解析记录 imported，域名、记录类型和记录值均相同时视为同一条记录。
+// 如果 replace 为 true，则 old 中存在而 imported 中不存在的记录将被删除
+func DiffDomains(old, imported []db.Domain, replace bool) (create, update, del []db.Domain) {
+	key := func(d db.Domain) string { return d.Name + " " + d.DnsType + " " + d.Value }
+	oldMap := make(map[string]db.Domain, len(old))
+	for _, d := range old {
+		oldMap[key(d)] = d
+	}
+	seen := make(map[string]struct{}, len(imported))
+	for _, d := range imported {
+		k := key(d)
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		o, ok := oldMap[k]
+		if !ok {
+			create = append(create, d)
+			continue
+		}
+		if o.Ttl != d.Ttl {
+			o.Ttl = d.Ttl
+			update = append(update, o)
+		}
+	}
+	if replace {
+		for _, d := range old {
+			// 拒绝全局解析的记录无法用这些格式表示，所以不会删除
+			if _, ok := seen[key(d)]; !ok && !d.DenyGlobal {
+				del = append(del, d)
+			}
+		}
+	}
+	return
+}
+
+// DiffForwards 比较现有转发规则 old 和导入的转发规则 imported，域名相同时视为同一条规则。
+// 如果 replace 为 true，则 old 中存在而 imported 中不存在的规则将被删除
+func DiffForwards(old, imported []db.Forward, replace bool) (create, update, del []db.Forward) {
+	oldMap := make(map[string]db.Forward, len(old))
+	for _, f := range old {
+		oldMap[f.Name] = f
+	}
+	seen := make(map[string]struct{}, len(imported))
+	for _, f := range imported {
+		if _, ok := seen[f.Name]; ok {
+			continue
+		}
+		seen[f.Name] = struct{}{}
+		o, ok := oldMap[f.Name]
+		if !ok {
+			create = append(create, f)
+			continue
+		}
+		if strings.Join(o.DnsSvr, ",") != strings.Join(f.DnsSvr, ",") {
+			o.DnsSvr = f.DnsSvr
+			update = append(update, o)
+		}
+	}
+	if replace {
+		for _, f := range old {
+			// 拒绝全局转发的规则以及域名列表规则无法用这些格式表示，所以不会删除
+			if _, ok := seen[f.Name]; !ok && !f.DenyGlobal && !strings.HasPrefix(f.Name, db.ListPrefix) {
+				del = append(del, f)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,150 @@
+package ruleio
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/laeni/pri-dns/db"
+)
+
+func TestDomainRoundTrip(t *testing.T) {
+	domains := []db.Domain{
+		{Name: "example.com", Value: "1.2.3.4", Ttl: 300, DnsType: "A", Enable: true},
+		{Name: "example.com", Value: "2001:db8::1", Ttl: 300, DnsType: "AAAA", Enable: true},
+		{Name: "*.example.org", Value: "5.6.7.8", Ttl: 60, DnsType: "A", Enable: true},
+	}
+	tests := []struct {
+		format  string
+		want    []db.Domain
+		skipped int
+	}{
+		{format: FormatZone, want: domains},
+		{format: FormatHosts, want: []db.Domain{
+			{Name: "example.com", Value: "1.2.3.4", Ttl: defaultTtl, DnsType: "A", Enable: true},
+			{Name: "example.com", Value: "2001:db8::1", Ttl: defaultTtl, DnsType: "AAAA", Enable: true},
+		}, skipped: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			skipped, err := encodeDomains(tt.format, domains, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(skipped) != tt.skipped {
+				t.Errorf("skipped = %v, want %d", skipped, tt.skipped)
+			}
+			got, _, err := decodeDomains(tt.format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeDomains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardRoundTrip(t *testing.T) {
+	forwards := []db.Forward{
+		{Name: "*.example.com", DnsSvr: []string{"1.1.1.1", "8.8.8.8:5353"}, Enable: true},
+		{Name: "*", DnsSvr: []string{"223.5.5.5"}, Enable: true},
+	}
+	for _, format := range []string{FormatDnsmasq, FormatUnbound, FormatCoreDNS} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if _, err := encodeForwards(format, forwards, &buf); err != nil {
+				t.Fatal(err)
+			}
+			got, skipped, err := decodeForwards(format, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(skipped) != 0 {
+				t.Errorf("skipped = %v", skipped)
+			}
+			if !reflect.DeepEqual(got, forwards) {
+				t.Errorf("decodeForwards() = %v, want %v", got, forwards)
+			}
+		})
+	}
+}
+
+func TestDecodeForwards(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   []db.Forward
+	}{
+		{
+			name:   "unbound tls",
+			format: FormatUnbound,
+			data: `server:
+	verbosity: 1
+forward-zone:
+	name: "google.com."
+	forward-addr: 8.8.8.8@853#dns.google
+	forward-tls-upstream: yes
+`,
+			want: []db.Forward{{Name: "*.google.com", DnsSvr: []string{"tls://8.8.8.8"}, Enable: true}},
+		},
+		{
+			name:   "coredns",
+			format: FormatCoreDNS,
+			data: `a.com b.com:53 {
+	cache
+	forward . tls://9.9.9.9 1.1.1.1 {
+		tls_servername dns.quad9.net
+	}
+}
+`,
+			want: []db.Forward{
+				{Name: "*.a.com", DnsSvr: []string{"tls://9.9.9.9", "1.1.1.1"}, Enable: true},
+				{Name: "*.b.com", DnsSvr: []string{"tls://9.9.9.9", "1.1.1.1"}, Enable: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := decodeForwards(tt.format, strings.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeForwards() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffForwards(t *testing.T) {
+	old := []db.Forward{
+		{ID: 1, Name: "*.a.com", DnsSvr: []string{"1.1.1.1"}},
+		{ID: 2, Name: "*.b.com", DnsSvr: []string{"1.1.1.1"}},
+		{ID: 3, Name: "*.c.com", DnsSvr: []string{"1.1.1.1"}},
+		{ID: 4, Name: "*.d.com", DenyGlobal: true},
+	}
+	imported := []db.Forward{
+		{Name: "*.a.com", DnsSvr: []string{"1.1.1.1"}},
+		{Name: "*.b.com", DnsSvr: []string{"8.8.8.8"}},
+		{Name: "*.e.com", DnsSvr: []string{"8.8.8.8"}},
+	}
+
+	create, update, del := DiffForwards(old, imported, true)
+	if len(create) != 1 || create[0].Name != "*.e.com" {
+		t.Errorf("create = %v", create)
+	}
+	if len(update) != 1 || update[0].ID != 2 || update[0].DnsSvr[0] != "8.8.8.8" {
+		t.Errorf("update = %v", update)
+	}
+	if len(del) != 1 || del[0].ID != 3 {
+		t.Errorf("delete = %v", del)
+	}
+
+	if _, _, del := DiffForwards(old, imported, false); len(del) != 0 {
+		t.Errorf("delete without replace = %v", del)
+	}
+}
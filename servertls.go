@@ -0,0 +1,114 @@
+package pri_dns
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/laeni/pri-dns/types"
+)
+
+// certCheckInterval 检查后台服务的证书文件是否修改的最小间隔
+var certCheckInterval = 10 * time.Second
+
+// certReloader 加载后台服务的证书及客户端CA证书，文件修改后在下一次握手时重新加载，重新加载失败时继续使用原来的证书
+type certReloader struct {
+	config types.ServerTlsConfig
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool // 客户端CA证书，没有配置时为 nil
+	modTime time.Time      // 已加载的文件中最新的修改时间
+	checked time.Time      // 最后一次检查文件的时间
+}
+
+// newCertReloader 创建证书加载器，首次加载失败时返回错误
+func newCertReloader(config types.ServerTlsConfig) (*certReloader, error) {
+	r := &certReloader{config: config}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime 返回证书文件中最新的修改时间
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load 加载证书文件，调用时需持有锁（首次加载除外）
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.config.ClientCAFile != "" {
+		data, err := os.ReadFile(r.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.config.ClientCAFile)
+		}
+	}
+	r.cert, r.pool, r.modTime, r.checked = &cert, pool, modTime, time.Now()
+	return nil
+}
+
+// current 返回当前的证书及客户端CA证书，距离上次检查超过 certCheckInterval 且文件已修改时重新加载
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		modTime, err := r.latestModTime()
+		if err != nil {
+			log.Errorf("check server certificate: %v", err)
+		} else if !modTime.Equal(r.modTime) {
+			if err := r.load(modTime); err != nil {
+				log.Errorf("reload server certificate: %v", err)
+			} else {
+				log.Infof("reloaded server certificate %s", r.config.CertFile)
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+// tlsConfig 返回每次握手时使用当前证书的 TLS 配置
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			config := &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}
+			if pool != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
@@ -0,0 +1,186 @@
+package pri_dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/laeni/pri-dns/types"
+)
+
+// writeTestCert 生成序列号为 serial 的自签名证书并写入 certFile 和 keyFile
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "pri-dns"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTest 使用 ln 启动一个返回 "OK" 的 HTTP 服务
+func serveTest(t *testing.T, ln net.Listener) {
+	svr := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("OK"))
+	})}
+	go func() { _ = svr.Serve(ln) }()
+	t.Cleanup(func() { _ = svr.Close() })
+}
+
+func TestServerTls(t *testing.T) {
+	defer func(old time.Duration) { certCheckInterval = old }(certCheckInterval)
+	certCheckInterval = 0
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, 1)
+
+	certs, err := newCertReloader(types.ServerTlsConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := newAdminListener(&types.Config{ServerPort: "127.0.0.1:0"}, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTest(t, ln)
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 1 {
+		t.Fatalf("serial = %d, want 1", got)
+	}
+
+	// 证书文件修改后重新加载
+	writeTestCert(t, certFile, keyFile, 2)
+	later := time.Now().Add(time.Second)
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("serial after reload = %d, want 2", got)
+	}
+
+	// 重新加载失败时继续使用原来的证书
+	if err := os.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Second)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if got := serial(); got != 2 {
+		t.Errorf("serial after failed reload = %d, want 2", got)
+	}
+}
+
+func TestServerTlsClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, 1)
+	// 使用自签名的服务端证书同时作为客户端证书及其CA证书
+	certs, err := newCertReloader(types.ServerTlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := newAdminListener(&types.Config{ServerPort: "127.0.0.1:0"}, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTest(t, ln)
+
+	get := func(certs []tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("https://" + ln.Addr().String())
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	if err := get(nil); err == nil {
+		t.Error("request without client certificate should fail")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get([]tls.Certificate{cert}); err != nil {
+		t.Errorf("request with client certificate: %v", err)
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pri-dns.sock")
+	// 遗留的 socket 文件将被删除
+	old, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = old.Close()
+
+	ln, err := newAdminListener(&types.Config{ServerPort: unixSocketPrefix + path}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTest(t, ln)
+
+	client := &http.Client{Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://pri-dns/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "OK" {
+		t.Errorf("body = %s, want OK", body)
+	}
+}
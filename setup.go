@@ -2,20 +2,24 @@ package pri_dns
 
 import (
 	"crypto/tls"
+	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
-	_ "github.com/go-sql-driver/mysql"
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
 	"github.com/laeni/pri-dns/db"
-	"github.com/laeni/pri-dns/db/mysql"
+	"github.com/laeni/pri-dns/db/snapshot"
+	sqlStore "github.com/laeni/pri-dns/db/sql"
+	"github.com/laeni/pri-dns/domainlist"
 	"github.com/laeni/pri-dns/forward"
 	"github.com/laeni/pri-dns/types"
 	"github.com/miekg/dns"
-	gormDriver "gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -27,22 +31,24 @@ func setup(c *caddy.Controller) error {
 		return err
 	}
 
+	// 后台服务和解析历史需要在关闭存储之前停止，以便正在处理的请求能够完成、尚未写入的解析历史能够写入存储，所以先于 initDb 注册
+	var p *PriDns
+	c.OnShutdown(func() error {
+		if p != nil {
+			p.drain()
+		}
+		return nil
+	})
+
 	store, err := initDb(c, config)
 	if err != nil {
 		return err
 	}
 
-	p := NewPriDns(config, store)
+	p = NewPriDns(config, store)
 	c.OnStartup(p.initFunc)
 	c.OnShutdown(p.closeFunc)
 
-	if config.ServerPort != "" {
-		err := StartApp(p)
-		if err != nil {
-			return err
-		}
-	}
-
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		p.Next = next
 		return p
@@ -55,7 +61,7 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 	config := &types.Config{
 		Tls:         make(map[string]*tls.Config),
 		HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
-		MySQL:       types.MySQLConfig{ConnMaxLifetime: 10 * time.Minute},
+		SQL:         types.SQLConfig{ConnMaxLifetime: 10 * time.Minute},
 	}
 
 	// 解析
@@ -88,20 +94,67 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 						return nil, c.Err("'serverPort' 配置错误，它有且仅有一个参数")
 					}
 					config.ServerPort = svrPortArgs[0]
-				case "mysql":
+				case "server_tls":
+					// server_tls CERT KEY [CLIENT_CA]
+					args := c.RemainingArgs()
+					if len(args) < 2 || len(args) > 3 {
+						return nil, c.ArgErr()
+					}
+					config.ServerTls = types.ServerTlsConfig{CertFile: args[0], KeyFile: args[1]}
+					if len(args) == 3 {
+						config.ServerTls.ClientCAFile = args[2]
+					}
+				case "trusted_proxies":
+					args := c.RemainingArgs()
+					if len(args) == 0 {
+						return nil, c.ArgErr()
+					}
+					if config.TrustedProxies != nil {
+						return nil, c.Err("配置重复定义: trusted_proxies")
+					}
+					ipSet, err := cidrMerger.LoadIpSet(args...)
+					if err != nil {
+						return nil, c.Errf("trusted_proxies 加载失败: %v", err)
+					}
+					config.TrustedProxies = ipSet
+				case "proxy_protocol":
+					if len(c.RemainingArgs()) != 0 {
+						return nil, c.Err("proxy_protocol 不需要参数")
+					}
+					config.ProxyProtocol = true
+				case "mysql", "sql":
+					// mysql 块等同于 driver 为 mysql 的 sql 块
+					block := c.Val()
 					if config.StoreType != "" {
-						return nil, c.Err("配置重复定义: mysql")
+						return nil, c.Errf("配置重复定义: %s", block)
+					}
+					config.StoreType = storeTypeSQL
+					if block == "mysql" {
+						config.SQL.Driver = sqlStore.DriverMySQL
 					}
-					config.StoreType = storeTypeMySQL
 
 					for c.NextBlock() {
 						switch c.Val() {
-						case "dataSourceName":
+						case "driver":
+							if block != "sql" {
+								return nil, c.Errf("不支持的配置: %s", c.Val())
+							}
+							args := c.RemainingArgs()
+							if len(args) != 1 {
+								return nil, c.ArgErr()
+							}
+							switch args[0] {
+							case sqlStore.DriverMySQL, sqlStore.DriverPostgres, sqlStore.DriverSQLite:
+								config.SQL.Driver = args[0]
+							default:
+								return nil, c.Errf("不支持的数据库驱动: %s", args[0])
+							}
+						case "dataSourceName", "dsn":
 							dataSourceNameArgs := c.RemainingArgs()
 							if len(dataSourceNameArgs) != 1 {
 								return nil, c.Errf("dataSourceName 配置错误")
 							}
-							config.MySQL.DataSourceName = dataSourceNameArgs[0]
+							config.SQL.DataSourceName = dataSourceNameArgs[0]
 						case "maxIdleConns":
 							args := c.RemainingArgs()
 							if len(args) != 1 {
@@ -111,7 +164,7 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 							if err != nil {
 								return nil, err
 							}
-							config.MySQL.MaxIdleConns = maxIdleConns
+							config.SQL.MaxIdleConns = maxIdleConns
 						case "maxOpenConns":
 							args := c.RemainingArgs()
 							if len(args) != 1 {
@@ -121,7 +174,7 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 							if err != nil {
 								return nil, err
 							}
-							config.MySQL.MaxOpenConns = maxOpenConns
+							config.SQL.MaxOpenConns = maxOpenConns
 						case "connMaxLifetime":
 							args := c.RemainingArgs()
 							if len(args) != 1 {
@@ -134,11 +187,32 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 							if dur < 0 {
 								return nil, fmt.Errorf("connMaxLifetime can't be negative: %d", dur)
 							}
-							config.MySQL.ConnMaxLifetime = dur
+							config.SQL.ConnMaxLifetime = dur
+						case "autoMigrate":
+							if len(c.RemainingArgs()) != 0 {
+								return nil, fmt.Errorf("autoMigrate 不需要参数")
+							}
+							config.SQL.AutoMigrate = true
+						case "pollInterval":
+							args := c.RemainingArgs()
+							if len(args) != 1 {
+								return nil, fmt.Errorf("pollInterval 参数个数有误")
+							}
+							dur, err := time.ParseDuration(args[0])
+							if err != nil {
+								return nil, err
+							}
+							if dur <= 0 {
+								return nil, fmt.Errorf("pollInterval must be positive: %d", dur)
+							}
+							config.SQL.PollInterval = dur
 						default:
 							return nil, c.Errf("不支持的配置: %s", c.Val())
 						}
 					}
+					if config.SQL.Driver == "" {
+						return nil, c.Errf("sql 必须配置 driver")
+					}
 				case "etcd":
 					if config.StoreType != "" {
 						return nil, c.Err("配置重复定义: etcd")
@@ -258,6 +332,285 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 							return nil, fmt.Errorf("health_check: unknown option %s", hcOpts)
 						}
 					}
+				case "ipset":
+					// ipset NAME SOURCE...
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return nil, c.ArgErr()
+					}
+					if _, ok := config.IpSets[args[0]]; ok {
+						return nil, c.Errf("配置重复定义: ipset %s", args[0])
+					}
+					ipSet, err := cidrMerger.LoadIpSet(args[1:]...)
+					if err != nil {
+						return nil, c.Errf("ipset %s 加载失败: %v", args[0], err)
+					}
+					if config.IpSets == nil {
+						config.IpSets = make(map[string]*cidrMerger.IpSet)
+					}
+					config.IpSets[args[0]] = ipSet
+				case "response_policy":
+					// response_policy NAME { ... }
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					if _, ok := config.ResponsePolicies[args[0]]; ok {
+						return nil, c.Errf("配置重复定义: response_policy %s", args[0])
+					}
+					policy, err := parseResponsePolicy(c)
+					if err != nil {
+						return nil, err
+					}
+					if config.ResponsePolicies == nil {
+						config.ResponsePolicies = make(map[string]types.ResponsePolicyConfig)
+					}
+					config.ResponsePolicies[args[0]] = policy
+				case "fallback":
+					if len(c.RemainingArgs()) > 0 {
+						return nil, c.ArgErr()
+					}
+					for c.NextBlock() {
+						switch c.Val() {
+						case "bogus":
+							args := c.RemainingArgs()
+							if len(args) == 0 {
+								return nil, c.ArgErr()
+							}
+							config.Fallback.Bogus = append(config.Fallback.Bogus, args...)
+						case "expect":
+							args := c.RemainingArgs()
+							if len(args) == 0 {
+								return nil, c.ArgErr()
+							}
+							config.Fallback.Expect = append(config.Fallback.Expect, args...)
+						default:
+							return nil, c.Errf("不支持的配置: %s", c.Val())
+						}
+					}
+				case "domain_list":
+					// domain_list NAME SOURCE
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return nil, c.ArgErr()
+					}
+					for _, it := range config.DomainLists {
+						if it.Name == args[0] {
+							return nil, c.Errf("配置重复定义: domain_list %s", args[0])
+						}
+					}
+					listConfig := types.DomainListConfig{Name: args[0], Source: args[1], Format: domainlist.FormatPlain}
+					for c.NextBlock() {
+						switch c.Val() {
+						case "format":
+							if !c.NextArg() {
+								return nil, c.ArgErr()
+							}
+							switch c.Val() {
+							case domainlist.FormatPlain, domainlist.FormatDnsmasq, domainlist.FormatGfwList:
+								listConfig.Format = c.Val()
+							default:
+								return nil, c.Errf("不支持的域名列表格式: %s", c.Val())
+							}
+						case "refresh":
+							if !c.NextArg() {
+								return nil, c.ArgErr()
+							}
+							dur, err := time.ParseDuration(c.Val())
+							if err != nil {
+								return nil, err
+							}
+							if dur < 0 {
+								return nil, fmt.Errorf("refresh can't be negative: %d", dur)
+							}
+							listConfig.Refresh = dur
+						default:
+							return nil, c.Errf("不支持的配置: %s", c.Val())
+						}
+					}
+					config.DomainLists = append(config.DomainLists, listConfig)
+				case "history":
+					if len(c.RemainingArgs()) > 0 {
+						return nil, c.ArgErr()
+					}
+					for c.NextBlock() {
+						switch c.Val() {
+						case "expire":
+							if !c.NextArg() {
+								return nil, c.ArgErr()
+							}
+							dur, err := time.ParseDuration(c.Val())
+							if err != nil {
+								return nil, err
+							}
+							if dur < 0 {
+								return nil, fmt.Errorf("expire can't be negative: %d", dur)
+							}
+							config.History.Expire = dur
+						case "flush_interval":
+							if !c.NextArg() {
+								return nil, c.ArgErr()
+							}
+							dur, err := time.ParseDuration(c.Val())
+							if err != nil {
+								return nil, err
+							}
+							if dur <= 0 {
+								return nil, fmt.Errorf("flush_interval must be positive: %d", dur)
+							}
+							config.History.FlushInterval = dur
+						case "batch_size", "queue_size":
+							key := c.Val()
+							if !c.NextArg() {
+								return nil, c.ArgErr()
+							}
+							n, err := strconv.Atoi(c.Val())
+							if err != nil {
+								return nil, err
+							}
+							if n <= 0 {
+								return nil, fmt.Errorf("%s must be positive: %d", key, n)
+							}
+							if key == "batch_size" {
+								config.History.BatchSize = n
+							} else {
+								config.History.QueueSize = n
+							}
+						case "capture":
+							args := c.RemainingArgs()
+							if len(args) == 0 {
+								return nil, c.ArgErr()
+							}
+							for _, arg := range args {
+								switch arg {
+								case "domain":
+									config.History.CaptureDomain = true
+								case "next":
+									config.History.CaptureNext = true
+								default:
+									return nil, c.Errf("不支持的解析历史来源: %s", arg)
+								}
+							}
+						default:
+							return nil, c.Errf("不支持的配置: %s", c.Val())
+						}
+					}
+				case "snapshot":
+					if !c.NextArg() {
+						return nil, c.ArgErr()
+					}
+					config.Snapshot = types.SnapshotConfig{Path: c.Val(), Refresh: time.Minute}
+					if len(c.RemainingArgs()) > 0 {
+						return nil, c.ArgErr()
+					}
+					for c.NextBlock() {
+						switch c.Val() {
+						case "refresh":
+							if !c.NextArg() {
+								return nil, c.ArgErr()
+							}
+							dur, err := time.ParseDuration(c.Val())
+							if err != nil {
+								return nil, err
+							}
+							if dur <= 0 {
+								return nil, fmt.Errorf("refresh must be positive: %d", dur)
+							}
+							config.Snapshot.Refresh = dur
+						default:
+							return nil, c.Errf("不支持的配置: %s", c.Val())
+						}
+					}
+				case "ratelimit":
+					if len(c.RemainingArgs()) > 0 {
+						return nil, c.ArgErr()
+					}
+					for c.NextBlock() {
+						switch c.Val() {
+						case "forward", "local":
+							dst := &config.RateLimit.Forward
+							if c.Val() == "local" {
+								dst = &config.RateLimit.Local
+							}
+							r, err := parseRate(c.RemainingArgs())
+							if err != nil {
+								return nil, c.Err(err.Error())
+							}
+							*dst = r
+						case "response":
+							args := c.RemainingArgs()
+							if len(args) != 1 {
+								return nil, c.ArgErr()
+							}
+							switch args[0] {
+							case types.RateLimitRefused, types.RateLimitDrop, types.RateLimitTruncate:
+								config.RateLimit.Response = args[0]
+							default:
+								return nil, c.Errf("不支持的限速响应: %s", args[0])
+							}
+						default:
+							return nil, c.Errf("不支持的配置: %s", c.Val())
+						}
+					}
+				case "acl":
+					if len(c.RemainingArgs()) > 0 {
+						return nil, c.ArgErr()
+					}
+					// 同一项可以出现多次，所有来源合并为一个集合
+					sources := make(map[string][]string)
+					for c.NextBlock() {
+						switch c.Val() {
+						case "allow", "deny", aclForward, aclAdmin, aclRules:
+							key := c.Val()
+							args := c.RemainingArgs()
+							if len(args) == 0 {
+								return nil, c.ArgErr()
+							}
+							sources[key] = append(sources[key], args...)
+						default:
+							return nil, c.Errf("不支持的配置: %s", c.Val())
+						}
+					}
+					for key, dst := range map[string]**cidrMerger.IpSet{
+						"allow":    &config.Acl.Allow,
+						"deny":     &config.Acl.Deny,
+						aclForward: &config.Acl.Forward,
+						aclAdmin:   &config.Acl.Admin,
+						aclRules:   &config.Acl.Rules,
+					} {
+						if len(sources[key]) == 0 {
+							continue
+						}
+						ipSet, err := cidrMerger.LoadIpSet(sources[key]...)
+						if err != nil {
+							return nil, c.Errf("acl %s 加载失败: %v", key, err)
+						}
+						*dst = ipSet
+					}
+				case "rule_quota":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					n, err := strconv.Atoi(args[0])
+					if err != nil {
+						return nil, err
+					}
+					if n < 0 {
+						return nil, fmt.Errorf("rule_quota can't be negative: %d", n)
+					}
+					config.RuleQuota = n
+				case "store_error":
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return nil, c.ArgErr()
+					}
+					switch args[0] {
+					case types.StoreErrorServfail, types.StoreErrorFallthrough, types.StoreErrorLastGood:
+						config.StoreErrorPolicy = args[0]
+					default:
+						return nil, c.Errf("不支持的存储异常处理策略: %s", args[0])
+					}
 				default:
 					return nil, c.Errf("不支持的配置: %s", c.Val())
 				}
@@ -268,32 +621,182 @@ func parsePriDns(c *caddy.Controller) (*types.Config, error) {
 	if config.StoreType == "" {
 		return nil, c.Errf("必须至少使用其中一种存储")
 	}
+	// 任何客户端都可以发送 PROXY 头冒充其他IP，所以必须指定可信代理
+	if config.ProxyProtocol && config.TrustedProxies == nil {
+		return nil, c.Err("proxy_protocol 需要同时配置 trusted_proxies")
+	}
+	// fallback 中引用的 ipset 必须已定义（ipset 可以定义在 fallback 之后）
+	for _, name := range append(config.Fallback.Bogus, config.Fallback.Expect...) {
+		if _, ok := config.IpSets[name]; !ok {
+			return nil, c.Errf("fallback 引用了未定义的 ipset: %s", name)
+		}
+	}
 
 	return config, nil
 }
 
+// parseResponsePolicy 解析 response_policy 块
+func parseResponsePolicy(c *caddy.Controller) (types.ResponsePolicyConfig, error) {
+	var policy types.ResponsePolicyConfig
+	for c.NextBlock() {
+		switch c.Val() {
+		case "min_ttl", "max_ttl":
+			key := c.Val()
+			if !c.NextArg() {
+				return policy, c.ArgErr()
+			}
+			ttl, err := strconv.ParseUint(c.Val(), 10, 32)
+			if err != nil {
+				return policy, c.Errf("%s 必须为非负整数: %s", key, c.Val())
+			}
+			if key == "min_ttl" {
+				policy.MinTtl = uint32(ttl)
+			} else {
+				policy.MaxTtl = uint32(ttl)
+			}
+		case "no_aaaa":
+			if len(c.RemainingArgs()) > 0 {
+				return policy, c.ArgErr()
+			}
+			policy.NoAAAA = true
+		case "exclude":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return policy, c.ArgErr()
+			}
+			exclude, err := cidrMerger.LoadIpSet(args...)
+			if err != nil {
+				return policy, c.Errf("exclude 加载失败: %v", err)
+			}
+			policy.Exclude = exclude
+		case "minimal":
+			if len(c.RemainingArgs()) > 0 {
+				return policy, c.ArgErr()
+			}
+			policy.Minimal = true
+		default:
+			return policy, c.Errf("不支持的配置: %s", c.Val())
+		}
+	}
+	if policy.MinTtl > 0 && policy.MaxTtl > 0 && policy.MinTtl > policy.MaxTtl {
+		return policy, c.Errf("min_ttl 不能大于 max_ttl: %d > %d", policy.MinTtl, policy.MaxTtl)
+	}
+	return policy, nil
+}
+
+// parseRate 解析 "QPS [BURST]" 格式的速率，BURST 省略时与 QPS 相同（至少为 1）
+func parseRate(args []string) (types.Rate, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return types.Rate{}, errors.New("格式为: QPS [BURST]")
+	}
+	qps, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || qps <= 0 {
+		return types.Rate{}, fmt.Errorf("QPS 必须为正数: %s", args[0])
+	}
+	r := types.Rate{QPS: qps, Burst: max(1, int(qps))}
+	if len(args) == 2 {
+		if r.Burst, err = strconv.Atoi(args[1]); err != nil || r.Burst <= 0 {
+			return types.Rate{}, fmt.Errorf("BURST 必须为正整数: %s", args[1])
+		}
+	}
+	return r, nil
+}
+
 func initDb(c *caddy.Controller, config *types.Config) (db.Store, error) {
 	switch config.StoreType {
-	case storeTypeMySQL:
-		ormDb, err := gorm.Open(gormDriver.Open(config.MySQL.DataSourceName))
-		if err != nil {
-			log.Fatal(err)
+	case storeTypeSQL:
+		// 使用本地快照时 connect 在后台刷新快照的 goroutine 中执行，所以需要加锁与 OnShutdown 同步。
+		// 关闭后才建立的连接直接关闭，以免泄漏
+		var (
+			sqlMu  sync.Mutex
+			sqlDb  *sql.DB
+			closed bool
+		)
+		c.OnShutdown(func() error {
+			sqlMu.Lock()
+			defer sqlMu.Unlock()
+			closed = true
+			if sqlDb == nil {
+				return nil
+			}
+			return sqlDb.Close()
+		})
+		connect := func() (db.Store, error) {
+			ormDb, err := openSQL(config)
+			if err != nil {
+				return nil, err
+			}
+			d, err := ormDb.DB()
+			if err != nil {
+				return nil, err
+			}
+			sqlMu.Lock()
+			defer sqlMu.Unlock()
+			if closed {
+				_ = d.Close()
+				return nil, errors.New("store closed")
+			}
+			sqlDb = d
+			store := sqlStore.NewStore(ormDb)
+			if config.SQL.PollInterval > 0 {
+				store.SetPollInterval(config.SQL.PollInterval)
+			}
+			return &store, nil
+		}
+		if config.Snapshot.Path == "" {
+			return connect()
 		}
-		d, err := ormDb.DB()
+
+		// 使用本地快照，数据库不可用时仍然可以启动
+		store, err := snapshot.Open(config.Snapshot.Path, connect)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		c.OnStartup(func() error {
+			store.Start(config.Snapshot.Refresh)
+			return nil
+		})
 		c.OnShutdown(func() error {
-			return d.Close()
+			store.Stop()
+			return nil
 		})
-		// SetMaxIdleConns 设置空闲连接池中连接的最大数量（默认：2）
-		d.SetMaxIdleConns(config.MySQL.MaxIdleConns)
-		// SetMaxOpenConns 设置打开数据库连接的最大数量(默认：0,无限制)
-		d.SetMaxOpenConns(config.MySQL.MaxOpenConns)
-		// SetConnMaxLifetime 设置了连接可复用的最大时间。
-		d.SetConnMaxLifetime(config.MySQL.ConnMaxLifetime)
-		store := mysql.NewStore(ormDb)
-		return &store, nil
+		return store, nil
 	}
 	return nil, nil
 }
+
+// openSQL 连接数据库并按配置设置连接池，必要时执行表结构迁移
+func openSQL(config *types.Config) (*gorm.DB, error) {
+	ormDb, err := sqlStore.Open(config.SQL.Driver, config.SQL.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ormDb.DB()
+	if err != nil {
+		return nil, err
+	}
+	// SetMaxIdleConns 设置空闲连接池中连接的最大数量（默认：2）
+	d.SetMaxIdleConns(config.SQL.MaxIdleConns)
+	// SetMaxOpenConns 设置打开数据库连接的最大数量(默认：0,无限制)
+	d.SetMaxOpenConns(config.SQL.MaxOpenConns)
+	// SetConnMaxLifetime 设置了连接可复用的最大时间。
+	d.SetConnMaxLifetime(config.SQL.ConnMaxLifetime)
+	// 自动创建或升级表结构
+	if config.SQL.AutoMigrate {
+		migrated, err := sqlStore.Migrate(ormDb)
+		if err != nil {
+			_ = d.Close()
+			return nil, err
+		}
+		if migrated > 0 {
+			log.Infof("applied %d schema migrations", migrated)
+		}
+		// 将旧版本的解析历史迁移到 history_ip 表，会删除 history 表中的记录，所以同样只在开启 autoMigrate 时执行
+		if migrated, err := sqlStore.MigrateLegacyHistory(ormDb); err != nil {
+			log.Errorf("migrate legacy history: %v", err)
+		} else if migrated > 0 {
+			log.Infof("migrated %d legacy history rows to history_ip", migrated)
+		}
+	}
+	return ormDb, nil
+}
@@ -1,10 +1,13 @@
 package pri_dns
 
 import (
+	"crypto/tls"
 	"github.com/coredns/caddy"
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
 	"github.com/laeni/pri-dns/types"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestParse(t *testing.T) {
@@ -24,11 +27,437 @@ func TestParse(t *testing.T) {
 						}`,
 			&types.Config{
 				AdminPassword: "admin",
-				StoreType:     storeTypeMySQL,
-				MySQL:         types.MySQLConfig{DataSourceName: "xx"},
+				StoreType:     storeTypeSQL,
+				SQL:           types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:           map[string]*tls.Config{},
+				HealthCheck:   types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
 			},
 			false,
 		},
+		{
+			"解析历史过期时间",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							history {
+								expire 720h
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				History:     types.HistoryConfig{Expire: 720 * time.Hour},
+			},
+			false,
+		},
+		{
+			"解析历史写入配置",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							history {
+								flush_interval 10s
+								batch_size 500
+								queue_size 5000
+								capture domain next
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				History:     types.HistoryConfig{FlushInterval: 10 * time.Second, BatchSize: 500, QueueSize: 5000, CaptureDomain: true, CaptureNext: true},
+			},
+			false,
+		},
+		{
+			"解析历史写入配置错误",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							history {
+								batch_size 0
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"不支持的解析历史来源",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							history {
+								capture upstream
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"不支持的配置-history",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							history {
+								expire -1h
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"存储异常处理策略",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							store_error last_good
+						}`,
+			&types.Config{
+				StoreType:        storeTypeSQL,
+				SQL:              types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:              map[string]*tls.Config{},
+				HealthCheck:      types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				StoreErrorPolicy: types.StoreErrorLastGood,
+			},
+			false,
+		},
+		{
+			"限速及规则数量限制",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							ratelimit {
+								forward 20 50
+								local 100
+								response truncate
+							}
+							rule_quota 200
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				RateLimit: types.RateLimitConfig{
+					Forward:  types.Rate{QPS: 20, Burst: 50},
+					Local:    types.Rate{QPS: 100, Burst: 100},
+					Response: types.RateLimitTruncate,
+				},
+				RuleQuota: 200,
+			},
+			false,
+		},
+		{
+			"访问控制",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							acl {
+								allow 192.168.0.0/16
+								allow 10.0.0.0/8
+								deny 192.168.9.0/24
+								forward 192.168.1.0/24
+								admin 127.0.0.1
+								rules 192.168.1.0/24
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				Acl: types.AclConfig{
+					Allow:   mustLoadIpSet("192.168.0.0/16", "10.0.0.0/8"),
+					Deny:    mustLoadIpSet("192.168.9.0/24"),
+					Forward: mustLoadIpSet("192.168.1.0/24"),
+					Admin:   mustLoadIpSet("127.0.0.1"),
+					Rules:   mustLoadIpSet("192.168.1.0/24"),
+				},
+			},
+			false,
+		},
+		{
+			"后台服务监听及可信代理",
+			`pri-dns {
+							serverPort unix:/run/pri-dns.sock
+							server_tls server.crt server.key ca.crt
+							trusted_proxies 127.0.0.1 10.0.0.0/8
+							proxy_protocol
+							mysql {
+								dataSourceName xx
+							}
+						}`,
+			&types.Config{
+				ServerPort:     "unix:/run/pri-dns.sock",
+				ServerTls:      types.ServerTlsConfig{CertFile: "server.crt", KeyFile: "server.key", ClientCAFile: "ca.crt"},
+				TrustedProxies: mustLoadIpSet("127.0.0.1", "10.0.0.0/8"),
+				ProxyProtocol:  true,
+				StoreType:      storeTypeSQL,
+				SQL:            types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:            map[string]*tls.Config{},
+				HealthCheck:    types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+			},
+			false,
+		},
+		{
+			"PROXY protocol 没有可信代理",
+			`pri-dns {
+							proxy_protocol
+							mysql {
+								dataSourceName xx
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"访问控制地址错误",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							acl {
+								allow 192.168.0.0/33
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"响应策略",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							response_policy ipv4 {
+								min_ttl 60
+								max_ttl 3600
+								no_aaaa
+								exclude 10.0.0.0/8 192.168.0.0/16
+								minimal
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				ResponsePolicies: map[string]types.ResponsePolicyConfig{"ipv4": {
+					MinTtl: 60, MaxTtl: 3600, NoAAAA: true, Exclude: mustLoadIpSet("10.0.0.0/8", "192.168.0.0/16"), Minimal: true,
+				}},
+			},
+			false,
+		},
+		{
+			"响应策略TTL错误",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							response_policy short {
+								min_ttl 600
+								max_ttl 60
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"响应策略重复定义",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							response_policy a {
+								no_aaaa
+							}
+							response_policy a {
+								minimal
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"限速QPS错误",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							ratelimit {
+								forward 0
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"不支持的限速响应",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							ratelimit {
+								response servfail
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"不支持的存储异常处理策略",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							store_error ignore
+						}`,
+			nil,
+			true,
+		},
+		{
+			"本地快照",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							snapshot /var/lib/coredns/pri-dns.snapshot {
+								refresh 30s
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				Snapshot:    types.SnapshotConfig{Path: "/var/lib/coredns/pri-dns.snapshot", Refresh: 30 * time.Second},
+			},
+			false,
+		},
+		{
+			"本地快照默认刷新间隔",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							snapshot /var/lib/coredns/pri-dns.snapshot
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+				Snapshot:    types.SnapshotConfig{Path: "/var/lib/coredns/pri-dns.snapshot", Refresh: time.Minute},
+			},
+			false,
+		},
+		{
+			"本地快照没有路径",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							snapshot
+						}`,
+			nil,
+			true,
+		},
+		{
+			"规则变更查询间隔",
+			`pri-dns {
+							sql {
+								driver sqlite
+								dsn /tmp/pri-dns.db
+								pollInterval 2s
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "sqlite", DataSourceName: "/tmp/pri-dns.db", ConnMaxLifetime: 10 * time.Minute, PollInterval: 2 * time.Second},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+			},
+			false,
+		},
+		{
+			"自动迁移",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+								autoMigrate
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "mysql", DataSourceName: "xx", ConnMaxLifetime: 10 * time.Minute, AutoMigrate: true},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+			},
+			false,
+		},
+		{
+			"sql-sqlite",
+			`pri-dns {
+							sql {
+								driver sqlite
+								dsn pri-dns.db
+							}
+						}`,
+			&types.Config{
+				StoreType:   storeTypeSQL,
+				SQL:         types.SQLConfig{Driver: "sqlite", DataSourceName: "pri-dns.db", ConnMaxLifetime: 10 * time.Minute},
+				Tls:         map[string]*tls.Config{},
+				HealthCheck: types.HealthCheckConfig{HcInterval: 5000 * time.Millisecond, HcDomain: "."},
+			},
+			false,
+		},
+		{
+			"sql-没有配置驱动",
+			`pri-dns {
+							sql {
+								dsn pri-dns.db
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"sql-不支持的驱动",
+			`pri-dns {
+							sql {
+								driver oracle
+								dsn xx
+							}
+						}`,
+			nil,
+			true,
+		},
+		{
+			"重复配置-存储-sql",
+			`pri-dns {
+							mysql {
+								dataSourceName xx
+							}
+							sql {
+								driver sqlite
+								dsn pri-dns.db
+							}
+						}`,
+			nil,
+			true,
+		},
 		{
 			"存在多余指令",
 			`pri-dns xx1 {
@@ -142,3 +571,11 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func mustLoadIpSet(sources ...string) *cidrMerger.IpSet {
+	set, err := cidrMerger.LoadIpSet(sources...)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
@@ -0,0 +1,56 @@
+package pri_dns
+
+import (
+	"context"
+	"github.com/coredns/coredns/request"
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/db"
+	myForward "github.com/laeni/pri-dns/forward"
+	"github.com/miekg/dns"
+)
+
+// exchange 根据转发规则的模式将请求转发给 proxies。
+// 智能模式下同时询问所有上游，优先使用IP全部属于规则指定的IP集合的应答，如果没有这样的应答则使用最先到达的成功应答
+func exchange(d *PriDns, ctx context.Context, state request.Request, forward *db.Forward, proxies []*myForward.Proxy) (*dns.Msg, error) {
+	if forward.Mode != db.ForwardModeSmart {
+		return myForward.Exchange(proxies, ctx, state)
+	}
+
+	ipSet, ok := d.Config.IpSets[forward.IpSet]
+	if !ok {
+		log.Warningf("转发规则 %d 引用了未定义的 ipset: %s，将按普通模式转发", forward.ID, forward.IpSet)
+		return myForward.Exchange(proxies, ctx, state)
+	}
+	ret, preferred, err := myForward.ExchangeParallel(proxies, ctx, state, func(ret *dns.Msg) bool {
+		return inIpSet(ipSet, ret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if preferred {
+		myForward.SmartCount.WithLabelValues("preferred").Add(1)
+	} else {
+		myForward.SmartCount.WithLabelValues("fallback").Add(1)
+	}
+	return ret, nil
+}
+
+// inIpSet 判断应答中的IP是否全部属于 ipSet，如果应答中没有IP则返回 false
+func inIpSet(ipSet *cidrMerger.IpSet, ret *dns.Msg) bool {
+	found := false
+	for _, rr := range ret.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			if !ipSet.Contains(v.A) {
+				return false
+			}
+			found = true
+		case *dns.AAAA:
+			if !ipSet.Contains(v.AAAA) {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,86 @@
+package pri_dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+)
+
+// closedUpstreams 没有DNS服务器监听的地址，转发到这些地址总是失败。
+// 不使用临时端口，以免本地的UDP套接字恰好分配到相同的端口而连接到自身
+var closedUpstreams = []string{"127.0.0.1:1", "127.0.0.1:2"}
+
+// silentUpstream 返回一个接收查询但从不应答的DNS服务器地址
+func silentUpstream(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestSmartServeDNS(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream func(t *testing.T) []string
+		want     []string // 为空表示转发失败
+	}{
+		{"优先使用属于ipset的应答", func(t *testing.T) []string {
+			// 属于 ipset 的应答较慢，也应该优先使用
+			cn, _ := stubUpstream(t, "1.2.3.4", 100*time.Millisecond)
+			other, _ := stubUpstream(t, "8.8.8.8", 0)
+			return []string{other, cn}
+		}, []string{"1.2.3.4"}},
+		{"都不属于ipset时使用最先成功的应答", func(t *testing.T) []string {
+			slow, _ := stubUpstream(t, "8.8.4.4", 100*time.Millisecond)
+			fast, _ := stubUpstream(t, "8.8.8.8", 0)
+			return []string{slow, fast}
+		}, []string{"8.8.8.8"}},
+		{"失败的上游不影响其他上游", func(t *testing.T) []string {
+			other, _ := stubUpstream(t, "8.8.8.8", 0)
+			return []string{closedUpstreams[0], other}
+		}, []string{"8.8.8.8"}},
+		{"不应答的上游不影响其他上游", func(t *testing.T) []string {
+			other, _ := stubUpstream(t, "8.8.8.8", 0)
+			return []string{silentUpstream(t), other}
+		}, []string{"8.8.8.8"}},
+		{"所有上游都失败", func(t *testing.T) []string {
+			return closedUpstreams
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := memory.NewStore()
+			if err := store.SaveRules(db.RuleChanges{CreateForwards: []db.Forward{
+				{Name: "example.com", DnsSvr: tt.upstream(t), Mode: db.ForwardModeSmart, IpSet: "cn", Enable: true},
+			}}); err != nil {
+				t.Fatal(err)
+			}
+			d := NewPriDns(&types.Config{IpSets: map[string]*cidrMerger.IpSet{"cn": mustLoadIpSet("1.0.0.0/8")}}, store)
+			defer func() { _ = d.closeFunc() }()
+
+			start := time.Now()
+			got, err := serveA(t, d)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("answer = %v, want error", got)
+				}
+				return
+			}
+			if err != nil || len(got) != 1 || got[0] != tt.want[0] {
+				t.Errorf("answer = %v, %v, want %v", got, err, tt.want)
+			}
+			// 有成功应答时不需要等待其他上游超时
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("answer took %v", elapsed)
+			}
+		})
+	}
+}
@@ -1,110 +1,251 @@
 package pri_dns
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/kataras/iris/v12"
 	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
 	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/ruleio"
+	"github.com/laeni/pri-dns/types"
+	"github.com/pires/go-proxyproto"
+	"math"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+const (
+	defaultAuditLimit = 100  // 查询审计记录时默认返回的数量
+	maxAuditLimit     = 1000 // 查询审计记录时最多返回的数量
+)
+
+// adminShutdownTimeout 停止后台服务时等待正在处理的请求完成的最长时间
+var adminShutdownTimeout = 5 * time.Second
+
+// adminServers 正在运行的后台服务，key 为监听地址。重新加载配置时新实例在旧实例关闭之前启动，
+// 所以新实例启动时先停止旧实例在同一地址上的服务以释放该地址
 var (
-	app *iris.Application // 应用程序实例
+	adminServersMu sync.Mutex
+	adminServers   = make(map[string]*adminServer)
 )
 
-// StartApp 启动服务。启动时需要 PriDns 实例来注册关闭回调钩子以及读取相关配置
-func StartApp(p *PriDns) error {
-	// 目前不支持修改应用配置
-	if app != nil {
-		return nil
-	}
-	app = newApp(p.Store)
+// adminServer 后台服务，由 PriDns 实例持有，随实例启动和关闭
+type adminServer struct {
+	config *types.Config
+	store  db.Store
 
-	var startError error
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		startError = func() error {
-			var err error
-
-			// 检测服务是否正常启动
-			go func() {
-				var healthErr error
-				for i := 0; i < 100; i++ {
-					if err != nil {
-						wg.Done()
-						return
-					}
-					resp, errRes := http.Get(fmt.Sprintf("http://127.0.0.1:%s/health", strings.Split(p.Config.ServerPort, ":")[1]))
-					if errRes == nil && (resp.StatusCode >= 200 && resp.StatusCode < 300) {
-						wg.Done()
-						return
-					}
-					healthErr = errRes
-					time.Sleep(100 * time.Millisecond)
-				}
-				log.Error("后台服务健康检查无法通过", healthErr)
-			}()
+	srv      *http.Server
+	ln       net.Listener
+	stopOnce sync.Once
+	stopErr  error
+}
+
+func newAdminServer(config *types.Config, store db.Store) *adminServer {
+	return &adminServer{config: config, store: store}
+}
 
-			err = app.Listen(p.Config.ServerPort)
+// start 启动服务。监听器创建成功后连接即可排队等待处理，所以只要监听器和应用创建成功即视为启动成功，不需要再通过请求检测服务是否可用
+func (s *adminServer) start() error {
+	// 先完成可能出错的准备工作，避免停止了旧实例的服务后才发现无法启动
+	var certs *certReloader
+	if s.config.ServerTls.CertFile != "" {
+		var err error
+		if certs, err = newCertReloader(s.config.ServerTls); err != nil {
 			return err
-		}()
+		}
+	}
+	app := newApp(s.config, s.store)
+	if err := app.Build(); err != nil {
+		return err
+	}
+
+	adminServersMu.Lock()
+	defer adminServersMu.Unlock()
+	addr := s.config.ServerPort
+	if old := adminServers[addr]; old != nil {
+		// 立即释放监听地址，旧实例正在处理的请求在后台继续完成
+		_ = old.ln.Close()
+		go func() { _ = old.shutdown() }()
+	}
+	ln, err := newAdminListener(s.config, certs)
+	if err != nil {
+		return err
+	}
+	s.srv, s.ln = &http.Server{Handler: app}, ln
+	adminServers[addr] = s
+	go func() {
+		// 停止时先关闭了监听器，所以 net.ErrClosed 也表示正常停止
+		if err := s.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			log.Errorf("admin server: %v", err)
+		}
 	}()
-	wg.Wait()
-	return startError
+	log.Infof("admin server listening on %s", addr)
+	return nil
+}
+
+// stop 停止服务并等待正在处理的请求完成，未启动时不做任何处理
+func (s *adminServer) stop() error {
+	adminServersMu.Lock()
+	if adminServers[s.config.ServerPort] == s {
+		delete(adminServers, s.config.ServerPort)
+	}
+	srv := s.srv
+	adminServersMu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return s.shutdown()
+}
+
+// shutdown 关闭监听器并等待正在处理的请求完成，可以重复调用
+func (s *adminServer) shutdown() error {
+	s.stopOnce.Do(func() {
+		_ = s.ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		s.stopErr = s.srv.Shutdown(ctx)
+	})
+	return s.stopErr
+}
+
+// unixSocketPrefix serverPort 以该前缀开头时表示监听 unix socket
+const unixSocketPrefix = "unix:"
+
+// newAdminListener 创建后台服务的监听器。配置了 proxy_protocol 时接受 PROXY protocol，certs 不为 nil 时使用 TLS
+func newAdminListener(config *types.Config, certs *certReloader) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(config.ServerPort, unixSocketPrefix); ok {
+		// 删除上次未正常退出时遗留的 socket 文件
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		ln, err = net.Listen("unix", path)
+	} else {
+		ln, err = net.Listen("tcp", config.ServerPort)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.ProxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, Policy: proxyProtocolPolicy(config.TrustedProxies)}
+	}
+	if certs != nil {
+		ln = tls.NewListener(ln, certs.tlsConfig())
+	}
+	return ln, nil
+}
+
+// degradable 为可以处于降级模式的存储，如 snapshot.Store
+type degradable interface {
+	Degraded() (bool, time.Time)
 }
 
-func newApp(store db.Store) *iris.Application {
-	app = iris.New()
+func newApp(config *types.Config, store db.Store) *iris.Application {
+	app := iris.New()
+	// 使用本地快照提供解析时（数据库不可用）返回 DEGRADED，此时 DNS 仍然可用，所以状态码依然为 200
 	app.Get("/health", func(c iris.Context) {
+		if s, ok := store.(degradable); ok {
+			if degraded, snapTime := s.Degraded(); degraded {
+				c.Header("X-Snapshot-Time", snapTime.Format(time.RFC3339))
+				_, _ = c.WriteString("DEGRADED")
+				return
+			}
+		}
 		_, _ = c.WriteString("OK")
 	})
 
 	apiParty := app.Party("/api")
 	{
-		// 获取 WireGuard 代理IP
+		// 访问控制，/health 不受限制
+		apiParty.Use(func(ctx iris.Context) {
+			if !aclAllowed(config.Acl, clientIp(config, ctx), aclAdmin) {
+				aclDeniedCount.WithLabelValues(aclAdmin).Inc()
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "当前客户端不允许访问后台接口"})
+				return
+			}
+			ctx.Next()
+		})
+
+		// 获取 WireGuard 代理IP，可以通过 format 参数指定输出格式以便直接用于路由器等设备
 		getIpLine := func(ctx iris.Context) {
-			hosts, hisExs := store.FindHistoryByHost(ctx.RemoteAddr())
+			scope := ctx.URLParamDefault("scope", db.HistoryScopeMine)
+			if scope != db.HistoryScopeMine && scope != db.HistoryScopeAll {
+				ctx.StopWithStatus(http.StatusBadRequest)
+				return
+			}
+			// halfLife 不为空时，合并时按最后解析时间对IP加权，越久未解析到的IP权重越低
+			var halfLife time.Duration
+			if v := ctx.URLParam("halfLife"); v != "" {
+				var err error
+				if halfLife, err = time.ParseDuration(v); err != nil || halfLife <= 0 {
+					ctx.StopWithStatus(http.StatusBadRequest)
+					return
+				}
+			}
+			host, ok := clientHost(config, ctx)
+			if !ok {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "只有管理员才能查询其他客户端的解析历史"})
+				return
+			}
+			his, hisExs, err := store.FindHistoryByHost(host, scope)
+			if err != nil {
+				log.Error(err)
+				ctx.StopWithJSON(http.StatusInternalServerError, iris.Map{"error": err.Error()})
+				return
+			}
+			now := time.Now()
+			if expire := config.History.Expire; expire > 0 {
+				his = filterExpiredHistory(his, now.Add(-expire))
+			}
+			weight := recencyWeight(his, now, halfLife)
+			var hostIPNets []*net.IPNet
 			{
-				// 解析IP地址
-				hostIPNets := cidrMerger.StrToIpNet(hosts)
+				// 解析IP地址，并根据 family 参数筛选地址族
+				hosts := make([]string, len(his))
+				for i, it := range his {
+					hosts[i] = it.IpNet
+				}
+				hostIPNets = cidrMerger.StrToIpNet(hosts)
+				v4, v6 := splitFamily(hostIPNets)
+				switch ctx.URLParamDefault("family", "all") {
+				case "4":
+					v6 = nil
+				case "6":
+					v4 = nil
+				case "all":
+				default:
+					ctx.StopWithStatus(http.StatusBadRequest)
+					return
+				}
 
-				// 根据版本进行合并
+				// 根据版本进行合并，IPv4 和 IPv6 分别合并
+				query := ctx.Request().URL.Query()
 				switch ctx.URLParamIntDefault("v", 2) {
 				case 1: // mask=8&level=100 & mask=12&level=50 & mask=16&level=10 & mask=24&level=1
-					query := ctx.Request().URL.Query()
-					masks, maskOk := query["mask"]    // 掩码位数. 取值为 1-32
-					levels, levelOk := query["level"] // 在一个特定的网段下（网段由具体某个IP和mask决定），如果存在的解析历史数量达到该值，则直接取该网段的网络地址
-					var arr [][2]int
-					if maskOk || levelOk {
-						if len(masks) == len(levels) { // 解析
-							for i := 0; i < len(masks); i++ {
-								mask, maskErr := strconv.Atoi(masks[i])
-								level, levelErr := strconv.Atoi(levels[i])
-								if maskErr != nil || levelErr != nil || mask < 1 || mask > 32 || level < 1 {
-									ctx.StopWithStatus(http.StatusBadRequest)
-									return
-								} else {
-									arr = append(arr, [2]int{mask, level})
-								}
-							}
-						} else { // 异常
-							ctx.StopWithStatus(http.StatusBadRequest)
-							return
-						}
-					} else {
-						//                                  256       128       64        32       16       8        4
-						arr = [][2]int{{8, 100}, {16, 50}, {24, 25}, {25, 20}, {26, 10}, {27, 5}, {28, 4}, {29, 3}, {30, 2}}
+					// mask 为掩码位数，取值为 1-32；level 表示在一个特定的网段下（网段由具体某个IP和mask决定），如果存在的解析历史数量达到该值，则直接取该网段的网络地址
+					//                                                     256       128       64        32       16       8        4
+					arr4, ok4 := parseMaskLevel(query["mask"], query["level"], 32, [][2]int{{8, 100}, {16, 50}, {24, 25}, {25, 20}, {26, 10}, {27, 5}, {28, 4}, {29, 3}, {30, 2}})
+					// IPv6 使用 mask6 和 level6，mask6 取值为 1-128
+					arr6, ok6 := parseMaskLevel(query["mask6"], query["level6"], 128, [][2]int{{32, 100}, {40, 50}, {48, 20}, {56, 5}, {64, 2}})
+					if !ok4 || !ok6 {
+						ctx.StopWithStatus(http.StatusBadRequest)
+						return
 					}
 
-					hostIPNets = mergeIpV1(hostIPNets, arr)
+					hostIPNets = append(mergeIpV1(v4, arr4, weight), mergeIpV1(v6, arr6, weight)...)
 				case 2: // level24=1 & level16=5 & level8=10
-					query := ctx.Request().URL.Query()
 					levels, levelOk := query["level"]
 					var level [3]int
 					if levelOk {
@@ -126,7 +267,7 @@ func newApp(store db.Store) *iris.Application {
 						level = [...]int{1, 3, 10}
 					}
 
-					hostIPNets = mergeIpV2(hostIPNets, level)
+					hostIPNets = append(mergeIpV2(v4, [3]int{24, 16, 8}, level, weight), mergeIpV2(v6, [3]int{64, 48, 32}, level, weight)...)
 				default:
 					ctx.StopWithStatus(http.StatusBadRequest)
 					return
@@ -140,29 +281,457 @@ func newApp(store db.Store) *iris.Application {
 				// 排序、去重
 				ipRange = cidrMerger.SortAndMerge(ipRange)
 
-				// 转为网段形式字符串
-				hosts = cidrMerger.IpNetToString(cidrMerger.IpRangeToIpNet(ipRange))
+				hostIPNets = cidrMerger.IpRangeToIpNet(ipRange)
+			}
+
+			format := ctx.URLParam("format")
+			if format == "" && strings.Contains(ctx.GetHeader("Accept"), "application/json") {
+				format = ipLineFormatJson
+			}
+			contentType, body, err := renderIpLine(format, hostIPNets, ipLineOptions{
+				name:   ctx.URLParamDefault("name", "pri_dns"),
+				table:  ctx.URLParamDefault("table", "pri_dns"),
+				policy: ctx.URLParam("policy"),
+			})
+			if err != nil {
+				ctx.StopWithJSON(http.StatusBadRequest, iris.Map{"error": err.Error()})
+				return
 			}
 
-			ctx.WriteString(strings.Join(hosts, ","))
+			// 客户端可以通过 If-None-Match 轮询，内容未变化时返回 304
+			sum := sha256.Sum256(body)
+			etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+			ctx.Header("ETag", etag)
+			if etagMatch(strings.Join(ctx.Request().Header.Values("If-None-Match"), ","), etag) {
+				ctx.StatusCode(http.StatusNotModified)
+				return
+			}
+			ctx.ContentType(contentType)
+			_, _ = ctx.Write(body)
 		}
 		apiParty.Get("/ip-line", getIpLine)
 		apiParty.Get("/ip-line.txt", getIpLine)
-		// 获取客户端IP
+		// 获取客户端IP，管理员通过 client 参数指定客户端时返回该客户端
 		apiParty.Get("/client", func(ctx iris.Context) {
-			ctx.WriteString(ctx.RemoteAddr())
+			host, ok := clientHost(config, ctx)
+			if !ok {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "只有管理员才能指定其他客户端"})
+				return
+			}
+			_, _ = ctx.WriteString(host)
+		})
+
+		// 导出规则
+		apiParty.Get("/export", func(ctx iris.Context) {
+			host, ok := ruleScope(config, ctx)
+			if !ok {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "只有管理员才能操作全局规则或其他客户端的规则"})
+				return
+			}
+			opts := ruleio.Options{Kind: ctx.URLParamDefault("type", ruleio.KindDomain), Format: ctx.URLParam("format"), Host: host}
+
+			var buf bytes.Buffer
+			skipped, err := ruleio.Export(store, opts, &buf)
+			if err != nil {
+				ctx.StopWithJSON(ruleioStatus(err), iris.Map{"error": err.Error()})
+				return
+			}
+			ctx.Header("X-Skipped-Count", strconv.Itoa(len(skipped)))
+			ctx.ContentType("text/plain")
+			_, _ = ctx.Write(buf.Bytes())
+		})
+		// 导入规则，请求体为对应格式的文件内容。dryRun=true 时只返回变更而不保存
+		apiParty.Post("/import", func(ctx iris.Context) {
+			if !rulesAllowed(config, ctx) {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "当前客户端不允许修改私有规则"})
+				return
+			}
+			host, ok := ruleScope(config, ctx)
+			if !ok {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "只有管理员才能操作全局规则或其他客户端的规则"})
+				return
+			}
+			opts := ruleio.Options{
+				Kind:    ctx.URLParamDefault("type", ruleio.KindDomain),
+				Format:  ctx.URLParam("format"),
+				Host:    host,
+				Replace: ctx.URLParamBoolDefault("replace", false),
+				DryRun:  ctx.URLParamBoolDefault("dryRun", false),
+
+				Actor:    actorOf(config, ctx),
+				ClientIp: clientIp(config, ctx),
+				Check:    ruleCheck(config, ctx, store),
+			}
+
+			result, err := ruleio.Import(store, opts, ctx.Request().Body)
+			if err != nil {
+				ctx.StopWithJSON(ruleioStatus(err), iris.Map{"error": err.Error()})
+				return
+			}
+			_ = ctx.JSON(result)
+		})
+		// 启用或禁用一条规则，规则的生效范围与 global、client 参数一致
+		apiParty.Post("/rules/enable", func(ctx iris.Context) {
+			if !rulesAllowed(config, ctx) {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "当前客户端不允许修改私有规则"})
+				return
+			}
+			host, ok := ruleScope(config, ctx)
+			if !ok {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "只有管理员才能操作全局规则或其他客户端的规则"})
+				return
+			}
+			id, err := ctx.URLParamInt64("id")
+			if err != nil {
+				ctx.StopWithJSON(http.StatusBadRequest, iris.Map{"error": "id 参数错误"})
+				return
+			}
+			enable, err := ctx.URLParamBool("enable")
+			if err != nil {
+				ctx.StopWithJSON(http.StatusBadRequest, iris.Map{"error": "enable 参数错误"})
+				return
+			}
+			found, err := setRuleEnable(store, ctx.URLParamDefault("type", ruleio.KindDomain), host, id, enable, actorOf(config, ctx), clientIp(config, ctx))
+			if err != nil {
+				ctx.StopWithJSON(ruleioStatus(err), iris.Map{"error": err.Error()})
+				return
+			}
+			if !found {
+				ctx.StopWithJSON(http.StatusNotFound, iris.Map{"error": "规则不存在"})
+				return
+			}
+			_ = ctx.JSON(iris.Map{"id": id, "enable": enable})
+		})
+		// 查询规则的审计记录，按时间倒序排列。指定 type 和 ruleId 时即为该规则的版本历史
+		apiParty.Get("/audit", func(ctx iris.Context) {
+			filter, status, err := auditFilter(config, ctx)
+			if err != nil {
+				ctx.StopWithJSON(status, iris.Map{"error": err.Error()})
+				return
+			}
+			logs, err := store.FindAudit(filter)
+			if err != nil {
+				ctx.StopWithJSON(http.StatusInternalServerError, iris.Map{"error": err.Error()})
+				return
+			}
+			if logs == nil {
+				logs = []db.AuditLog{}
+			}
+			_ = ctx.JSON(logs)
+		})
+		// 将规则恢复到审计记录 id 对应的版本，即该次变更之后的状态
+		apiParty.Post("/audit/revert", func(ctx iris.Context) {
+			if !rulesAllowed(config, ctx) {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "当前客户端不允许修改私有规则"})
+				return
+			}
+			id, err := ctx.URLParamInt64("id")
+			if err != nil {
+				ctx.StopWithJSON(http.StatusBadRequest, iris.Map{"error": "id 参数错误"})
+				return
+			}
+			status, err := revertAudit(store, id, func(host string) bool {
+				return host == clientIp(config, ctx) || isAdmin(config, ctx)
+			}, ruleCheck(config, ctx, store), actorOf(config, ctx), clientIp(config, ctx))
+			if err != nil {
+				ctx.StopWithJSON(status, iris.Map{"error": err.Error()})
+				return
+			}
+			_ = ctx.JSON(iris.Map{"id": id})
+		})
+		// 清理过期的解析历史，expire 为空时使用配置的过期时间
+		apiParty.Post("/history/prune", func(ctx iris.Context) {
+			if !isAdmin(config, ctx) {
+				ctx.StopWithJSON(http.StatusForbidden, iris.Map{"error": "只有管理员才能清理解析历史"})
+				return
+			}
+			expire := config.History.Expire
+			if v := ctx.URLParam("expire"); v != "" {
+				var err error
+				if expire, err = time.ParseDuration(v); err != nil {
+					ctx.StopWithJSON(http.StatusBadRequest, iris.Map{"error": err.Error()})
+					return
+				}
+			}
+			if expire <= 0 {
+				ctx.StopWithJSON(http.StatusBadRequest, iris.Map{"error": "没有指定过期时间"})
+				return
+			}
+			removed, err := store.PruneHistory(time.Now().Add(-expire))
+			if err != nil {
+				ctx.StopWithJSON(http.StatusInternalServerError, iris.Map{"error": err.Error()})
+				return
+			}
+			_ = ctx.JSON(iris.Map{"removed": removed})
 		})
 	}
 
 	return app
 }
 
-// 从网段中排除指定网段，比如排除私有地址或者指定地址
+// isAdmin 判断请求者是否为管理员。管理员需要通过请求头 X-Admin-Password 或参数 password 提供 adminPassword，未配置 adminPassword 时没有管理员
+func isAdmin(config *types.Config, ctx iris.Context) bool {
+	if config.AdminPassword == "" {
+		return false
+	}
+	password := ctx.GetHeader("X-Admin-Password")
+	if password == "" {
+		password = ctx.URLParam("password")
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(config.AdminPassword)) == 1
+}
+
+// rulesAllowed 判断请求者能否修改规则，管理员不受访问控制中 rules 的限制
+func rulesAllowed(config *types.Config, ctx iris.Context) bool {
+	if isAdmin(config, ctx) || aclAllowed(config.Acl, clientIp(config, ctx), aclRules) {
+		return true
+	}
+	aclDeniedCount.WithLabelValues(aclRules).Inc()
+	return false
+}
+
+// ruleioStatus 返回导入导出出错时的响应状态码，存储异常为 500，超出规则数量限制为 403，其他为 400
+func ruleioStatus(err error) int {
+	if errors.Is(err, ruleio.ErrStore) {
+		return http.StatusInternalServerError
+	}
+	if errors.Is(err, errRuleQuota) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// actorOf 返回记录到审计记录中的操作者：管理员为 "admin"，可以通过请求头 X-Actor 指定具体的名称，如 "admin:alice"；其他为 "client"
+func actorOf(config *types.Config, ctx iris.Context) string {
+	if !isAdmin(config, ctx) {
+		return "client"
+	}
+	if name := ctx.GetHeader("X-Actor"); name != "" {
+		return "admin:" + name
+	}
+	return "admin"
+}
+
+// auditFilter 根据请求参数生成审计记录的查询条件。生效范围与 ruleScope 相同，管理员还可以通过 all=true 查询所有生效范围
+func auditFilter(config *types.Config, ctx iris.Context) (filter db.AuditFilter, status int, err error) {
+	if !(ctx.URLParamBoolDefault("all", false) && isAdmin(config, ctx)) {
+		host, ok := ruleScope(config, ctx)
+		if !ok {
+			return filter, http.StatusForbidden, errors.New("只有管理员才能查询全局规则或其他客户端的规则")
+		}
+		filter.ClientHost = &host
+	}
+	filter.RuleType = ctx.URLParam("type")
+	filter.RuleId = ctx.URLParamInt64Default("ruleId", 0)
+	filter.Actor = ctx.URLParam("actor")
+	filter.ClientIp = ctx.URLParam("clientIp")
+	for _, it := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if v := ctx.URLParam(it.name); v != "" {
+			if *it.dst, err = time.Parse(time.RFC3339, v); err != nil {
+				return filter, http.StatusBadRequest, fmt.Errorf("%s 参数错误: %v", it.name, err)
+			}
+		}
+	}
+	filter.Limit = ctx.URLParamIntDefault("limit", defaultAuditLimit)
+	if filter.Limit <= 0 || filter.Limit > maxAuditLimit {
+		return filter, http.StatusBadRequest, fmt.Errorf("limit 取值范围为 1-%d", maxAuditLimit)
+	}
+	return filter, http.StatusOK, nil
+}
+
+// setRuleEnable 修改生效范围为 host 的规则 id 的启用状态，kind 为 ruleio.KindDomain 或 ruleio.KindForward。
+// 规则不存在时 found 为 false，存储出错时返回的错误包装了 ruleio.ErrStore
+func setRuleEnable(store db.Store, kind, host string, id int64, enable bool, actor, clientIp string) (found bool, err error) {
+	changes := db.RuleChanges{Actor: actor, ClientIp: clientIp}
+	switch kind {
+	case ruleio.KindDomain:
+		domains, err := store.FindDomainByHost(host)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ruleio.ErrStore, err)
+		}
+		for _, it := range domains {
+			if it.ID == id && it.ClientHost == host {
+				it.Enable = enable
+				changes.UpdateDomains = append(changes.UpdateDomains, it)
+			}
+		}
+	case ruleio.KindForward:
+		forwards, err := store.FindForwardByHost(host)
+		if err != nil {
+			return false, fmt.Errorf("%w: %v", ruleio.ErrStore, err)
+		}
+		for _, it := range forwards {
+			if it.ID == id && it.ClientHost == host {
+				it.Enable = enable
+				changes.UpdateForwards = append(changes.UpdateForwards, it)
+			}
+		}
+	default:
+		return false, fmt.Errorf("unknown rule type: %s", kind)
+	}
+	if len(changes.UpdateDomains) == 0 && len(changes.UpdateForwards) == 0 {
+		return false, nil
+	}
+	if err := store.SaveRules(changes); err != nil {
+		return false, fmt.Errorf("%w: %v", ruleio.ErrStore, err)
+	}
+	return true, nil
+}
+
+// revertAudit 将规则恢复到审计记录 id 对应的版本，allowed 判断请求者能否操作生效范围为 host 的规则，check 不为 nil 时在保存前检查变更。
+// 出错时返回对应的响应状态码
+func revertAudit(store db.Store, id int64, allowed func(host string) bool, check func(db.RuleChanges) error, actor, clientIp string) (int, error) {
+	logs, err := store.FindAudit(db.AuditFilter{ID: id})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if len(logs) == 0 {
+		return http.StatusNotFound, errors.New("审计记录不存在")
+	}
+	// 规则的生效范围可能在之后的变更中被修改，所以同时检查规则当前的生效范围
+	latest, err := store.FindAudit(db.AuditFilter{RuleType: logs[0].RuleType, RuleId: logs[0].RuleId, Limit: 1})
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !allowed(logs[0].ClientHost) || !allowed(latest[0].ClientHost) {
+		return http.StatusForbidden, errors.New("只有管理员才能操作全局规则或其他客户端的规则")
+	}
+	changes, err := db.RevertChanges(store, logs[0])
+	if err != nil {
+		if errors.Is(err, db.ErrNotRevertible) {
+			return http.StatusBadRequest, err
+		}
+		return http.StatusInternalServerError, err
+	}
+	if check != nil {
+		if err := check(changes); err != nil {
+			return ruleioStatus(err), err
+		}
+	}
+	changes.Actor, changes.ClientIp = actor, clientIp
+	if err := store.SaveRules(changes); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// ruleCheck 返回保存变更前的检查函数：检查规则的生效时间段格式、引用的响应策略，以及是否超出私有规则数量限制
+func ruleCheck(config *types.Config, ctx iris.Context, store db.Store) func(db.RuleChanges) error {
+	quotaCheck := ruleQuotaCheck(config, ctx, store)
+	return func(changes db.RuleChanges) error {
+		if err := db.CheckSchedule(changes); err != nil {
+			return err
+		}
+		if err := checkPolicy(config.ResponsePolicies, changes); err != nil {
+			return err
+		}
+		if quotaCheck != nil {
+			return quotaCheck(changes)
+		}
+		return nil
+	}
+}
+
+// errRuleQuota 表示保存变更后客户端的私有规则数量将超出 rule_quota
+var errRuleQuota = errors.New("超出私有规则数量限制")
+
+// ruleQuotaCheck 返回检查变更是否超出私有规则数量限制的函数，管理员或者没有配置限制时返回 nil
+func ruleQuotaCheck(config *types.Config, ctx iris.Context, store db.Store) func(db.RuleChanges) error {
+	if config.RuleQuota <= 0 || isAdmin(config, ctx) {
+		return nil
+	}
+	return func(changes db.RuleChanges) error {
+		return checkRuleQuota(store, config.RuleQuota, changes)
+	}
+}
+
+// checkRuleQuota 检查保存 changes 后每个客户端的私有规则（解析记录和转发规则）数量是否超出 quota，只检查规则数量增加的客户端
+func checkRuleQuota(store db.Store, quota int, changes db.RuleChanges) error {
+	delta := make(map[string]int)
+	for _, it := range changes.CreateDomains {
+		delta[it.ClientHost]++
+	}
+	for _, it := range changes.DeleteDomains {
+		delta[it.ClientHost]--
+	}
+	for _, it := range changes.CreateForwards {
+		delta[it.ClientHost]++
+	}
+	for _, it := range changes.DeleteForwards {
+		delta[it.ClientHost]--
+	}
+	for host, n := range delta {
+		if host == "" || n <= 0 {
+			continue
+		}
+		domains, err := store.FindDomainByHost(host)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ruleio.ErrStore, err)
+		}
+		forwards, err := store.FindForwardByHost(host)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ruleio.ErrStore, err)
+		}
+		if count := len(domains) + len(forwards) + n; count > quota {
+			return fmt.Errorf("%w: %s 保存后将有 %d 条规则，最多 %d 条", errRuleQuota, host, count, quota)
+		}
+	}
+	return nil
+}
+
+// ruleScope 根据请求参数确定规则的生效范围：global=true 表示全局规则，client 表示指定客户端的规则，默认为请求者自己的规则。
+// 只有管理员才能操作全局规则或其他客户端的规则，此时 ok 为 false
+func ruleScope(config *types.Config, ctx iris.Context) (host string, ok bool) {
+	if ctx.URLParamBoolDefault("global", false) {
+		return "", isAdmin(config, ctx)
+	}
+	return clientHost(config, ctx)
+}
+
+// clientHost 返回请求对应的客户端：默认为请求者的IP，管理员可以通过 client 参数指定其他客户端，非管理员指定其他客户端时 ok 为 false
+func clientHost(config *types.Config, ctx iris.Context) (host string, ok bool) {
+	ip := clientIp(config, ctx)
+	host = ctx.URLParamDefault("client", ip)
+	if host != ip {
+		return host, isAdmin(config, ctx)
+	}
+	return host, true
+}
+
+// parseMaskLevel 解析成对出现的 mask 和 level 参数，mask 取值为 1-maxMask。如果没有指定参数则返回默认值 def
+func parseMaskLevel(masks, levels []string, maxMask int, def [][2]int) ([][2]int, bool) {
+	if len(masks) == 0 && len(levels) == 0 {
+		return def, true
+	}
+	if len(masks) != len(levels) {
+		return nil, false
+	}
+	arr := make([][2]int, 0, len(masks))
+	for i := 0; i < len(masks); i++ {
+		mask, maskErr := strconv.Atoi(masks[i])
+		level, levelErr := strconv.Atoi(levels[i])
+		if maskErr != nil || levelErr != nil || mask < 1 || mask > maxMask || level < 1 {
+			return nil, false
+		}
+		arr = append(arr, [2]int{mask, level})
+	}
+	return arr, true
+}
+
+// 从网段中排除指定网段，比如排除私有地址或者指定地址。不同地址族的网段互不影响
 func excludeIpRange(irs []*cidrMerger.Range, exs []*cidrMerger.Range) []*cidrMerger.Range {
+	if len(exs) == 0 {
+		return irs
+	}
 	irsTmp := make([]*cidrMerger.Range, 0, len(irs))
 	for i, exRange := range exs {
 		for _, irRange := range irs {
-			if isIpBefore(irRange.Start, exRange.Start) && isIpBefore(exRange.End, irRange.End) {
+			if !isSameFamily(irRange.Start, exRange.Start) {
+				irsTmp = append(irsTmp, irRange)
+			} else if isIpBefore(irRange.Start, exRange.Start) && isIpBefore(exRange.End, irRange.End) {
 				// ` |irRange.Start          |irRange.End
 				// `     |exRange.Start  |exRange.End
 				irsTmp = append(irsTmp, &cidrMerger.Range{Start: irRange.Start, End: ipMinusOne(exRange.Start)})
@@ -192,6 +761,11 @@ func excludeIpRange(irs []*cidrMerger.Range, exs []*cidrMerger.Range) []*cidrMer
 	return irsTmp
 }
 
+// isSameFamily 判断 a 和 b 是否为同一地址族
+func isSameFamily(a, b net.IP) bool {
+	return (a.To4() == nil) == (b.To4() == nil)
+}
+
 func isIpBefore(a, b net.IP) bool {
 	l := len(a)
 	if l != len(b) {
@@ -207,6 +781,7 @@ func isIpBefore(a, b net.IP) bool {
 				panic("只支持同种类型的IP进行比较")
 			}
 		}
+		l = len(a)
 	}
 	for i := 0; i < l; i++ {
 		if a[i] == b[i] {
@@ -253,67 +828,60 @@ func ipMinusOne(ip net.IP) net.IP {
 	return tmp
 }
 
-// mergeIpV1 V1版本的合并规则，明确通过指定将达到指定数量的原始IP进行合并，
+// mergeIpV1 V1版本的合并规则，明确通过指定将达到指定数量的原始IP进行合并，hostIPNets 必须为同一地址族，
 // 比如 'mask=16&level=10' 表示如果存在10个ip在16位掩码时的网络地址相同，则用16位掩码的网络地址表示它们。
 // mask和level可以出现多次，且必须成对出现，当出现多次时，分别用他们和原始IP进行计算，并将每次得到的结果在最后进行合并。
 // pri 参数表示默认情况下是否需要过滤掉内网IP
-func mergeIpV1(hostIPNets []*net.IPNet, arr [][2]int) []*net.IPNet {
+func mergeIpV1(hostIPNets []*net.IPNet, arr [][2]int, weight ipWeight) []*net.IPNet {
 	dst := make([]*net.IPNet, 0, len(hostIPNets)*len(arr))
 	for _, it := range arr {
-		dst = append(dst, mergeIpByMaskAndLevel(hostIPNets, it[0], it[1])...)
+		dst = append(dst, mergeIpByMaskAndLevel(hostIPNets, it[0], it[1], weight)...)
 	}
 	return dst
 }
 
-// mergeIpV2 对IP进行简单合并，合并分为3步：
+// mergeIpV2 对IP进行简单合并，合并分为3步（以 IPv4 为例，此时 masks 为 [24, 16, 8]）：
 // 第1步，对原始数据进行合并，合并规则和版本1一样，但此步骤中明确指定mask为24，level值为第1个level参数的值
 // 第2步，合并规则和第1步一样，但此步骤的输入数据不再是原始IP，而是第1步中生成的结果，且明确指定mask为16，level值为第2个level参数的值
 // 第3步，再次重复第2步，此步骤的输入数据也不是原始IP，而是第2步中生成的结果，且明确指定mask为8，level值为第3个level参数的值。此步骤得到的结果为最终结果
-func mergeIpV2(hostIPNets []*net.IPNet, level [3]int) []*net.IPNet {
+// hostIPNets 必须为同一地址族，IPv6 的 masks 一般为 [64, 48, 32]
+func mergeIpV2(hostIPNets []*net.IPNet, masks [3]int, level [3]int, weight ipWeight) []*net.IPNet {
 	// 从第2步开始，需要把不符合进入下一步的数据筛选出来
 	other := make([]*net.IPNet, 0, len(hostIPNets))
 
 	// 第1步
-	hostIPNets = mergeIpByMaskAndLevel(hostIPNets, 24, level[0])
-
-	// 第2步
-	i := 0
-	for _, hostIPNet := range hostIPNets {
-		maskSize, _ := hostIPNet.Mask.Size()
-		if maskSize > 24 {
-			other = append(other, hostIPNet)
-		} else {
-			hostIPNets[i] = hostIPNet
-			i++
-		}
-	}
-	hostIPNets = mergeIpByMaskAndLevel(hostIPNets[:i], 16, level[1])
-
-	// 第3步
-	i = 0
-	for _, hostIPNet := range hostIPNets {
-		maskSize, _ := hostIPNet.Mask.Size()
-		if maskSize > 16 {
-			other = append(other, hostIPNet)
-		} else {
-			hostIPNets[i] = hostIPNet
-			i++
+	hostIPNets = mergeIpByMaskAndLevel(hostIPNets, masks[0], level[0], weight)
+
+	// 第2步、第3步
+	for step := 1; step < 3; step++ {
+		i := 0
+		for _, hostIPNet := range hostIPNets {
+			maskSize, _ := hostIPNet.Mask.Size()
+			if maskSize > masks[step-1] {
+				other = append(other, hostIPNet)
+			} else {
+				hostIPNets[i] = hostIPNet
+				i++
+			}
 		}
+		hostIPNets = mergeIpByMaskAndLevel(hostIPNets[:i], masks[step], level[step], weight)
 	}
-	hostIPNets = mergeIpByMaskAndLevel(hostIPNets[:i], 8, level[1])
 
 	return append(hostIPNets, other...)
 }
 
-func mergeIpByMaskAndLevel(hosts []*net.IPNet, mask, level int) []*net.IPNet {
+// mergeIpByMaskAndLevel 如果 hosts 中有 level 个及以上的网段属于同一个掩码位数为 mask 的网段，则用该网段代替它们。
+// weight 不为空时，每个网段按其权重计数，即权重之和达到 level 时才进行合并。
+// hosts 必须为同一地址族
+func mergeIpByMaskAndLevel(hosts []*net.IPNet, mask, level int, weight ipWeight) []*net.IPNet {
 	l := len(hosts)
 
 	ipNets := make([]*net.IPNet, l) // 目标网络地址
 	j := 0
 	for _, host := range hosts {
-		size, _ := host.Mask.Size()
+		size, bits := host.Mask.Size()
 		if mask < size {
-			mask := net.CIDRMask(mask, 8*net.IPv4len)
+			mask := net.CIDRMask(mask, bits)
 			tarIpNet := &net.IPNet{IP: host.IP.Mask(mask), Mask: mask}
 			ipNets[j] = tarIpNet
 			j++
@@ -345,7 +913,7 @@ func mergeIpByMaskAndLevel(hosts []*net.IPNet, mask, level int) []*net.IPNet {
 	dst := make([]*net.IPNet, 0, j)
 	for netKey, nets := range ipMap {
 		if nets != nil {
-			if len(nets) >= level {
+			if weight.sum(nets) >= float64(level) {
 				_, ipNet, _ := net.ParseCIDR(netKey)
 				dst = append(dst, ipNet)
 			} else {
@@ -358,3 +926,59 @@ func mergeIpByMaskAndLevel(hosts []*net.IPNet, mask, level int) []*net.IPNet {
 
 	return dst
 }
+
+// ipWeight 表示网段在合并时的权重，为 nil 时每个网段的权重均为 1
+type ipWeight func(ipNet *net.IPNet) float64
+
+func (w ipWeight) sum(nets []*net.IPNet) float64 {
+	if w == nil {
+		return float64(len(nets))
+	}
+	var sum float64
+	for _, it := range nets {
+		sum += w(it)
+	}
+	return sum
+}
+
+// recencyWeight 根据最后解析时间计算权重，权重每经过 halfLife 减半。
+// 网段的权重为其包含的解析历史中的最大权重，所以已经合并的网段仍然按 1 个计数。halfLife 为 0 时返回 nil
+func recencyWeight(his []db.HistoryIp, now time.Time, halfLife time.Duration) ipWeight {
+	if halfLife <= 0 {
+		return nil
+	}
+	ips := make([]net.IP, 0, len(his))
+	weights := make([]float64, 0, len(his))
+	for _, it := range his {
+		ipNets := cidrMerger.StrToIpNet([]string{it.IpNet})
+		if len(ipNets) == 0 {
+			continue
+		}
+		age := now.Sub(it.LastSeen)
+		if age < 0 {
+			age = 0
+		}
+		ips = append(ips, ipNets[0].IP)
+		weights = append(weights, math.Pow(0.5, float64(age)/float64(halfLife)))
+	}
+	return func(ipNet *net.IPNet) float64 {
+		var w float64
+		for i, ip := range ips {
+			if weights[i] > w && ipNet.Contains(ip) {
+				w = weights[i]
+			}
+		}
+		return w
+	}
+}
+
+// filterExpiredHistory 去除最后解析时间早于 before 的解析历史
+func filterExpiredHistory(his []db.HistoryIp, before time.Time) []db.HistoryIp {
+	dst := make([]db.HistoryIp, 0, len(his))
+	for _, it := range his {
+		if !it.LastSeen.Before(before) {
+			dst = append(dst, it)
+		}
+	}
+	return dst
+}
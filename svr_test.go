@@ -1,10 +1,21 @@
 package pri_dns
 
 import (
+	"encoding/json"
 	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/ruleio"
+	"github.com/laeni/pri-dns/types"
+	"github.com/laeni/pri-dns/util"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_isIpBefore(t *testing.T) {
@@ -135,26 +146,495 @@ func Test_excludeIpRange(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "从IPv6网段中排除网段",
+			args: args{
+				irs: []cidrMerger.IRange{mustParse("2001:db8::/32")},
+				exs: []cidrMerger.IRange{mustParse("2001:db8::/33")},
+			},
+			want: []cidrMerger.IRange{mustParse("2001:db8:8000::/33")},
+		},
+		{
+			name: "不同地址族的网段互不影响",
+			args: args{
+				irs: []cidrMerger.IRange{mustParse("1.2.3.0/24"), mustParse("2001:db8::/32")},
+				exs: []cidrMerger.IRange{mustParse("1.2.3.0/25"), mustParse("2001:db9::/32")},
+			},
+			want: []cidrMerger.IRange{mustParse("1.2.3.128/25"), mustParse("2001:db8::/32")},
+		},
+		{
+			name: "没有需要排除的网段",
+			args: args{
+				irs: []cidrMerger.IRange{mustParse("1.2.3.0/24")},
+				exs: nil,
+			},
+			want: []cidrMerger.IRange{mustParse("1.2.3.0/24")},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := excludeIpRange(tt.args.irs, tt.args.exs); !iRangeEqual(got, tt.want) {
+			if got := excludeIpRange(toRanges(tt.args.irs), toRanges(tt.args.exs)); !iRangeEqual(got, toRanges(tt.want)) {
 				t.Errorf("excludeIpRange() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func iRangeEqual(a, b []cidrMerger.IRange) bool {
+func toRanges(irs []cidrMerger.IRange) []*cidrMerger.Range {
+	ranges := make([]*cidrMerger.Range, len(irs))
+	for i, ir := range irs {
+		ranges[i] = ir.ToRange()
+	}
+	return ranges
+}
+
+func iRangeEqual(a, b []*cidrMerger.Range) bool {
 	if len(a) != len(b) {
 		return false
 	}
 	for i := 0; i < len(a); i++ {
-		aRange := a[i].ToRange()
-		bRange := b[i].ToRange()
+		aRange := a[i]
+		bRange := b[i]
 		if !aRange.Start.Equal(bRange.Start) || !aRange.End.Equal(bRange.End) {
 			return false
 		}
 	}
 	return true
 }
+
+func mustParse(text string) cidrMerger.IRange {
+	r, err := cidrMerger.Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func Test_mergeIpByMaskAndLevel(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []string
+		mask  int
+		level int
+		want  []string
+	}{
+		{
+			name:  "IPv4 达到数量后合并",
+			hosts: []string{"1.2.3.4", "1.2.3.5", "1.2.4.1"},
+			mask:  24,
+			level: 2,
+			want:  []string{"1.2.3.0/24", "1.2.4.1/32"},
+		},
+		{
+			name:  "IPv6 达到数量后合并",
+			hosts: []string{"2001:db8::1", "2001:db8::2", "2001:db9::1"},
+			mask:  64,
+			level: 2,
+			want:  []string{"2001:db8::/64", "2001:db9::1/128"},
+		},
+		{
+			name:  "IPv6 未达到数量",
+			hosts: []string{"2001:db8::1", "2001:db8:0:2::1"},
+			mask:  64,
+			level: 2,
+			want:  []string{"2001:db8::1/128", "2001:db8:0:2::1/128"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cidrMerger.IpNetToString(mergeIpByMaskAndLevel(cidrMerger.StrToIpNet(tt.hosts), tt.mask, tt.level, nil))
+			if !util.SliceEqual(got, tt.want) {
+				t.Errorf("mergeIpByMaskAndLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mergeIpV2(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []string
+		masks [3]int
+		level [3]int
+		want  []string
+	}{
+		{
+			name:  "IPv4",
+			hosts: []string{"1.2.3.4", "1.2.4.4", "1.3.3.4", "9.9.9.9"},
+			masks: [3]int{24, 16, 8},
+			level: [3]int{1, 2, 2},
+			want:  []string{"1.2.0.0/15", "9.9.9.0/24"},
+		},
+		{
+			name:  "IPv6",
+			hosts: []string{"2001:db8::1", "2001:db8:1::1", "2001:db8:1::2", "2400:cb00::1"},
+			masks: [3]int{64, 48, 32},
+			level: [3]int{2, 1, 2},
+			want:  []string{"2001:db8:1::/48", "2001:db8::1/128", "2400:cb00::1/128"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cidrMerger.IpNetToString(mergeIpV2(cidrMerger.StrToIpNet(tt.hosts), tt.masks, tt.level, nil))
+			if !util.SliceEqual(got, tt.want) {
+				t.Errorf("mergeIpV2() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_recencyWeight(t *testing.T) {
+	now := time.Now()
+	his := []db.HistoryIp{
+		{IpNet: "1.2.3.4", LastSeen: now},
+		{IpNet: "1.2.3.5", LastSeen: now},
+		{IpNet: "1.2.4.1", LastSeen: now.Add(-30 * 24 * time.Hour)},
+		{IpNet: "1.2.4.2", LastSeen: now.Add(-30 * 24 * time.Hour)},
+	}
+	hosts := cidrMerger.StrToIpNet([]string{"1.2.3.4", "1.2.3.5", "1.2.4.1", "1.2.4.2"})
+
+	tests := []struct {
+		name     string
+		halfLife time.Duration
+		want     []string
+	}{
+		{
+			name:     "不加权",
+			halfLife: 0,
+			want:     []string{"1.2.3.0/24", "1.2.4.0/24"},
+		},
+		{
+			name:     "长时间未解析到的IP不足以合并",
+			halfLife: 24 * time.Hour,
+			want:     []string{"1.2.3.0/24", "1.2.4.1/32", "1.2.4.2/32"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weight := recencyWeight(his, now, tt.halfLife)
+			got := cidrMerger.IpNetToString(mergeIpByMaskAndLevel(hosts, 24, 2, weight))
+			if !util.SliceEqual(got, tt.want) {
+				t.Errorf("mergeIpByMaskAndLevel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_filterExpiredHistory(t *testing.T) {
+	now := time.Now()
+	his := []db.HistoryIp{
+		{IpNet: "1.2.3.4", LastSeen: now},
+		{IpNet: "1.2.3.5", LastSeen: now.Add(-48 * time.Hour)},
+	}
+	got := filterExpiredHistory(his, now.Add(-24*time.Hour))
+	if len(got) != 1 || got[0].IpNet != "1.2.3.4" {
+		t.Errorf("filterExpiredHistory() = %v", got)
+	}
+}
+
+func Test_setRuleEnable(t *testing.T) {
+	store := memory.NewStore()
+	err := store.SaveRules(db.RuleChanges{
+		CreateDomains:  []db.Domain{{ClientHost: "192.168.1.2", Name: "example.com", Value: "10.0.0.1", DnsType: "A", Enable: true}},
+		CreateForwards: []db.Forward{{Name: "example.com", DnsSvr: []string{"8.8.8.8"}, Enable: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, _ := store.FindDomainByHost("192.168.1.2")
+	forwards, _ := store.FindForwardByHost("")
+
+	tests := []struct {
+		name      string
+		kind      string
+		host      string
+		id        int64
+		wantFound bool
+		wantErr   bool
+	}{
+		{"禁用解析", ruleio.KindDomain, "192.168.1.2", domains[0].ID, true, false},
+		{"禁用转发", ruleio.KindForward, "", forwards[0].ID, true, false},
+		{"其他客户端的规则", ruleio.KindDomain, "192.168.1.3", domains[0].ID, false, false},
+		{"规则不存在", ruleio.KindForward, "", forwards[0].ID + 100, false, false},
+		{"类型错误", "history", "", forwards[0].ID, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := setRuleEnable(store, tt.kind, tt.host, tt.id, false, "admin", "127.0.0.1")
+			if (err != nil) != tt.wantErr || found != tt.wantFound {
+				t.Errorf("setRuleEnable() = %v, %v, want %v", found, err, tt.wantFound)
+			}
+		})
+	}
+
+	domains, _ = store.FindDomainByHost("192.168.1.2")
+	forwards, _ = store.FindForwardByHost("")
+	if domains[0].Enable || forwards[0].Enable {
+		t.Errorf("rules still enabled: %+v, %+v", domains[0], forwards[0])
+	}
+}
+
+func Test_revertAudit(t *testing.T) {
+	store := memory.NewStore()
+	d := db.Domain{ClientHost: "192.168.1.2", Name: "example.com", Value: "10.0.0.1", DnsType: "A", Enable: true}
+	if err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{d}}); err != nil {
+		t.Fatal(err)
+	}
+	d = mustFindDomain(t, store, "192.168.1.2")
+	d.Value = "10.0.0.2"
+	if err := store.SaveRules(db.RuleChanges{UpdateDomains: []db.Domain{d}}); err != nil {
+		t.Fatal(err)
+	}
+	logs, _ := store.FindAudit(db.AuditFilter{RuleType: db.RuleTypeDomain, RuleId: d.ID})
+	create := logs[len(logs)-1]
+
+	owner := func(host string) bool { return host == "192.168.1.2" }
+	other := func(host string) bool { return host == "192.168.1.3" }
+	if status, _ := revertAudit(store, create.ID+100, owner, nil, "client", "192.168.1.2"); status != http.StatusNotFound {
+		t.Errorf("revertAudit(not exist) = %d, want 404", status)
+	}
+	if status, _ := revertAudit(store, create.ID, other, nil, "client", "192.168.1.3"); status != http.StatusForbidden {
+		t.Errorf("revertAudit(other) = %d, want 403", status)
+	}
+	if status, err := revertAudit(store, create.ID, owner, nil, "client", "192.168.1.2"); status != http.StatusOK {
+		t.Fatalf("revertAudit(owner) = %d, %v", status, err)
+	}
+	if got := mustFindDomain(t, store, "192.168.1.2"); got.Value != "10.0.0.1" {
+		t.Errorf("domain after revert = %+v", got)
+	}
+	logs, _ = store.FindAudit(db.AuditFilter{RuleType: db.RuleTypeDomain, RuleId: d.ID, Limit: 1})
+	if logs[0].Actor != "client" || logs[0].ClientIp != "192.168.1.2" {
+		t.Errorf("revert audit log = %+v", logs[0])
+	}
+}
+
+// 恢复到生效时间段格式有误的版本时拒绝保存
+func Test_revertAudit_invalidSchedule(t *testing.T) {
+	store := memory.NewStore()
+	d := db.Domain{Name: "example.com", Value: "10.0.0.1", DnsType: "A", Enable: true, Schedule: "Mon 9:00-18:00"}
+	if err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{d}}); err != nil {
+		t.Fatal(err)
+	}
+	d = mustFindDomain(t, store, "")
+	d.Schedule = "Mon 09:00-18:00"
+	if err := store.SaveRules(db.RuleChanges{UpdateDomains: []db.Domain{d}}); err != nil {
+		t.Fatal(err)
+	}
+	logs, _ := store.FindAudit(db.AuditFilter{RuleType: db.RuleTypeDomain, RuleId: d.ID})
+
+	admin := func(string) bool { return true }
+	if status, err := revertAudit(store, logs[len(logs)-1].ID, admin, db.CheckSchedule, "admin", "127.0.0.1"); status != http.StatusBadRequest {
+		t.Errorf("revertAudit() = %d, %v, want 400", status, err)
+	}
+	if got := mustFindDomain(t, store, ""); got.Schedule != d.Schedule {
+		t.Errorf("schedule = %q, want %q", got.Schedule, d.Schedule)
+	}
+}
+
+func mustFindDomain(t *testing.T, store db.Store, host string) db.Domain {
+	t.Helper()
+	domains, err := store.FindDomainByHost(host)
+	if err != nil || len(domains) != 1 {
+		t.Fatalf("FindDomainByHost() = %+v, %v", domains, err)
+	}
+	return domains[0]
+}
+
+func Test_checkRuleQuota(t *testing.T) {
+	store := memory.NewStore()
+	err := store.SaveRules(db.RuleChanges{
+		CreateDomains:  []db.Domain{{ClientHost: "192.168.1.2", Name: "a.example.com", Value: "10.0.0.1", DnsType: "A", Enable: true}},
+		CreateForwards: []db.Forward{{ClientHost: "192.168.1.2", Name: "*.example.org", DnsSvr: []string{"8.8.8.8"}, Enable: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, _ := store.FindDomainByHost("192.168.1.2")
+	newDomain := db.Domain{ClientHost: "192.168.1.2", Name: "b.example.com", Value: "10.0.0.2", DnsType: "A", Enable: true}
+
+	tests := []struct {
+		name    string
+		changes db.RuleChanges
+		wantErr bool
+	}{
+		{"未超出", db.RuleChanges{CreateDomains: []db.Domain{newDomain}}, false},
+		{"超出", db.RuleChanges{CreateDomains: []db.Domain{newDomain, newDomain}}, true},
+		{"删除后未超出", db.RuleChanges{CreateDomains: []db.Domain{newDomain, newDomain}, DeleteDomains: domains}, false},
+		{"全局规则不限", db.RuleChanges{CreateForwards: []db.Forward{{Name: "a"}, {Name: "b"}, {Name: "c"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRuleQuota(store, 3, tt.changes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRuleQuota() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && ruleioStatus(err) != http.StatusForbidden {
+				t.Errorf("ruleioStatus() = %d, want 403", ruleioStatus(err))
+			}
+		})
+	}
+}
+
+func Test_adminServerReload(t *testing.T) {
+	// 找一个空闲的端口
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	newStore := func(value string) db.Store {
+		store := memory.NewStore()
+		err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{
+			{ClientHost: "127.0.0.1", Name: "example.com", Value: value, DnsType: "A", Enable: true},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	export := func() (string, error) {
+		resp, err := http.Get("http://" + addr + "/api/export?format=hosts")
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	old := newAdminServer(&types.Config{ServerPort: addr}, newStore("10.0.0.1"))
+	if err := old.start(); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := export(); err != nil || !strings.Contains(body, "10.0.0.1") {
+		t.Fatalf("export() = %q, %v", body, err)
+	}
+
+	// 重新加载配置时新实例在旧实例关闭之前启动，并接管同一地址
+	cur := newAdminServer(&types.Config{ServerPort: addr}, newStore("10.0.0.2"))
+	if err := cur.start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := export(); err != nil || !strings.Contains(body, "10.0.0.2") {
+		t.Errorf("export() after reload = %q, %v", body, err)
+	}
+
+	if err := cur.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := export(); err == nil {
+		t.Error("admin server still serving after stop")
+	}
+	// 未启动的服务可以直接停止
+	if err := newAdminServer(&types.Config{ServerPort: addr}, nil).stop(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportExportApi(t *testing.T) {
+	const client = "192.0.2.1" // httptest.NewRequest 的请求者IP
+	store := memory.NewStore()
+	err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{
+		{ClientHost: client, Name: "a.example.com", Value: "10.0.0.1", Ttl: 600, DnsType: "A", Enable: true},
+		{Name: "g.example.com", Value: "10.0.0.9", Ttl: 600, DnsType: "A", Enable: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &types.Config{AdminPassword: "secret", Acl: types.AclConfig{Rules: mustLoadIpSet(client)}}
+	app := newApp(config, store)
+	if err := app.Build(); err != nil {
+		t.Fatal(err)
+	}
+	// serve 以 remoteIp 的身份请求后台接口，admin 为 true 时提供管理员密码
+	serve := func(method, target, body, remoteIp string, admin bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = remoteIp + ":12345"
+		if admin {
+			req.Header.Set("X-Admin-Password", "secret")
+		}
+		rec := httptest.NewRecorder()
+		app.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("导出格式", func(t *testing.T) {
+		tests := []struct {
+			format string
+			status int
+			want   string
+		}{
+			{ruleio.FormatHosts, http.StatusOK, "10.0.0.1\ta.example.com\n"},
+			{ruleio.FormatZone, http.StatusOK, "a.example.com.\t600\tIN\tA\t10.0.0.1\n"},
+			{ruleio.FormatDnsmasq, http.StatusBadRequest, ""},
+		}
+		for _, tt := range tests {
+			rec := serve(http.MethodGet, "/api/export?format="+tt.format, "", client, false)
+			if rec.Code != tt.status || tt.want != "" && rec.Body.String() != tt.want {
+				t.Errorf("export %s = %d %q, want %d %q", tt.format, rec.Code, rec.Body.String(), tt.status, tt.want)
+			}
+		}
+	})
+
+	t.Run("权限", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			method   string
+			target   string
+			remoteIp string
+			admin    bool
+			want     int
+		}{
+			{"导出全局规则", http.MethodGet, "/api/export?format=hosts&global=true", client, false, http.StatusForbidden},
+			{"管理员导出全局规则", http.MethodGet, "/api/export?format=hosts&global=true", client, true, http.StatusOK},
+			{"导出其他客户端的规则", http.MethodGet, "/api/export?format=hosts&client=192.0.2.2", client, false, http.StatusForbidden},
+			{"不允许修改规则的客户端导入", http.MethodPost, "/api/import?format=hosts", "192.0.2.2", false, http.StatusForbidden},
+			{"导入全局规则", http.MethodPost, "/api/import?format=hosts&global=true", client, false, http.StatusForbidden},
+			{"管理员导入全局规则", http.MethodPost, "/api/import?format=hosts&global=true&dryRun=true", "192.0.2.2", true, http.StatusOK},
+			{"导入自己的规则", http.MethodPost, "/api/import?format=hosts&dryRun=true", client, false, http.StatusOK},
+		}
+		for _, tt := range tests {
+			if rec := serve(tt.method, tt.target, "", tt.remoteIp, tt.admin); rec.Code != tt.want {
+				t.Errorf("%s: status = %d, want %d: %s", tt.name, rec.Code, tt.want, rec.Body.String())
+			}
+		}
+		if rec := serve(http.MethodGet, "/api/export?format=hosts&global=true", "", client, true); rec.Body.String() != "10.0.0.9\tg.example.com\n" {
+			t.Errorf("export global = %q", rec.Body.String())
+		}
+	})
+
+	t.Run("导入", func(t *testing.T) {
+		const body = "10.0.0.1 a.example.com\n10.0.0.2 b.example.com\n"
+		// dryRun 时只返回变更而不保存
+		rec := serve(http.MethodPost, "/api/import?format=hosts&replace=true&dryRun=true", body, client, false)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+		}
+		var result ruleio.Result
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		if c := result.Changes; len(c.CreateDomains) != 1 || c.CreateDomains[0].Name != "b.example.com" || c.CreateDomains[0].ClientHost != client ||
+			len(c.UpdateDomains) != 0 || len(c.DeleteDomains) != 0 {
+			t.Errorf("dry run changes = %+v", c)
+		}
+		if domains, _ := store.FindDomainByHost(client); len(domains) != 1 {
+			t.Errorf("dry run saved domains: %+v", domains)
+		}
+
+		if rec := serve(http.MethodPost, "/api/import?format=hosts", body, client, false); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+		}
+		if domains, _ := store.FindDomainByHost(client); len(domains) != 2 {
+			t.Errorf("imported domains = %+v", domains)
+		}
+		if rec := serve(http.MethodPost, "/api/import?format=json", body, client, false); rec.Code != http.StatusBadRequest {
+			t.Errorf("unsupported format status = %d", rec.Code)
+		}
+	})
+}
@@ -2,24 +2,95 @@ package types
 
 import (
 	"crypto/tls"
+	cidrMerger "github.com/laeni/pri-dns/cidr-merger"
 	"time"
 )
 
 // Config 表示插件配置
 type Config struct {
-	ServerPort    string // 控制台管理端口,如果不配置则不会开启控制台
-	AdminPassword string // 管理员身份确认密码，提供该密码可以拥有管理员身份，否则将被视为普通用户
-	StoreType     string
-	MySQL         MySQLConfig
-	Tls           map[string]*tls.Config // TLS 配置。key 为IP，value 为该IP对应的主机名与 TLS 配置
-	HealthCheck   HealthCheckConfig      // 健康检查配置
+	ServerPort    string          // 控制台管理端口,如果不配置则不会开启控制台。以 "unix:" 开头时表示监听 unix socket，如 "unix:/run/pri-dns.sock"
+	ServerTls     ServerTlsConfig // 后台服务的 TLS 配置
+	AdminPassword string          // 管理员身份确认密码，提供该密码可以拥有管理员身份，否则将被视为普通用户
+	// 后台服务前面的可信反向代理，直接连接的对端属于该集合时才根据 Forwarded、X-Forwarded-For、X-Real-IP 请求头确定请求者的IP
+	TrustedProxies *cidrMerger.IpSet
+	ProxyProtocol  bool // 后台服务是否接受 PROXY protocol（v1/v2）
+	StoreType      string
+	SQL            SQLConfig
+	Tls            map[string]*tls.Config       // TLS 配置。key 为IP，value 为该IP对应的主机名与 TLS 配置
+	HealthCheck    HealthCheckConfig            // 健康检查配置
+	IpSets         map[string]*cidrMerger.IpSet // 命名的IP集合，key 为集合名称
+	// 命名的转发应答响应策略，key 为策略名称，转发规则通过 policy 引用
+	ResponsePolicies map[string]ResponsePolicyConfig
+	Fallback         FallbackConfig     // 转发应答被污染时的回退配置
+	DomainLists      []DomainListConfig // 外部域名列表
+	History          HistoryConfig      // 解析历史配置
+	Snapshot         SnapshotConfig     // 规则的本地快照配置
+	// 查询存储出错时的处理策略。servfail | fallthrough | last_good，为空时与 servfail 相同
+	StoreErrorPolicy string
+	RateLimit        RateLimitConfig // 每个客户端的查询速率限制
+	RuleQuota        int             // 每个客户端通过后台接口最多可以拥有的私有规则（解析记录和转发规则）数量，为 0 时不限
+	Acl              AclConfig       // 访问控制
 }
 
-type MySQLConfig struct {
-	DataSourceName  string        // MySQL数据库连接地址
+const (
+	StoreErrorServfail    = "servfail"    // 响应 SERVFAIL
+	StoreErrorFallthrough = "fallthrough" // 交给下一个插件处理
+	StoreErrorLastGood    = "last_good"   // 使用最近一次成功查询到的规则，没有时响应 SERVFAIL
+)
+
+// RateLimitConfig 每个客户端的查询速率限制，转发的查询和本地应答的查询分别计算
+type RateLimitConfig struct {
+	Forward  Rate   // 命中转发规则的查询
+	Local    Rate   // 使用自定义解析应答的查询
+	Response string // 超出限制时的响应。refused | drop | truncate，为空时与 refused 相同
+}
+
+// Rate 令牌桶的速率，QPS 为 0 时表示不限
+type Rate struct {
+	QPS   float64 // 每秒补充的令牌数量
+	Burst int     // 桶的容量，即允许的突发查询数量
+}
+
+const (
+	RateLimitRefused  = "refused"  // 响应 REFUSED
+	RateLimitDrop     = "drop"     // 不响应
+	RateLimitTruncate = "truncate" // 响应设置了 TC 标志的空应答，使客户端通过 TCP 重试；TCP 查询响应 REFUSED
+)
+
+// ResponsePolicyConfig 转发应答的响应策略，依次去除 Exclude 中的IP、去除 AAAA 记录、限制TTL、去除非必要的记录
+type ResponsePolicyConfig struct {
+	MinTtl  uint32            // 记录的最小TTL（秒），小于该值时改为该值，为 0 时不限
+	MaxTtl  uint32            // 记录的最大TTL（秒），大于该值时改为该值，为 0 时不限
+	NoAAAA  bool              // 是否去除 AAAA 记录，用于只使用 IPv4 的规则
+	Exclude *cidrMerger.IpSet // 去除IP属于该集合的 A、AAAA 记录，为 nil 时不去除
+	Minimal bool              // 是否只返回 Answer，有应答时去除 Authority 和 Additional 中的记录
+}
+
+// ServerTlsConfig 后台服务的 TLS 配置，CertFile 为空时表示不使用 TLS。证书文件修改后自动重新加载
+type ServerTlsConfig struct {
+	CertFile     string // 证书文件
+	KeyFile      string // 私钥文件
+	ClientCAFile string // 客户端证书的CA证书文件，配置后要求客户端提供该CA签发的证书
+}
+
+// AclConfig 访问控制配置，限制哪些客户端可以使用插件的功能。各项为 nil 时表示不限制
+type AclConfig struct {
+	Allow   *cidrMerger.IpSet // 允许使用插件的客户端，不属于该集合的客户端的请求将交给下一个插件处理，后台接口响应 403
+	Deny    *cidrMerger.IpSet // 禁止使用插件的客户端，优先于 Allow
+	Forward *cidrMerger.IpSet // 允许使用转发规则的客户端
+	Admin   *cidrMerger.IpSet // 允许访问后台接口的客户端
+	Rules   *cidrMerger.IpSet // 允许通过后台接口修改自己的私有规则的客户端，管理员不受限制
+}
+
+// SQLConfig 关系型数据库配置
+type SQLConfig struct {
+	Driver          string        // 数据库驱动。mysql | postgres | sqlite
+	DataSourceName  string        // 数据库连接地址
 	MaxIdleConns    int           // 空闲连接池中连接的最大数量（默认：2）
 	MaxOpenConns    int           // 打开数据库连接的最大数量(默认：0,无限制)
 	ConnMaxLifetime time.Duration // 连接可复用的最大时间
+	AutoMigrate     bool          // 是否在启动时自动执行表结构迁移
+	PollInterval    time.Duration // 查询规则是否变更的间隔，为 0 时使用默认值（10s）
 }
 
 // HealthCheckConfig 为健康检查配置，配置时格式与 forward 插件配置相同
@@ -28,3 +99,33 @@ type HealthCheckConfig struct {
 	HcRecursionDesired bool
 	HcDomain           string
 }
+
+// FallbackConfig 用于判断上游的应答是否被污染，被污染的应答将使用转发规则中的回退DNS服务器重新解析
+type FallbackConfig struct {
+	Bogus  []string // IP集合名称，应答中只要有IP属于其中任意集合就视为被污染
+	Expect []string // IP集合名称，应答中只要有IP不属于其中任何集合就视为被污染
+}
+
+// DomainListConfig 外部域名列表配置，转发规则的域名为 "@名称" 时表示该规则适用于列表中的所有域名
+type DomainListConfig struct {
+	Name    string        // 列表名称
+	Source  string        // 列表来源，可以是本地文件路径或者 http(s) 地址
+	Format  string        // 列表格式。plain | dnsmasq | gfwlist
+	Refresh time.Duration // 刷新间隔，为 0 时表示只在启动时加载一次
+}
+
+// SnapshotConfig 规则的本地快照配置，存储不可用时使用快照中的规则
+type SnapshotConfig struct {
+	Path    string        // 快照文件路径，为空时表示不使用快照
+	Refresh time.Duration // 从存储加载规则并更新快照的间隔
+}
+
+// HistoryConfig 解析历史配置
+type HistoryConfig struct {
+	Expire        time.Duration // 解析历史的过期时间，超过该时间未再解析到的IP将被定期清理，为 0 时表示永不过期
+	FlushInterval time.Duration // 写入解析历史的间隔，为 0 时使用默认值（1m）
+	BatchSize     int           // 待写入的IP数量达到该值时立即写入，为 0 时使用默认值（1000）
+	QueueSize     int           // 等待汇总的解析结果队列长度，队列已满时丢弃新的解析结果，为 0 时使用默认值（1000）
+	CaptureDomain bool          // 是否将自定义解析的应答记录到对应的转发规则的解析历史
+	CaptureNext   bool          // 是否将匹配转发规则但交给下一个插件处理（如客户端不允许使用转发）的查询的应答记录到该规则的解析历史
+}
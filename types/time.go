@@ -15,6 +15,16 @@ func (t *LocalTime) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%s\"", format)), nil
 }
 
+// UnmarshalJSON 解析 MarshalJSON 输出的格式，时间按本地时区解析
+func (t *LocalTime) UnmarshalJSON(data []byte) error {
+	t2, err := time.ParseInLocation("\"2006-01-02 15:04:05\"", string(data), time.Local)
+	if err != nil {
+		return err
+	}
+	*t = LocalTime(t2)
+	return nil
+}
+
 // 实现 Scanner 接口
 func (t *LocalTime) Scan(src interface{}) error {
 	t2, ok := src.(time.Time)
@@ -0,0 +1,83 @@
+package pri_dns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/laeni/pri-dns/db"
+	"github.com/laeni/pri-dns/db/memory"
+	"github.com/laeni/pri-dns/types"
+	"github.com/miekg/dns"
+)
+
+// 两个实例共享同一存储，通过其中一个实例修改规则后，另一个实例缓存的规则将被清理
+func TestWatchRules(t *testing.T) {
+	store := &failingStore{Store: memory.NewStore()}
+	err := store.SaveRules(db.RuleChanges{CreateDomains: []db.Domain{
+		{Name: "example.com", Value: "10.0.0.1", Ttl: 60, DnsType: "A", Enable: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newInstance := func() *PriDns {
+		d := NewPriDns(&types.Config{StoreErrorPolicy: types.StoreErrorLastGood}, store)
+		d.Next = test.NextHandler(dns.RcodeRefused, nil)
+		if err := d.initFunc(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = d.closeFunc() })
+		return d
+	}
+	a, b := newInstance(), newInstance()
+
+	query := func(d *PriDns) (int, string) {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		code, _ := d.ServeDNS(context.Background(), rec, r)
+		if rec.Msg == nil || len(rec.Msg.Answer) == 0 {
+			return code, ""
+		}
+		return code, rec.Msg.Answer[0].(*dns.A).A.String()
+	}
+	if _, ip := query(b); ip != "10.0.0.1" {
+		t.Fatalf("b answered %q before change", ip)
+	}
+
+	// 通过实例 a 修改规则
+	domains, err := a.Store.FindDomainByHost("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains[0].Value = "10.0.0.2"
+	if err := a.Store.SaveRules(db.RuleChanges{UpdateDomains: domains}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 等待实例 b 处理变更通知，之后存储不可用时不会再使用变更前缓存的规则
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.lastGood.mu.RLock()
+		n := len(b.lastGood.domains)
+		b.lastGood.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b did not receive change notification")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.fail = true
+	if code, ip := query(b); code != dns.RcodeServerFailure || ip != "" {
+		t.Errorf("b answered %d %q with stale cache", code, ip)
+	}
+	store.fail = false
+	if _, ip := query(b); ip != "10.0.0.2" {
+		t.Errorf("b answered %q after change", ip)
+	}
+}